@@ -3,104 +3,187 @@ package backend
 // This is horrible...don't look here yet
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
 	"github.com/voutilad/bolt-proxy/bolt"
 )
 
 var magic = []byte{0x60, 0x60, 0xb0, 0x17}
 
-// Use the provided []byte as a Hello message to try authenticating with the
-// provided address, forcing the use of the given version []byte.
-//
-// If useTls, dial the address with the TLS dialer routine.
-//
-// On success, return a net.Conn that's pass the bolt handshake and has been
-// authenticated and is ready for transactions. Otherwise, return nil and the
-// error.
-func authClient(hello, version []byte, network, address string, useTls bool) (net.Conn, error) {
-	var conn net.Conn
-	var err error
+// Returned by authClient when the host won't speak the version we offered
+var ErrVersionRefused = errors.New("host refused the offered bolt version")
 
+// Dial the address with the TLS dialer routine if useTls, giving up after
+// timeout (if not 0).
+func dialHost(network, address string, useTls bool, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
 	// XXX: For now, we use the default TLS config, so probably won't work
 	// with self-signed certificates.
 	if useTls {
 		conf := &tls.Config{}
-		conn, err = tls.Dial(network, address, conf)
-	} else {
-		conn, err = net.Dial(network, address)
+		return tls.DialWithDialer(dialer, network, address, conf)
 	}
-	if err != nil {
-		return nil, err
+	return dialer.Dial(network, address)
+}
+
+// Perform the Bolt handshake (bolt magic + version list) on conn, offering
+// up to 4 versions or ranges, and return the version the server picked.
+// A server that picks none of them results in ErrVersionRefused.
+func handshake(conn net.Conn, offers ...bolt.VersionRange) (bolt.Version, error) {
+	if len(offers) > 4 {
+		offers = offers[:4]
+	}
+	buf := make([]byte, 20)
+	copy(buf, magic)
+	for i, offer := range offers {
+		slot := buf[4+i*4 : 8+i*4]
+		copy(slot, offer.Max.Bytes())
+		slot[1] = offer.Back
 	}
 
-	// Bolt handshake (bolt magic + version list)
-	handshake := append(magic, version...)
-	handshake = append(handshake, []byte{
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00}...)
-	_, err = conn.Write(handshake)
+	_, err := conn.Write(buf)
 	if err != nil {
-		msg := fmt.Sprintf("couldn't send handshake to auth server %s: %s", address, err)
-		conn.Close()
-		return nil, errors.New(msg)
+		return bolt.Version{}, fmt.Errorf("couldn't send handshake to server %s: %s",
+			conn.RemoteAddr(), err)
 	}
 
 	// Server should pick a version and provide as 4-byte array
-	// TODO: we eventually need version handling...for now ignore :-/
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
-	if err != nil || n != 4 {
-		msg := fmt.Sprintf("didn't get valid handshake response from auth server %s: %s", address, err)
-		conn.Close()
-		return nil, errors.New(msg)
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return bolt.Version{}, fmt.Errorf("didn't get valid handshake response from server %s: %s",
+			conn.RemoteAddr(), err)
+	}
+	version, _ := bolt.ParseVersion(buf[:4])
+	if version == (bolt.Version{}) {
+		return version, ErrVersionRefused
+	}
+	return version, nil
+}
+
+// How long a host gets to answer our attempt to authenticate
+const AUTH_TIMEOUT = 30 * time.Second
+
+// How long we try connecting to a host on a client's behalf, so one that's
+// unreachable doesn't hold up the client's handshake
+const DIAL_TIMEOUT = 5 * time.Second
+
+// Use the provided Hello to try authenticating with the provided address,
+// offering only the given version, which is what our client speaks. Since
+// Bolt 5.1 that takes a HELLO and a LOGON carrying the auth. The encoded
+// messages are scrubbed once they're sent.
+//
+// If useTls, dial the address with the TLS dialer routine.
+//
+// On success, return a BoltConn that's pass the bolt handshake and has been
+// authenticated and is ready for transactions, along with the metadata of
+// the server's reply to the HELLO. Otherwise, return nil and the error,
+// which is ErrVersionRefused if the host doesn't speak the version.
+func authClient(hello *bolt.Hello, version bolt.Version, network, address string, useTls bool) (bolt.BoltConn, map[string]interface{}, error) {
+	conn, err := dialHost(network, address, useTls, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
 	}
+	conn.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
 
-	// Try performing the bolt auth the given hello message
-	_, err = conn.Write(hello)
+	chosen, err := handshake(conn, bolt.VersionRange{Max: version})
+	if err == nil && chosen != version {
+		err = ErrVersionRefused
+	}
 	if err != nil {
-		msg := fmt.Sprintf("failed to send hello buffer to server %s: %s", address, err)
 		conn.Close()
-		return nil, errors.New(msg)
+		return nil, nil, err
 	}
+	// from here on, the DirectConn keeps track of read deadlines
+	conn.SetDeadline(time.Time{})
 
-	n, err = conn.Read(buf)
+	messages, err := authMessages(hello, version)
 	if err != nil {
-		msg := fmt.Sprintf("failed to get auth response from auth server %s: %s", address, err)
 		conn.Close()
-		return nil, errors.New(msg)
+		return nil, nil, err
+	}
+	server := bolt.NewDirectConn(conn)
+	// the size limit is for clients, whereas servers send what they're
+	// asked for, however big
+	server.SetMaxMessageSize(0)
+	server.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
+
+	// Try performing the bolt auth with the given hello message
+	err = server.WriteMessages(messages)
+	for _, msg := range messages {
+		msg.Release()
+	}
+	if err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("failed to send hello to server %s: %s", address, err)
 	}
 
-	msg := bolt.IdentifyType(buf)
-	if msg == bolt.FailureMsg {
-		// See if we can extract the error message
-		r, _, err := bolt.ParseMap(buf[4:n])
+	// There's a reply for each message, all of which must be a SUCCESS
+	var metadata map[string]interface{}
+	for i := range messages {
+		reply, err := server.ReadMessage(context.Background())
 		if err != nil {
-			conn.Close()
-			return nil, err
+			server.Close()
+			return nil, nil, fmt.Errorf("failed to get auth response from auth server %s: %s", address, err)
 		}
 
-		val, found := r["message"]
-		if found {
-			failmsg, ok := val.(string)
-			if ok {
-				conn.Close()
-				return nil, errors.New(failmsg)
+		switch reply.T {
+		case bolt.SuccessMsg:
+			success := bolt.Success{}
+			if err = success.Decode(reply); err == nil && i == 0 {
+				metadata = success.Metadata
 			}
+			reply.Release()
+		case bolt.FailureMsg:
+			// See if we can extract the error message
+			failure := bolt.Failure{}
+			err = failure.Decode(reply)
+			reply.Release()
+			server.Close()
+			if err != nil {
+				return nil, nil, errors.New("could not parse auth server response")
+			}
+			return nil, nil, errors.New(failure.Message)
+		default:
+			// Try to be polite and say goodbye if we know we failed.
+			reply.Release()
+			goodbye, _ := (&bolt.Goodbye{}).Encode()
+			server.WriteMessage(goodbye)
+			server.Close()
+			return nil, nil, errors.New("unknown error from auth server")
 		}
-		conn.Close()
-		return nil, errors.New("could not parse auth server response")
-	} else if msg == bolt.SuccessMsg {
-		// The only happy outcome! Keep conn open.
-		return conn, nil
 	}
 
-	// Try to be polite and say goodbye if we know we failed.
-	conn.Write([]byte{0x00, 0x02, 0xb0, 0x02})
-	conn.Close()
-	return nil, errors.New("unknown error from auth server")
+	// The only happy outcome! Keep conn open.
+	server.SetDeadline(time.Time{})
+	return server, metadata, nil
+}
+
+// The messages it takes to authenticate with hello in the given version:
+// just the HELLO, or since Bolt 5.1, a HELLO then a LOGON with the auth.
+func authMessages(hello *bolt.Hello, version bolt.Version) ([]*bolt.Message, error) {
+	if !bolt.CatalogFor(version).Allows(bolt.LogonMsg) {
+		msg, err := hello.Encode()
+		if err != nil {
+			return nil, err
+		}
+		return []*bolt.Message{msg}, nil
+	}
+
+	bare, logon := hello.SplitAuth()
+	first, err := bare.Encode()
+	if err != nil {
+		return nil, err
+	}
+	second, err := logon.Encode()
+	if err != nil {
+		first.Release()
+		return nil, err
+	}
+	return []*bolt.Message{first, second}, nil
 }
@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+func TestLargeServerMessages(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// a host that follows its SUCCESS for the HELLO with a RECORD bigger
+	// than a client may send
+	big := strings.Repeat("x", bolt.DefaultMaxMessageSize)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 20)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		chosen, _ := bolt.ValidateHandshake(buf[4:20], bolt.Version{Major: 4, Minor: 4}.Bytes())
+		if _, err := conn.Write(chosen); err != nil {
+			return
+		}
+
+		client := bolt.NewDirectConn(conn)
+		if _, err := client.ReadMessage(context.Background()); err != nil {
+			return
+		}
+		success := bolt.NewSuccess()
+		record, _ := (&bolt.Record{Values: []interface{}{big}}).Encode()
+		client.WriteMessages([]*bolt.Message{success, record})
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	hello := &bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+		Credentials: bolt.NewCredentials([]byte("password"))}
+	server, _, err := authClient(hello, bolt.Version{Major: 4, Minor: 4},
+		"tcp", listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg, err := server.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != bolt.RecordMsg || len(msg.Data) <= bolt.DefaultMaxMessageSize {
+		t.Fatalf("expected the whole RECORD, got %s of %d bytes\n", msg.T, len(msg.Data))
+	}
+}
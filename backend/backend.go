@@ -2,6 +2,7 @@ package backend
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"sync"
@@ -13,15 +14,33 @@ import (
 type Backend struct {
 	monitor *Monitor
 	tls     bool
-	log     *log.Logger
+	// if set, every host is reached through this Unix domain socket
+	socket string
+	log    *log.Logger
 	// map of principals -> hosts -> connections
 	connectionPool map[string]map[string]bolt.BoltConn
 	routingCache   map[string]RoutingTable
 	info           ClusterInfo
+	infoLock       sync.Mutex
+	// what Bolt version each host speaks, by host, and the one we offer
+	// clients as of the last check
+	versions     map[string]bolt.Version
+	offered      bolt.Version
+	versionsLock sync.Mutex
+	// if set, clients newer than a host get translated for it
+	translate bool
+	// load balancing policies by database ("" for the rest), and the
+	// balancers using them
+	policies      map[string]string
+	balancers     map[string]LoadBalancer
+	balancersLock sync.Mutex
+	// if set, there's no monitor and info and routingCache never expire
+	static bool
 }
 
 func NewBackend(logger *log.Logger, username, password string, uri string, hosts ...string) (*Backend, error) {
 	tls := false
+	socket := ""
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
@@ -31,6 +50,14 @@ func NewBackend(logger *log.Logger, username, password string, uri string, hosts
 		tls = true
 	case "bolt", "neo4j":
 		// ok
+	case UNIX_SCHEME:
+		if u.Path == "" {
+			return nil, errors.New("missing socket path in bolt+unix uri")
+		}
+		socket = u.Path
+		if err := checkUnixSocket(socket); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, errors.New("invalid neo4j connection scheme")
 	}
@@ -40,14 +67,46 @@ func NewBackend(logger *log.Logger, username, password string, uri string, hosts
 		return nil, err
 	}
 
-	return &Backend{
+	b := &Backend{
 		monitor:        monitor,
 		tls:            tls,
+		socket:         socket,
 		log:            logger,
 		connectionPool: make(map[string]map[string]bolt.BoltConn),
 		routingCache:   make(map[string]RoutingTable),
 		info:           <-monitor.Info,
-	}, nil
+		versions:       make(map[string]bolt.Version),
+	}
+	b.refreshVersions()
+	go b.watchVersions()
+	return b, nil
+}
+
+// A Backend for a cluster that never changes: info's hosts, running the
+// given Neo4j version and serving the given routing tables, none of which
+// expire. Nothing monitors it, which makes it handy for tests.
+func NewStaticBackend(logger *log.Logger, version Version, info ClusterInfo, tables ...RoutingTable) *Backend {
+	b := &Backend{
+		monitor:        &Monitor{Version: version},
+		log:            logger,
+		connectionPool: make(map[string]map[string]bolt.BoltConn),
+		routingCache:   make(map[string]RoutingTable),
+		info:           info,
+		versions:       make(map[string]bolt.Version),
+		static:         true,
+	}
+	for _, table := range tables {
+		b.routingCache[table.Name] = table
+	}
+	b.refreshVersions()
+	return b
+}
+
+// Let clients speak a newer Bolt version than some (or all) of the hosts,
+// translating their messages (see bolt.Translator) instead of leaving
+// those hosts out
+func (b *Backend) EnableTranslation() {
+	b.translate = true
 }
 
 func (b *Backend) Version() Version {
@@ -56,9 +115,12 @@ func (b *Backend) Version() Version {
 
 func (b *Backend) RoutingTable(db string) (RoutingTable, error) {
 	table, found := b.routingCache[db]
-	if found && !table.Expired() {
+	if found && (b.static || !table.Expired()) {
 		return table, nil
 	}
+	if b.static {
+		return RoutingTable{}, fmt.Errorf("no routing table for %s", db)
+	}
 
 	table, err := b.monitor.UpdateRoutingTable(db)
 	if err != nil {
@@ -70,9 +132,10 @@ func (b *Backend) RoutingTable(db string) (RoutingTable, error) {
 }
 
 func (b *Backend) ClusterInfo() (ClusterInfo, error) {
-	// XXX: this technically isn't thread safe as we mutate b.info
+	b.infoLock.Lock()
+	defer b.infoLock.Unlock()
 
-	if b.info.CreatedAt.Add(30 * time.Second).Before(time.Now()) {
+	if !b.static && b.info.CreatedAt.Add(30*time.Second).Before(time.Now()) {
 		select {
 		case <-time.After(30 * time.Second):
 			return ClusterInfo{}, errors.New("timeout waiting for updated ClusterInfo")
@@ -84,47 +147,74 @@ func (b *Backend) ClusterInfo() (ClusterInfo, error) {
 	return b.info, nil
 }
 
+// Network and address to dial for the given host
+func (b *Backend) dialAddress(host string) (string, string) {
+	if b.socket != "" {
+		return "unix", b.socket
+	}
+	return "tcp", host
+}
+
 // For now, we'll authenticate to all known hosts up-front to simplify things.
 // So for a given Hello message, use it to auth against all hosts known in the
-// current routing table.
+// current routing table. The Hello's Credentials are zeroed once we're done.
 //
-// Returns an map[string] of hosts to bolt.BoltConn's if successful, an empty
-// map and an error if not.
-func (b *Backend) Authenticate(hello *bolt.Message) (map[string]bolt.BoltConn, error) {
-	if hello.T != bolt.HelloMsg {
-		panic("authenticate requires a Hello message")
-	}
+// Every connection speaks the given version, the one our client speaks.
+// Hosts that can't (e.g. mid rolling upgrade) are left out, unless we
+// translate, in which case they speak their own version behind a
+// bolt.TranslatingConn. Since Bolt 5.1, the Hello's auth gets sent
+// separately in a LOGON.
+//
+// Returns an map[string] of hosts to bolt.BoltConn's if successful, along
+// with the metadata of the first host's reply to the HELLO (e.g. any
+// patch_bolt it agreed to). Returns an empty map and an error if not.
+func (b *Backend) Authenticate(hello *bolt.Hello, version bolt.Version) (map[string]bolt.BoltConn, map[string]interface{}, error) {
+	defer hello.Credentials.Zero()
 
-	// TODO: clean up this api...push the dirt into Bolt package?
-	msg, pos, err := bolt.ParseMap(hello.Data[4:])
-	if err != nil {
-		b.log.Printf("XXX pos: %d, hello map: %#v\n", pos, msg)
-		panic(err)
-	}
-	principal, ok := msg["principal"].(string)
-	if !ok {
-		panic("principal in Hello message was not a string")
-	}
+	principal := hello.Principal
 	b.log.Println("found principal:", principal)
 
-	// Try authing first with a Core cluster member before we try others
-	// this way we can fail fast and not spam a bad set of credentials
-	info, err := b.ClusterInfo()
-	if err != nil {
-		return nil, err
+	// Hosts we translate for can't agree to patches, like the utc one
+	// for 4.3 & 4.4, and everyone has to send the same datetimes
+	if b.translate && hello.Extra["patch_bolt"] != nil {
+		stripped := *hello
+		stripped.Extra = make(map[string]interface{}, len(hello.Extra))
+		for key, val := range hello.Extra {
+			if key != "patch_bolt" {
+				stripped.Extra[key] = val
+			}
+		}
+		hello = &stripped
 	}
-	defaultHost := info.Hosts[0]
 
-	b.log.Printf("trying to auth %s to host %s\n", principal, defaultHost)
-	conn, err := authClient(hello.Data, b.Version().Bytes(),
-		"tcp", defaultHost, b.tls)
+	info, err := b.ClusterInfo()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Ok, now to get the rest
+	// Try authing first with one host before we try others, this way we
+	// can fail fast and not spam a bad set of credentials. Hosts that
+	// don't speak the version don't count.
 	conns := make(map[string]bolt.BoltConn, len(info.Hosts))
-	conns[defaultHost] = bolt.NewDirectConn(conn)
+	var metadata map[string]interface{}
+	rest := info.Hosts
+	for len(conns) == 0 && len(rest) > 0 {
+		host := rest[0]
+		rest = rest[1:]
+
+		b.log.Printf("trying to auth %s to host %s\n", principal, host)
+		conn, meta, err := b.authHost(hello, version, host)
+		if err == ErrVersionRefused {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		conns[host] = conn
+		metadata = meta
+	}
+	if len(conns) == 0 {
+		return nil, nil, fmt.Errorf("no host speaks %s", version)
+	}
 
 	// We'll need a channel to collect results as we're going to auth
 	// to all hosts asynchronously
@@ -132,23 +222,20 @@ func (b *Backend) Authenticate(hello *bolt.Message) (map[string]bolt.BoltConn, e
 		conn bolt.BoltConn
 		host string
 	}
-	c := make(chan pair, len(info.Hosts)+1)
+	c := make(chan pair, len(rest))
 	var wg sync.WaitGroup
-	for _, host := range info.Hosts {
-		// skip the host we already used to test auth
-		if host != defaultHost {
-			wg.Add(1)
-			go func(h string) {
-				defer wg.Done()
-				conn, err := authClient(hello.Data, b.Version().Bytes(), "tcp", h, b.tls)
-				if err != nil {
-					b.log.Printf("failed to auth %s to %s!?\n", principal, h)
-					return
-				}
-				b.log.Printf("auth'd %s to host %s\n", principal, h)
-				c <- pair{bolt.NewDirectConn(conn), h}
-			}(host)
-		}
+	for _, host := range rest {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			conn, _, err := b.authHost(hello, version, h)
+			if err != nil {
+				b.log.Printf("failed to auth %s to %s!? %s\n", principal, h, err)
+				return
+			}
+			b.log.Printf("auth'd %s to host %s\n", principal, h)
+			c <- pair{conn, h}
+		}(host)
 	}
 
 	wg.Wait()
@@ -159,5 +246,34 @@ func (b *Backend) Authenticate(hello *bolt.Message) (map[string]bolt.BoltConn, e
 	}
 
 	b.log.Printf("auth'd principal to %d hosts\n", len(conns))
-	return conns, err
+	return conns, metadata, nil
+}
+
+// Authenticate to a single host with the given version. If it refuses the
+// version, we forget what we thought it spoke. If we translate, a host that
+// only speaks an older version gets that instead.
+func (b *Backend) authHost(hello *bolt.Hello, version bolt.Version, host string) (bolt.BoltConn, map[string]interface{}, error) {
+	t := bolt.Translator{Client: version, Server: version}
+	if b.translate {
+		hostVersion, err := b.HostVersion(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hostVersion.AtLeast(version) {
+			t.Server = hostVersion
+			hello = t.Hello(hello)
+		}
+	}
+
+	network, address := b.dialAddress(host)
+	conn, metadata, err := authClient(hello, t.Server, network, address, b.tls)
+	if err == ErrVersionRefused {
+		b.log.Printf("host %s doesn't speak %s\n", host, t.Server)
+		b.forgetVersion(host)
+	}
+	if err != nil || !t.Needed() {
+		return conn, metadata, err
+	}
+	b.log.Printf("translating %s for host %s speaking %s\n", version, host, t.Server)
+	return bolt.NewTranslatingConn(conn, t.Client, t.Server), metadata, nil
 }
@@ -0,0 +1,219 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing policies, by name
+const (
+	ROUND_ROBIN       string = "round-robin"
+	RANDOM            string = "random"
+	LEAST_OUTSTANDING string = "least-outstanding"
+	EWMA_LATENCY      string = "ewma"
+	// what databases get unless told otherwise
+	DEFAULT_POLICY = ROUND_ROBIN
+)
+
+// How much a new latency sample counts towards a host's EWMA
+const EWMA_WEIGHT = 0.3
+
+// The latency counted against a host that never answered a transaction, so
+// it doesn't keep winning for lack of samples
+const EWMA_PENALTY = 10 * time.Second
+
+// Picks which of the hosts able to serve a transaction gets it (e.g. one of
+// the readers for a read). Done gets called once that transaction is over,
+// with how long the host took to first answer it (0 if it never did), so
+// policies can keep track of load.
+type LoadBalancer interface {
+	Pick(hosts []string) string
+	Done(host string, latency time.Duration)
+}
+
+// Create a LoadBalancer using the named policy
+func NewLoadBalancer(policy string) (LoadBalancer, error) {
+	switch policy {
+	case ROUND_ROBIN:
+		return &roundRobin{}, nil
+	case RANDOM:
+		return &random{}, nil
+	case LEAST_OUTSTANDING:
+		return &leastOutstanding{outstanding: make(map[string]int)}, nil
+	case EWMA_LATENCY:
+		return &ewmaLatency{latency: make(map[string]float64)}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing policy %q", policy)
+	}
+}
+
+// Each host in turn
+type roundRobin struct {
+	sync.Mutex
+	next int
+}
+
+func (r *roundRobin) Pick(hosts []string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.next = (r.next + 1) % len(hosts)
+	return hosts[r.next]
+}
+
+func (r *roundRobin) Done(host string, latency time.Duration) {}
+
+// Any host, at random
+type random struct{}
+
+func (r *random) Pick(hosts []string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	return hosts[rand.Intn(len(hosts))]
+}
+
+func (r *random) Done(host string, latency time.Duration) {}
+
+// The host with the fewest transactions we've picked it for that aren't
+// done yet. Ties go round robin, so idle hosts share the work.
+type leastOutstanding struct {
+	roundRobin
+	outstanding map[string]int
+}
+
+func (l *leastOutstanding) Pick(hosts []string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	l.next = (l.next + 1) % len(hosts)
+	best := hosts[l.next]
+	for i := 1; i < len(hosts); i++ {
+		host := hosts[(l.next+i)%len(hosts)]
+		if l.outstanding[host] < l.outstanding[best] {
+			best = host
+		}
+	}
+	l.outstanding[best]++
+	return best
+}
+
+func (l *leastOutstanding) Done(host string, latency time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.outstanding[host] > 0 {
+		l.outstanding[host]--
+	}
+}
+
+// The host that's been quickest to answer lately, going by an exponentially
+// weighted moving average of its latency. Hosts we've no numbers for yet
+// come first, ties go round robin, and not answering at all counts as
+// taking EWMA_PENALTY.
+type ewmaLatency struct {
+	roundRobin
+	// in nanoseconds, by host
+	latency map[string]float64
+}
+
+func (e *ewmaLatency) Pick(hosts []string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	e.Lock()
+	defer e.Unlock()
+
+	e.next = (e.next + 1) % len(hosts)
+	best := hosts[e.next]
+	for i := 1; i < len(hosts); i++ {
+		host := hosts[(e.next+i)%len(hosts)]
+		if e.latency[host] < e.latency[best] {
+			best = host
+		}
+	}
+	return best
+}
+
+func (e *ewmaLatency) Done(host string, latency time.Duration) {
+	if latency <= 0 {
+		latency = EWMA_PENALTY
+	}
+	e.Lock()
+	defer e.Unlock()
+
+	sample := float64(latency)
+	if avg, found := e.latency[host]; found {
+		sample = EWMA_WEIGHT*sample + (1-EWMA_WEIGHT)*avg
+	}
+	e.latency[host] = sample
+}
+
+// Use the named policy for picking hosts for transactions against db, or
+// for any database not given its own if db is empty
+func (b *Backend) SetBalancer(db, policy string) error {
+	if _, err := NewLoadBalancer(policy); err != nil {
+		return err
+	}
+	b.balancersLock.Lock()
+	defer b.balancersLock.Unlock()
+	if b.policies == nil {
+		b.policies = make(map[string]string)
+	}
+	b.policies[db] = policy
+	b.balancers = nil
+	return nil
+}
+
+// The LoadBalancer for picking hosts for transactions against db
+func (b *Backend) Balancer(db string) LoadBalancer {
+	b.balancersLock.Lock()
+	defer b.balancersLock.Unlock()
+
+	if balancer, found := b.balancers[db]; found {
+		return balancer
+	}
+	policy, found := b.policies[db]
+	if !found {
+		policy, found = b.policies[""]
+	}
+	if !found {
+		policy = DEFAULT_POLICY
+	}
+	balancer, _ := NewLoadBalancer(policy)
+	if b.balancers == nil {
+		b.balancers = make(map[string]LoadBalancer)
+	}
+	b.balancers[db] = balancer
+	return balancer
+}
+
+// Set load balancing policies from a comma separated list, where each
+// entry is either db=policy or, for every other database, just a policy
+// (e.g. "least-outstanding,movies=ewma")
+func (b *Backend) SetBalancers(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		db, policy := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			db, policy = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if db == "" {
+				return fmt.Errorf("missing database in %q", entry)
+			}
+		}
+		if err := b.SetBalancer(db, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
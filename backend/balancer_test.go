@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBalancersSpreadLoad(t *testing.T) {
+	rt := RoutingTable{Name: "movies",
+		Readers: []string{"core1:7687", "core2:7687", "replica1:7687", "replica2:7687"},
+		Writers: []string{"core1:7687"}}
+	const picks = 4000
+
+	for _, policy := range []string{ROUND_ROBIN, RANDOM, LEAST_OUTSTANDING, EWMA_LATENCY} {
+		balancer, err := NewLoadBalancer(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for i := 0; i < picks; i++ {
+			host := balancer.Pick(rt.Readers)
+			counts[host]++
+			balancer.Done(host, time.Millisecond)
+		}
+
+		expected := picks / len(rt.Readers)
+		for _, host := range rt.Readers {
+			if counts[host] < expected*85/100 || counts[host] > expected*115/100 {
+				t.Fatalf("%s: expected about %d picks of %s, got %v\n", policy, expected, host, counts)
+			}
+		}
+		if host := balancer.Pick(rt.Writers); host != "core1:7687" {
+			t.Fatalf("%s: expected the only writer, got %s\n", policy, host)
+		}
+		if host := balancer.Pick(nil); host != "" {
+			t.Fatalf("%s: expected no host, got %s\n", policy, host)
+		}
+	}
+
+	if _, err := NewLoadBalancer("fastest"); err == nil {
+		t.Fatal("expected an unknown policy to fail")
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	balancer, _ := NewLoadBalancer(LEAST_OUTSTANDING)
+
+	// nothing finishes, so each gets one before anyone gets two
+	seen := make(map[string]bool)
+	for range hosts {
+		seen[balancer.Pick(hosts)] = true
+	}
+	if len(seen) != len(hosts) {
+		t.Fatalf("expected every host picked once, got %v\n", seen)
+	}
+
+	// b is the only one not busy
+	balancer.Done("b", 0)
+	if host := balancer.Pick(hosts); host != "b" {
+		t.Fatalf("expected b, got %s\n", host)
+	}
+}
+
+func TestEwmaLatency(t *testing.T) {
+	hosts := []string{"slow", "fast"}
+	balancer, _ := NewLoadBalancer(EWMA_LATENCY)
+
+	balancer.Done("slow", 50*time.Millisecond)
+	balancer.Done("fast", 5*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if host := balancer.Pick(hosts); host != "fast" {
+			t.Fatalf("expected fast, got %s\n", host)
+		}
+	}
+
+	// hosts we know nothing about get a try first
+	if host := balancer.Pick(append(hosts, "new")); host != "new" {
+		t.Fatalf("expected new, got %s\n", host)
+	}
+
+	// fast slowing down enough tips it over to slow
+	for i := 0; i < 10; i++ {
+		balancer.Done("fast", 100*time.Millisecond)
+	}
+	if host := balancer.Pick(hosts); host != "slow" {
+		t.Fatalf("expected slow, got %s\n", host)
+	}
+
+	// a host that never answers doesn't win for lack of numbers
+	hosts = []string{"dead", "live"}
+	balancer, _ = NewLoadBalancer(EWMA_LATENCY)
+	balancer.Done("live", 50*time.Millisecond)
+	balancer.Done("dead", 0)
+	for i := 0; i < 10; i++ {
+		if host := balancer.Pick(hosts); host != "live" {
+			t.Fatalf("expected live, got %s\n", host)
+		}
+	}
+}
+
+func TestBalancerPerDatabase(t *testing.T) {
+	b := newTestBackend(Version{Major: 4, Minor: 4})
+
+	if _, ok := b.Balancer("movies").(*roundRobin); !ok {
+		t.Fatalf("expected round robin by default, got %T\n", b.Balancer("movies"))
+	}
+	if err := b.SetBalancers("least-outstanding, movies=ewma"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Balancer("movies").(*ewmaLatency); !ok {
+		t.Fatalf("expected ewma for movies, got %T\n", b.Balancer("movies"))
+	}
+	if _, ok := b.Balancer("neo4j").(*leastOutstanding); !ok {
+		t.Fatalf("expected least outstanding for neo4j, got %T\n", b.Balancer("neo4j"))
+	}
+	if b.Balancer("neo4j") != b.Balancer("neo4j") {
+		t.Fatal("expected a database to keep its balancer")
+	}
+
+	for _, spec := range []string{"fastest", "=random", "movies=fastest"} {
+		if err := b.SetBalancers(spec); err == nil {
+			t.Fatalf("expected %q to fail\n", spec)
+		}
+	}
+}
@@ -45,6 +45,13 @@ func (v Version) String() string {
 		v.Extra)
 }
 
+// Returns true if the server has multiple databases, which came with Neo4j
+// 4.0 along with SHOW DATABASES and dbms.routing.getRoutingTable. Older
+// servers, like 3.5, have just the one and speak Bolt 3.
+func (v Version) MultiDb() bool {
+	return v.Major >= 4
+}
+
 func (v Version) Bytes() []byte {
 	return []byte{
 		0x00, 0x00,
@@ -53,7 +60,7 @@ func (v Version) Bytes() []byte {
 }
 
 func (m Monitor) UpdateRoutingTable(db string) (RoutingTable, error) {
-	return getRoutingTable(m.driver, db, m.Host)
+	return getRoutingTable(m.driver, m.Version, db, m.Host)
 }
 
 // Our default Driver configuration provides:
@@ -176,11 +183,15 @@ func NewMonitor(user, password, uri string, hosts ...string) (*Monitor, error) {
 		return nil, err
 	}
 	host := u.Host
+	if u.Scheme == UNIX_SCHEME {
+		// all we know is it's local
+		host = "localhost"
+	}
 	if u.Port() == "" {
 		host = host + ":7687"
 	}
 
-	info, err := getClusterInfo(&driver, host)
+	info, err := getClusterInfo(&driver, version, host)
 	if err != nil {
 		return nil, err
 	}
@@ -201,7 +212,7 @@ func NewMonitor(user, password, uri string, hosts ...string) (*Monitor, error) {
 		for {
 			select {
 			case <-ticker.C:
-				info, err := getClusterInfo(monitor.driver, monitor.Host)
+				info, err := getClusterInfo(monitor.driver, monitor.Version, monitor.Host)
 				if err != nil {
 					// TODO: how do we handle faults???
 					panic(err)
@@ -243,7 +254,24 @@ CALL dbms.routing.getRoutingTable({address: $host}, $db)
   YIELD ttl, servers
 UNWIND servers AS server
 UNWIND server["addresses"] AS address
-RETURN server["role"] AS role, address
+RETURN ttl, server["role"] AS role, address
+`
+
+// Same thing for Neo4j 3.5, which has no databases to ask about
+const LEGACY_ROUTING_QUERY = `
+CALL dbms.cluster.routing.getRoutingTable({address: $host})
+  YIELD ttl, servers
+UNWIND servers AS server
+UNWIND server["addresses"] AS address
+RETURN ttl, server["role"] AS role, address
+`
+
+// The Bolt address of each Neo4j 3.5 cluster member, as host:port
+const OVERVIEW_QUERY = `
+CALL dbms.cluster.overview() YIELD addresses
+WITH [a IN addresses WHERE a STARTS WITH "bolt://"][0] AS address
+WHERE address IS NOT NULL
+RETURN substring(address, size("bolt://")) AS address
 `
 
 // Given a neo4j.Transaction tx, collect the routing table maps for each of
@@ -252,8 +280,8 @@ RETURN server["role"] AS role, address
 //
 // The true data type is a table struct, mapping providing arrays of readers,
 // writers, and routers for the given db
-func routingTableTx(tx neo4j.Transaction, host string, db string) (interface{}, error) {
-	result, err := tx.Run(ROUTING_QUERY, map[string]interface{}{
+func routingTableTx(tx neo4j.Transaction, query, host, db string) (interface{}, error) {
+	result, err := tx.Run(query, map[string]interface{}{
 		"db":   db,
 		"host": host,
 	})
@@ -266,15 +294,26 @@ func routingTableTx(tx neo4j.Transaction, host string, db string) (interface{},
 		return nil, err
 	}
 
-	// expected fields: [role, address]
+	// expected fields: [ttl, role, address]
 	t := RoutingTable{
-		Name:    db,
-		Readers: []string{},
-		Writers: []string{},
-		Routers: []string{},
+		Name:      db,
+		Readers:   []string{},
+		Writers:   []string{},
+		Routers:   []string{},
+		CreatedAt: time.Now(),
 	}
 	for _, row := range rows {
-		val, found := row.Get("address")
+		val, found := row.Get("ttl")
+		if !found {
+			return nil, errors.New("missing ttl field in result")
+		}
+		ttl, ok := val.(int64)
+		if !ok {
+			return nil, errors.New("ttl isn't an integer")
+		}
+		t.Ttl = time.Duration(ttl) * time.Second
+
+		val, found = row.Get("address")
 		if !found {
 			return nil, errors.New("missing address field in result")
 		}
@@ -309,13 +348,17 @@ func routingTableTx(tx neo4j.Transaction, host string, db string) (interface{},
 
 // Using a pointer to a connected neo4j.Driver, orchestrate fetching the
 // routing table for a given database while using the provided host
-// routing context.
-func getRoutingTable(driver *neo4j.Driver, db, host string) (RoutingTable, error) {
+// routing context. Neo4j 3.5 only has the one table, whatever the db.
+func getRoutingTable(driver *neo4j.Driver, version Version, db, host string) (RoutingTable, error) {
 	session := (*driver).NewSession(neo4j.SessionConfig{})
 	defer session.Close()
 
+	query := ROUTING_QUERY
+	if !version.MultiDb() {
+		query = LEGACY_ROUTING_QUERY
+	}
 	result, err := session.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return routingTableTx(tx, host, db)
+		return routingTableTx(tx, query, host, db)
 	})
 	if err != nil {
 		return RoutingTable{}, err
@@ -329,7 +372,11 @@ func getRoutingTable(driver *neo4j.Driver, db, host string) (RoutingTable, error
 }
 
 // Populate a ClusterInfo instance with critical details on our backend
-func getClusterInfo(driver *neo4j.Driver, host string) (ClusterInfo, error) {
+func getClusterInfo(driver *neo4j.Driver, version Version, host string) (ClusterInfo, error) {
+	if !version.MultiDb() {
+		return getLegacyClusterInfo(driver, host)
+	}
+
 	session := (*driver).NewSession(neo4j.SessionConfig{
 		DatabaseName: "system",
 	})
@@ -381,7 +428,63 @@ func getClusterInfo(driver *neo4j.Driver, host string) (ClusterInfo, error) {
 	}
 
 	// For now get details for System db...
-	rt, err := getRoutingTable(driver, "system", host)
+	rt, err := getRoutingTable(driver, version, "system", host)
+	if err != nil {
+		return info, err
+	}
+	hosts := map[string]bool{}
+	for _, host := range append(rt.Readers, rt.Writers...) {
+		hosts[host] = true
+	}
+	for host := range hosts {
+		info.Hosts = append(info.Hosts, host)
+	}
+	return info, nil
+}
+
+// Populate a ClusterInfo for a Neo4j 3.5 backend, which has no system db
+// to ask and a single database that Bolt 3 clients can't name, so there's
+// no DefaultDb. Members come from the cluster overview, or the routing
+// table for a standalone server, which has no overview.
+func getLegacyClusterInfo(driver *neo4j.Driver, host string) (ClusterInfo, error) {
+	session := (*driver).NewSession(neo4j.SessionConfig{})
+	defer session.Close()
+
+	info := ClusterInfo{CreatedAt: time.Now()}
+	result, err := session.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		result, err := tx.Run(OVERVIEW_QUERY, nil)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := result.Collect()
+		if err != nil {
+			return nil, err
+		}
+
+		hosts := []string{}
+		for _, row := range rows {
+			val, found := row.Get("address")
+			if !found {
+				return nil, errors.New("missing 'address' field")
+			}
+			addr, ok := val.(string)
+			if !ok {
+				return nil, errors.New("address field isn't a string")
+			}
+			hosts = append(hosts, addr)
+		}
+		return hosts, nil
+	})
+	if err == nil {
+		hosts, ok := result.([]string)
+		if !ok {
+			panic("result isn't a []string")
+		}
+		info.Hosts = hosts
+		return info, nil
+	}
+
+	rt, err := getRoutingTable(driver, Version{Major: 3}, "", host)
 	if err != nil {
 		return info, err
 	}
@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+// How often we ask the hosts again about the Bolt versions they speak, e.g.
+// in case one got upgraded
+const VERSION_TTL = 30 * time.Second
+
+// How long a host gets to answer our asking, before we count it as
+// unreachable
+const PROBE_TIMEOUT = 5 * time.Second
+
+// The versions we offer a host when asking what it speaks, the way the
+// drivers do it: servers older than 4.3 don't know about ranges, so 4.1 and
+// 4.0 get offered on their own. A handshake only has room for four offers,
+// so if a host turns them all down we ask again with the next set, which
+// is how we find Neo4j 3.5 speaking Bolt 3.
+var probeOffers = [][]bolt.VersionRange{
+	{
+		{Max: bolt.MaxVersion, Back: bolt.MaxVersion.Minor},
+		{Max: bolt.Version{Major: 4, Minor: 4}, Back: 2},
+		{Max: bolt.Version{Major: 4, Minor: 1}},
+		{Max: bolt.Version{Major: 4, Minor: 0}},
+	},
+	{
+		{Max: bolt.Version{Major: 3, Minor: 0}},
+	},
+}
+
+// Connect to the host just long enough to see which of our offers it
+// picks
+func probeVersion(network, address string, useTls bool, offers []bolt.VersionRange) (bolt.Version, error) {
+	conn, err := dialHost(network, address, useTls, PROBE_TIMEOUT)
+	if err != nil {
+		return bolt.Version{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+	return handshake(conn, offers...)
+}
+
+// The newest Bolt version the host speaks, asking it if we don't know yet
+func (b *Backend) HostVersion(host string) (bolt.Version, error) {
+	b.versionsLock.Lock()
+	known, found := b.versions[host]
+	b.versionsLock.Unlock()
+	if found {
+		return known, nil
+	}
+	return b.probeHost(host)
+}
+
+// Ask the host which Bolt version it speaks, and remember it
+func (b *Backend) probeHost(host string) (bolt.Version, error) {
+	network, address := b.dialAddress(host)
+	var version bolt.Version
+	var err error
+	for _, offers := range probeOffers {
+		version, err = probeVersion(network, address, b.tls, offers)
+		if err != ErrVersionRefused {
+			break
+		}
+	}
+	if err != nil {
+		b.forgetVersion(host)
+		return bolt.Version{}, err
+	}
+
+	b.versionsLock.Lock()
+	known, found := b.versions[host]
+	b.versions[host] = version
+	b.versionsLock.Unlock()
+	if !found || version != known {
+		b.log.Printf("host %s speaks %s\n", host, version)
+	}
+	return version, nil
+}
+
+// Drop what we know about the host's version, so we ask it next time
+func (b *Backend) forgetVersion(host string) {
+	b.versionsLock.Lock()
+	delete(b.versions, host)
+	b.versionsLock.Unlock()
+}
+
+// The oldest of the versions the hosts speak, according to lookup, which
+// gets called for all of them at once. Hosts we can't reach don't get a
+// say. If we can't reach any, we go with the Neo4j version the monitor
+// found, as far as bolt.MaxVersion, or Bolt 3 for Neo4j 3.5.
+func (b *Backend) lowestVersion(hosts []string, lookup func(string) (bolt.Version, error)) bolt.Version {
+	versions := make([]bolt.Version, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			v, err := lookup(host)
+			if err != nil {
+				b.log.Printf("can't get bolt version of host %s: %s\n", host, err)
+			}
+			versions[i] = v
+		}(i, host)
+	}
+	wg.Wait()
+
+	var version bolt.Version
+	for _, v := range versions {
+		if v == (bolt.Version{}) {
+			continue
+		}
+		if version == (bolt.Version{}) || !v.AtLeast(version) {
+			version = v
+		}
+	}
+
+	if version == (bolt.Version{}) {
+		version = bolt.Version{Major: b.Version().Major, Minor: b.Version().Minor}
+		if version.AtLeast(bolt.MaxVersion) {
+			version = bolt.MaxVersion
+		} else if !b.Version().MultiDb() {
+			version = bolt.Version{Major: 3}
+		}
+	}
+	return version
+}
+
+// The newest Bolt version every host in the cluster spoke when we last
+// asked them all, which is what we offer clients. During a rolling upgrade
+// that's the oldest member's. Handshaking with a client never waits on the
+// hosts, as they're asked in the background.
+func (b *Backend) OfferedVersion() bolt.Version {
+	b.versionsLock.Lock()
+	defer b.versionsLock.Unlock()
+	return b.offered
+}
+
+// Ask every host in the cluster which version it speaks, all at once, and
+// work out what to offer clients
+func (b *Backend) refreshVersions() {
+	info, err := b.ClusterInfo()
+	if err != nil {
+		b.log.Printf("can't check host versions: %s\n", err)
+		info = ClusterInfo{}
+	}
+	version := b.lowestVersion(info.Hosts, b.probeHost)
+
+	// hosts that left the cluster get forgotten
+	current := make(map[string]bool, len(info.Hosts))
+	for _, host := range info.Hosts {
+		current[host] = true
+	}
+	b.versionsLock.Lock()
+	for host := range b.versions {
+		if !current[host] {
+			delete(b.versions, host)
+		}
+	}
+	b.offered = version
+	b.versionsLock.Unlock()
+}
+
+// Refresh the versions every VERSION_TTL, for as long as we run
+func (b *Backend) watchVersions() {
+	for range time.Tick(VERSION_TTL) {
+		b.refreshVersions()
+	}
+}
@@ -0,0 +1,244 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+// A pretend Neo4j host speaking up to the given version, which happily
+// authenticates anyone. It agrees to any patches asked for in a HELLO and
+// hands each auth message it gets to seen, if there is one.
+func fakeHost(t *testing.T, version bolt.Version, seen chan<- *bolt.Message) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 20)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				chosen, _ := bolt.ValidateHandshake(buf[4:20], version.Bytes())
+				if _, err := conn.Write(chosen); err != nil {
+					return
+				}
+
+				client := bolt.NewDirectConn(conn)
+				for {
+					msg, err := client.ReadMessage(context.Background())
+					if err != nil {
+						return
+					}
+					metadata := map[string]interface{}{}
+					hello := bolt.Hello{}
+					if hello.Decode(msg) == nil && hello.Extra["patch_bolt"] != nil {
+						metadata["patch_bolt"] = hello.Extra["patch_bolt"]
+					}
+					if seen != nil {
+						seen <- msg
+					}
+					success, _ := (&bolt.Success{Metadata: metadata}).Encode()
+					client.WriteMessage(success)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newTestBackend(version Version, hosts ...string) *Backend {
+	return &Backend{
+		monitor:  &Monitor{Version: version},
+		log:      log.New(ioutil.Discard, "", 0),
+		info:     ClusterInfo{Hosts: hosts, CreatedAt: time.Now()},
+		versions: make(map[string]bolt.Version),
+	}
+}
+
+func TestRollingUpgrade(t *testing.T) {
+	upgraded := fakeHost(t, bolt.Version{Major: 4, Minor: 4}, nil)
+	old := fakeHost(t, bolt.Version{Major: 4, Minor: 3}, nil)
+	b := newTestBackend(Version{Major: 4, Minor: 4}, upgraded, old)
+
+	if v, err := b.HostVersion(old); err != nil || v != (bolt.Version{Major: 4, Minor: 3}) {
+		t.Fatalf("expected the old host to speak 4.3, got %s (%v)\n", v, err)
+	}
+	if v := b.OfferedVersion(); v != (bolt.Version{}) {
+		t.Fatalf("expected no offer before a refresh, got %s\n", v)
+	}
+	b.refreshVersions()
+	if v := b.OfferedVersion(); v != (bolt.Version{Major: 4, Minor: 3}) {
+		t.Fatalf("expected to offer clients 4.3 after a refresh, got %s\n", v)
+	}
+
+	// a client that already settled on 4.4 only gets the upgraded host
+	creds := bolt.NewCredentials([]byte("password"))
+	hello := &bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+		Credentials: creds}
+	pool, _, err := b.Authenticate(hello, bolt.Version{Major: 4, Minor: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := pool[upgraded]; !found || len(pool) != 1 {
+		t.Fatalf("expected only the upgraded host, got %v\n", pool)
+	}
+	for _, conn := range pool {
+		conn.Close()
+	}
+	if creds.Bytes() != nil {
+		t.Fatal("expected credentials to be zeroed after authenticating")
+	}
+
+	// nobody speaks 5.0
+	hello.Credentials = bolt.NewCredentials([]byte("password"))
+	if _, _, err = b.Authenticate(hello, bolt.Version{Major: 5}); err == nil {
+		t.Fatal("expected authenticating with 5.0 to fail")
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	host := fakeHost(t, bolt.Version{Major: 3}, nil)
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = handshake(conn, bolt.VersionRange{Max: bolt.Version{Major: 4, Minor: 4}, Back: 4})
+	if err != ErrVersionRefused {
+		t.Fatalf("expected ErrVersionRefused, got %v\n", err)
+	}
+}
+
+func TestBolt3Backend(t *testing.T) {
+	seen := make(chan *bolt.Message, 1)
+	host := fakeHost(t, bolt.Version{Major: 3}, seen)
+	b := newTestBackend(Version{Major: 3, Minor: 5, Patch: 28}, host)
+
+	b.refreshVersions()
+	if v := b.OfferedVersion(); v != (bolt.Version{Major: 3}) {
+		t.Fatalf("expected to offer clients Bolt 3, got %s\n", v)
+	}
+
+	hello := &bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+		Credentials: bolt.NewCredentials([]byte("password"))}
+	pool, _, err := b.Authenticate(hello, bolt.Version{Major: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range pool {
+		conn.Close()
+	}
+	if msg := <-seen; msg.T != bolt.HelloMsg || !bytes.Contains(msg.Data, []byte("password")) {
+		t.Fatalf("expected a HELLO with the credentials, got %s\n", msg.T)
+	}
+
+	// with nobody to ask, the server version has to do
+	b = newTestBackend(Version{Major: 3, Minor: 5})
+	b.refreshVersions()
+	if v := b.OfferedVersion(); v != (bolt.Version{Major: 3}) {
+		t.Fatalf("expected Bolt 3 for Neo4j 3.5, got %s\n", v)
+	}
+}
+
+func TestAuthenticateWithLogon(t *testing.T) {
+	seen := make(chan *bolt.Message, 4)
+	host := fakeHost(t, bolt.Version{Major: 5, Minor: 4}, seen)
+	b := newTestBackend(Version{Major: 5, Minor: 20}, host)
+
+	b.refreshVersions()
+	if v := b.OfferedVersion(); v != bolt.MaxVersion {
+		t.Fatalf("expected to offer clients %s, got %s\n", bolt.MaxVersion, v)
+	}
+
+	for _, version := range []bolt.Version{{Major: 5, Minor: 0}, {Major: 5, Minor: 1}} {
+		hello := &bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+			Credentials: bolt.NewCredentials([]byte("password")),
+			Extra:       map[string]interface{}{"patch_bolt": []interface{}{"utc"}}}
+		pool, metadata, err := b.Authenticate(hello, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, conn := range pool {
+			conn.Close()
+		}
+		if metadata["patch_bolt"] == nil {
+			t.Fatalf("expected the HELLO's metadata, got %v\n", metadata)
+		}
+
+		// 5.0 still authenticates in the HELLO
+		first := <-seen
+		if first.T != bolt.HelloMsg {
+			t.Fatalf("expected a HELLO, got %s\n", first.T)
+		}
+		if !version.AtLeast(bolt.Version{Major: 5, Minor: 1}) {
+			if !bytes.Contains(first.Data, []byte("password")) {
+				t.Fatal("expected the credentials in the HELLO")
+			}
+			continue
+		}
+		second := <-seen
+		if second.T != bolt.LogonMsg || bytes.Contains(first.Data, []byte("password")) {
+			t.Fatalf("expected the credentials in a LOGON, got %s\n", second.T)
+		}
+		logon := bolt.Logon{}
+		if err = logon.Decode(second); err != nil {
+			t.Fatal(err)
+		}
+		if logon.Principal != "neo4j" || string(logon.Credentials.Bytes()) != "password" {
+			t.Fatalf("unexpected LOGON %#v\n", logon)
+		}
+	}
+}
+
+func TestAuthenticateTranslated(t *testing.T) {
+	seen := make(chan *bolt.Message, 4)
+	current := fakeHost(t, bolt.Version{Major: 5, Minor: 4}, nil)
+	old := fakeHost(t, bolt.Version{Major: 4, Minor: 0}, seen)
+	b := newTestBackend(Version{Major: 5, Minor: 20}, current, old)
+	b.EnableTranslation()
+
+	hello := &bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+		Credentials: bolt.NewCredentials([]byte("password")),
+		Extra:       map[string]interface{}{"bolt_agent": map[string]interface{}{"product": "test"}}}
+	pool, _, err := b.Authenticate(hello, bolt.Version{Major: 5, Minor: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, conn := range pool {
+			conn.Close()
+		}
+	}()
+	if _, ok := pool[current].(bolt.TranslatingConn); ok || len(pool) != 2 {
+		t.Fatalf("expected both hosts, only translating for the old one, got %v\n", pool)
+	}
+	if _, ok := pool[old].(bolt.TranslatingConn); !ok {
+		t.Fatalf("expected to translate for the old host, got %T\n", pool[old])
+	}
+
+	// the old host authenticates in its HELLO, without the 5.3 bolt_agent
+	msg := <-seen
+	if msg.T != bolt.HelloMsg || !bytes.Contains(msg.Data, []byte("password")) ||
+		bytes.Contains(msg.Data, []byte("bolt_agent")) {
+		t.Fatalf("unexpected %s for a 4.0 host: %#v\n", msg.T, msg.Data)
+	}
+}
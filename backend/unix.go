@@ -0,0 +1,20 @@
+package backend
+
+import (
+	"net"
+)
+
+// Scheme for backends reachable through a Unix domain socket, e.g.
+// bolt+unix:///var/run/neo4j/bolt.sock
+const UNIX_SCHEME = "bolt+unix"
+
+// Make sure there's something listening on the socket at path before we
+// count on it. The Neo4j driver behind our Monitor dials the socket
+// itself, as do we for every host.
+func checkUnixSocket(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
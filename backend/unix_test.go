@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bolt.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("can't listen on a unix socket: %s\n", err)
+	}
+	defer listener.Close()
+
+	if err = checkUnixSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkUnixSocket(filepath.Join(dir, "nope.sock")); err == nil {
+		t.Fatal("expected an error checking a missing socket")
+	}
+
+	// every host is reached through the socket
+	b := &Backend{socket: path}
+	if network, address := b.dialAddress("core-1:7687"); network != "unix" || address != path {
+		t.Fatalf("expected the socket, got %s %s\n", network, address)
+	}
+	b = &Backend{}
+	if network, address := b.dialAddress("core-1:7687"); network != "tcp" || address != "core-1:7687" {
+		t.Fatalf("expected the host over tcp, got %s %s\n", network, address)
+	}
+}
@@ -332,8 +332,9 @@ func TestSerializingInts(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal([]byte{0xc8, 0x99}, buf) {
-		t.Fatalf("expected 0xc8, 0x99 but saw %#v\n", buf)
+	// INT_8 is signed, so 153 needs an INT_16
+	if !bytes.Equal([]byte{0xc9, 0x00, 0x99}, buf) {
+		t.Fatalf("expected 0xc9, 0x00, 0x99 but saw %#v\n", buf)
 	}
 
 	buf, err = IntToBytes(5128)
@@ -370,7 +371,7 @@ func TestHorribleThings(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	out, err := TinyMapToBytes(m1)
+	out, err := Pack(m1)
 	if err != nil {
 		t.Fatal(err)
 	}
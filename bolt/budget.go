@@ -0,0 +1,131 @@
+package bolt
+
+import (
+	"sync"
+	"time"
+)
+
+// How many bytes a BoltConn reads ahead of its consumer when it hasn't
+// been given a Budget. Enough for a handful of small messages; larger
+// ones are read one at a time.
+const DefaultReadAhead = 64 * 1024
+
+// Limits the bytes BoltConns may read off the wire before anyone has
+// picked up the resulting Messages. Once a Budget is spent, the conns
+// drawing on it stop reading from their sockets until Messages are
+// consumed, pushing back on the peer via TCP flow control.
+//
+// Budgets nest: a Budget with a parent draws on both, so a session's
+// Budget can share a global one. A limit of 0 (or less) means unlimited.
+// A single Message bigger than the limit is let through on its own, so
+// large results slow down rather than stall forever.
+type Budget struct {
+	limit  int64
+	parent *Budget
+
+	lock sync.Mutex
+	// closed (and replaced) whenever bytes are released
+	freed   chan struct{}
+	used    int64
+	queued  int
+	waiting int
+	stalls  int64
+	stalled time.Duration
+}
+
+// A snapshot of a Budget's usage
+type BudgetStats struct {
+	Limit int64
+	// bytes read but not yet consumed, and the Messages they make up
+	InFlight int64
+	Queued   int
+	// readers currently blocked on the Budget
+	Waiting int
+	// how often readers had to wait, and for how long in total
+	Stalls  int64
+	Stalled time.Duration
+}
+
+func NewBudget(limit int64, parent *Budget) *Budget {
+	return &Budget{
+		limit:  limit,
+		parent: parent,
+		freed:  make(chan struct{}),
+	}
+}
+
+func (b *Budget) Stats() BudgetStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BudgetStats{
+		Limit:    b.limit,
+		InFlight: b.used,
+		Queued:   b.queued,
+		Waiting:  b.waiting,
+		Stalls:   b.stalls,
+		Stalled:  b.stalled,
+	}
+}
+
+// Take n bytes from this Budget and its parents, waiting for room as
+// needed. Gives up with ErrClosed if done is closed first.
+func (b *Budget) acquire(n int64, done <-chan struct{}) error {
+	for p := b; p != nil; p = p.parent {
+		if err := p.take(n, done); err != nil {
+			for q := b; q != p; q = q.parent {
+				q.give(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Return n bytes to this Budget and its parents
+func (b *Budget) release(n int64) {
+	for p := b; p != nil; p = p.parent {
+		p.give(n)
+	}
+}
+
+func (b *Budget) take(n int64, done <-chan struct{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var since time.Time
+	for b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		if since.IsZero() {
+			since = time.Now()
+			b.stalls++
+			b.waiting++
+			defer func() {
+				b.waiting--
+				b.stalled = b.stalled + time.Since(since)
+			}()
+		}
+
+		freed := b.freed
+		b.lock.Unlock()
+		select {
+		case <-freed:
+			b.lock.Lock()
+		case <-done:
+			b.lock.Lock()
+			return ErrClosed
+		}
+	}
+
+	b.used = b.used + n
+	b.queued++
+	return nil
+}
+
+func (b *Budget) give(n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used = b.used - n
+	b.queued--
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
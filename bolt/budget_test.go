@@ -0,0 +1,87 @@
+package bolt
+
+import (
+	"testing"
+	"time"
+)
+
+// Wait for someone to block on the Budget
+func waitForStall(t *testing.T, b *Budget) {
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Stats().Waiting == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a reader to stall")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBudgetNesting(t *testing.T) {
+	global := NewBudget(100, nil)
+	session := NewBudget(60, global)
+	done := make(chan struct{})
+
+	if err := session.acquire(50, done); err != nil {
+		t.Fatal(err)
+	}
+	if stats := global.Stats(); stats.InFlight != 50 || stats.Queued != 1 {
+		t.Fatalf("expected the global budget charged too, got %+v\n", stats)
+	}
+
+	// too much for the session, so wait for a release
+	acquired := make(chan error)
+	go func() {
+		acquired <- session.acquire(20, done)
+	}()
+	waitForStall(t, session)
+	session.release(50)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	stats := session.Stats()
+	if stats.InFlight != 20 || stats.Waiting != 0 || stats.Stalls != 1 {
+		t.Fatalf("unexpected session stats: %+v\n", stats)
+	}
+	if global.Stats().InFlight != 20 {
+		t.Fatalf("expected 20 bytes in flight globally, got %+v\n", global.Stats())
+	}
+}
+
+func TestBudgetOversizedAndClosed(t *testing.T) {
+	b := NewBudget(10, nil)
+	done := make(chan struct{})
+
+	// a message bigger than the whole budget gets through alone...
+	if err := b.acquire(50, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...but nothing gets through with it, unless we give up
+	acquired := make(chan error)
+	go func() {
+		acquired <- b.acquire(1, done)
+	}()
+	waitForStall(t, b)
+	close(done)
+	if err := <-acquired; err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v\n", err)
+	}
+
+	b.release(50)
+	if stats := b.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("expected nothing in flight, got %+v\n", stats)
+	}
+}
+
+func TestBudgetUnlimited(t *testing.T) {
+	b := NewBudget(0, nil)
+	for i := 0; i < 10; i++ {
+		if err := b.acquire(1<<20, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := b.Stats(); stats.InFlight != 10<<20 || stats.Stalls != 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
@@ -0,0 +1,158 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The largest chunk a 2-byte chunk header can describe
+const MaxChunkSize = 0xffff
+
+// Splits PackStream payloads into Bolt chunks, each prefixed with its
+// 2-byte big-endian length, followed by the 0x00 0x00 end-of-message
+// marker.
+//
+// The zero value uses chunks of up to MaxChunkSize bytes. A smaller Size
+// is mostly useful for exercising peers' reassembly logic.
+type Chunker struct {
+	Size int
+}
+
+func (c Chunker) size() int {
+	if c.Size <= 0 || c.Size > MaxChunkSize {
+		return MaxChunkSize
+	}
+	return c.Size
+}
+
+// Append the chunked form of payload to dst, returning the extended slice
+func (c Chunker) AppendChunks(dst, payload []byte) []byte {
+	max := c.size()
+
+	for len(payload) > 0 {
+		size := len(payload)
+		if size > max {
+			size = max
+		}
+		dst = append(dst, byte(size>>8), byte(size))
+		dst = append(dst, payload[:size]...)
+		payload = payload[size:]
+	}
+
+	return append(dst, 0x00, 0x00)
+}
+
+// Chunk a payload into a new buffer
+func (c Chunker) Chunk(payload []byte) []byte {
+	chunks := len(payload)/c.size() + 1
+	return c.AppendChunks(make([]byte, 0, len(payload)+2*chunks+2), payload)
+}
+
+// Chunk a payload into a new Message, identifying its Type
+func (c Chunker) Message(payload []byte) *Message {
+	data := c.Chunk(payload)
+	return &Message{T: IdentifyType(data), Data: data}
+}
+
+// Reassembles whole Bolt messages from a stream of chunked bytes that may
+// be split at arbitrary points, e.g. across short reads or WebSocket
+// frames. Feed it with Write and collect complete messages with Next.
+//
+// The zero value is ready to use. A Dechunker is not safe for concurrent
+// use.
+type Dechunker struct {
+	buf []byte
+	// start of the first message we haven't handed out yet
+	start int
+	// offset of the next chunk header we haven't inspected yet, so we
+	// don't rescan chunks of a large message on every Write
+	scan int
+}
+
+// Buffer more bytes from the stream. Never fails.
+func (d *Dechunker) Write(p []byte) (int, error) {
+	if d.start > 0 {
+		d.compact()
+	}
+	if d.buf == nil {
+		d.buf = getBuffer(len(p))[:0]
+	}
+	d.buf = append(growBuffer(d.buf, len(p)), p...)
+	return len(p), nil
+}
+
+// Hand back our buffer once everything in it has been handed out, so an
+// idle Dechunker doesn't hold onto one
+func (d *Dechunker) release() {
+	putBuffer(d.buf)
+	d.buf = nil
+	d.start, d.scan = 0, 0
+}
+
+// Shift any partial message to the front of our buffer, scrubbing what's
+// left behind so old messages don't linger in memory.
+func (d *Dechunker) compact() {
+	n := copy(d.buf, d.buf[d.start:])
+	for i := n; i < len(d.buf); i++ {
+		d.buf[i] = 0x00
+	}
+	d.buf = d.buf[:n]
+	d.scan = d.scan - d.start
+	d.start = 0
+}
+
+// Number of bytes buffered that aren't yet part of a complete message
+func (d *Dechunker) Buffered() int {
+	return len(d.buf) - d.start
+}
+
+// Return the next complete Message, if we have one. The Message's Data
+// is a copy of its chunks, including the end-of-message marker. A lone
+// 0x00 0x00 (a NOOP keep-alive in Bolt 4.1+) comes back as a NopMsg.
+func (d *Dechunker) Next() (*Message, bool) {
+	for d.scan+2 <= len(d.buf) {
+		size := int(binary.BigEndian.Uint16(d.buf[d.scan:]))
+		if size == 0 {
+			end := d.scan + 2
+			data := getBuffer(end - d.start)
+			copy(data, d.buf[d.start:end])
+
+			d.start, d.scan = end, end
+			if d.start == len(d.buf) {
+				d.release()
+			}
+			return &Message{T: IdentifyType(data), Data: data, pooled: true}, true
+		}
+
+		if len(d.buf)-d.scan-2 < size {
+			break
+		}
+		d.scan = d.scan + 2 + size
+	}
+	return nil, false
+}
+
+// Reassemble the chunks in a Message's Data into a single PackStream
+// payload, stopping at the 0x00 0x00 end-of-message marker (if present).
+func dechunk(data []byte) ([]byte, error) {
+	payload := make([]byte, 0, len(data))
+	pos := 0
+
+	for pos+2 <= len(data) {
+		size := int(data[pos])<<8 | int(data[pos+1])
+		pos = pos + 2
+		if size == 0 {
+			return payload, nil
+		}
+		if len(data)-pos < size {
+			return nil, errors.New("chunk size exceeds message data")
+		}
+		payload = append(payload, data[pos:pos+size]...)
+		pos = pos + size
+	}
+
+	if pos != len(data) {
+		return nil, errors.New("trailing bytes after last chunk")
+	}
+	return payload, nil
+}
@@ -0,0 +1,83 @@
+package bolt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkingLargePayloads(t *testing.T) {
+	payload := make([]byte, 2*MaxChunkSize+10)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	data := Chunker{}.Chunk(payload)
+	if len(data) != len(payload)+3*2+2 {
+		t.Fatalf("expected 3 chunks plus a terminator, got %d bytes\n", len(data))
+	}
+	if data[0] != 0xff || data[1] != 0xff {
+		t.Fatalf("expected first chunk to be full, got %#x %#x\n", data[0], data[1])
+	}
+
+	out, err := dechunk(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, out) {
+		t.Fatal("payload didn't survive chunking")
+	}
+
+	small := Chunker{Size: 2}.Chunk([]byte{0xb1, 0x71, 0x91, 0x01})
+	expected := []byte{0x0, 0x2, 0xb1, 0x71, 0x0, 0x2, 0x91, 0x01, 0x0, 0x0}
+	if !bytes.Equal(expected, small) {
+		t.Fatalf("expected %#v, got %#v\n", expected, small)
+	}
+}
+
+func TestDechunkingSplitStreams(t *testing.T) {
+	record := Chunker{Size: 3}.Message([]byte{0xb1, 0x71, 0x93, 0x01, 0x02, 0x03})
+	success, _ := (&Success{Metadata: map[string]interface{}{"has_more": false}}).Encode()
+	stream := append(append(append([]byte{}, record.Data...), 0x0, 0x0), success.Data...)
+
+	// feed the stream in every possible pair of pieces
+	for split := 0; split <= len(stream); split++ {
+		d := Dechunker{}
+		d.Write(stream[:split])
+
+		messages := []*Message{}
+		for msg, ok := d.Next(); ok; msg, ok = d.Next() {
+			messages = append(messages, msg)
+		}
+		d.Write(stream[split:])
+		for msg, ok := d.Next(); ok; msg, ok = d.Next() {
+			messages = append(messages, msg)
+		}
+
+		if len(messages) != 3 {
+			t.Fatalf("split at %d: expected 3 messages, got %d\n", split, len(messages))
+		}
+		if messages[0].T != RecordMsg || !bytes.Equal(record.Data, messages[0].Data) {
+			t.Fatalf("split at %d: unexpected first message %#v\n", split, messages[0])
+		}
+		if messages[1].T != NopMsg {
+			t.Fatalf("split at %d: expected a NOOP, got %s\n", split, messages[1].T)
+		}
+		if messages[2].T != SuccessMsg || !bytes.Equal(success.Data, messages[2].Data) {
+			t.Fatalf("split at %d: unexpected last message %#v\n", split, messages[2])
+		}
+		if d.Buffered() != 0 {
+			t.Fatalf("split at %d: expected empty buffer, have %d bytes\n", split, d.Buffered())
+		}
+	}
+}
+
+func TestDechunkingPartialMessage(t *testing.T) {
+	d := Dechunker{}
+	d.Write([]byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x01})
+	if msg, ok := d.Next(); ok {
+		t.Fatalf("expected no message without an end marker, got %#v\n", msg)
+	}
+	if d.Buffered() != 6 {
+		t.Fatalf("expected 6 buffered bytes, got %d\n", d.Buffered())
+	}
+}
@@ -2,11 +2,15 @@ package bolt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/gobwas/ws"
 )
@@ -14,73 +18,96 @@ import (
 // An abstraction of a Bolt-aware io.ReadWriterCloser. Allows for sending and
 // receiving Messages, abstracting away the nuances of the transport.
 //
-// R() should simply be a means of accessing the channel containining any
-// available Messages. (Might rename this later.) They should be handled async
-// by the conncetion instance.
+// ReadMessage() waits for the next complete Message until the context is
+// done or the deadline passes, in which case the Message (if any) is left
+// for the next call. A Message that's already been read is returned even
+// if the context is done, so passing a done context polls. Once the
+// connection is done for, it returns the same error as Err(): io.EOF for
+// a clean hang-up, or whatever went wrong.
 //
 // WriteMessage() should synchronously try to write a Bolt Message to the
-// connection.
+// connection. WriteMessages() does the same for several Messages at once
+// (e.g. a pipelined RUN and PULL), with as few writes as it can.
+//
+// SetDeadline() sets a deadline for future reads and writes, just like a
+// net.Conn. A zero time means no deadline. SetReadDeadline() only sets the
+// one for reads, e.g. to give up on an idle peer without cutting off a
+// long write to it.
+//
+// SetBudget() bounds how much gets read ahead of ReadMessage(). Until
+// then, a BoltConn reads at most DefaultReadAhead bytes ahead.
 type BoltConn interface {
-	R() <-chan *Message
+	ReadMessage(ctx context.Context) (*Message, error)
 	WriteMessage(*Message) error
+	WriteMessages([]*Message) error
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetBudget(b *Budget)
+	Err() error
 	io.Closer
 }
 
+// Implemented by BoltConns that can relay what they read straight to
+// another BoltConn instead of handing every Message to ReadMessage.
+// Passing nil stops forwarding.
+type Forwarder interface {
+	Forward(dst BoltConn)
+}
+
 // Designed for operating direct (e.g. TCP/IP-only) Bolt connections
 type DirectConn struct {
-	conn      io.ReadWriteCloser
-	buf, temp []byte
-	r         <-chan *Message
-	chunking  bool
+	conn   io.ReadWriteCloser
+	reader *connReader
+	queue  *messageQueue
+	wlock  *sync.Mutex
+	fwd    *forwarding
 }
 
-// Used for WebSocket-based Bolt connections
+// The biggest WebSocket frame we'll read, even with no limit on messages
+const maxFrameSize = math.MaxInt32
+
+// Used for WebSocket-based Bolt connections, from the server side of
+// the WebSocket (i.e. clients must mask their frames).
 type WsConn struct {
-	conn     io.ReadWriteCloser
-	buf      []byte
-	r        <-chan *Message
-	chunking bool
+	conn   io.ReadWriteCloser
+	queue  *messageQueue
+	reader *wsReader
+	writer *wsWriter
 }
 
-// Create a new Direct Bolt Connection that uses simple Read/Write calls
-// to transfer data.
-//
-// Note: the buffer size of 1024*128 is based off some manual testing as
-// it was found 1024*64 was not enough, for instance, as some messages
-// larger than 64kb have been encountered.
+// The read side of a WsConn, only touched by its reading go routine
+type wsReader struct {
+	d     Dechunker
+	state ws.State
+	// messages from the last frame we haven't queued yet
+	ready []*Message
+	// if the current message is compressed, its fragments so far
+	compressed bool
+	pending    []byte
+}
+
+// The write side of a WsConn, shared by copies of it
+type wsWriter struct {
+	sync.Mutex
+	closed bool
+	// nil unless permessage-deflate was negotiated
+	deflater  *deflater
+	threshold int
+}
+
+// Create a new Direct Bolt Connection that reads through a buffer, so
+// messages of any size can be read a chunk at a time no matter how the
+// bytes arrive on the wire. The buffer is only borrowed while there's
+// something in it.
 func NewDirectConn(c io.ReadWriteCloser) DirectConn {
-	msgchan := make(chan *Message)
 	dc := DirectConn{
-		conn:     c,
-		buf:      make([]byte, 1024*32),
-		temp:     make([]byte, 2),
-		r:        msgchan,
-		chunking: false,
-	}
-
-	// Preset the buffer to be non-0x00, since zeros are
-	// used as end-of-message markers
-	for i := 0; i < len(dc.buf); i++ {
-		dc.buf[i] = 0xff
-	}
-
-	// XXX: this design is ok for now, but in the event this go routine
-	// aborts, it's not clear what the behavior will be of the BoltChan.
-	go func() {
-		for {
-			message, err := dc.readMessage()
-			if err != nil {
-				if err == io.EOF {
-					// log.Println("direct bolt connection hung-up")
-					close(msgchan)
-					return
-				}
-				// log.Printf("direct bolt connection disconnect: %s\n", err)
-				return
-			}
-			msgchan <- message
-		}
-	}()
+		conn:   c,
+		reader: newConnReader(c),
+		queue:  newMessageQueue(),
+		wlock:  &sync.Mutex{},
+		fwd:    &forwarding{},
+	}
+	go dc.queue.fill(dc.nextMessage)
 
 	return dc
 }
@@ -94,187 +121,220 @@ func (c DirectConn) String() string {
 	}
 }
 
-func (c DirectConn) R() <-chan *Message {
-	return c.r
+func (c DirectConn) ReadMessage(ctx context.Context) (*Message, error) {
+	return c.queue.next(ctx)
 }
 
-// Read a single bolt Message, returning a point to it, or an error
-//
-// TODO: this needs a redesign...not sure best approach here, but
-// maybe involving a BufferedReader so we can more easily peek at
-// if we've got a chunked message or a full message. Then we could
-// adapt this to how the WsConn version works, which returns 0 or
-// many messages at once.
-//
-// Also, would be good to NOT DECHUNK like this currently does.
+func (c DirectConn) SetDeadline(t time.Time) error {
+	c.queue.setDeadline(t)
+	return setWriteDeadline(c.conn, t)
+}
+
+func (c DirectConn) SetReadDeadline(t time.Time) error {
+	c.queue.setDeadline(t)
+	return nil
+}
+
+func (c DirectConn) SetBudget(b *Budget) {
+	c.queue.setBudget(b)
+}
+
+// Fail reading any message (chunk headers and all) bigger than size bytes,
+// or lift the limit if 0. Until then, it's DefaultMaxMessageSize.
+func (c DirectConn) SetMaxMessageSize(size int) {
+	c.queue.setLimit(size)
+}
+
+func (c DirectConn) Err() error {
+	return c.queue.Err()
+}
+
+// Read a single, complete bolt Message, returning a pointer to it, or an
+// error. Returns io.EOF only if the connection closed cleanly between
+// messages; hanging up mid-message is an io.ErrUnexpectedEOF. A message
+// outgrowing our limit is an ErrMessageTooLarge.
 func (c *DirectConn) readMessage() (*Message, error) {
-	var (
-		t Type
-	)
-
-	underreads := 0
-	pos := 0
-
-	// TODO: abstract out a "readfully" like function...this under-read
-	// handling logic is so error prone and ugly
-
-	if !c.chunking {
-		for pos < 2 {
-			// We need to grab 2 bytes to get the message length
-			n, err := c.conn.Read(c.buf[pos:2])
-			if err != nil {
-				return nil, err
-			}
-			// TODO: deal with this horrible issue!
-			if n < 2 {
-				underreads++
-				if underreads > 5 {
-					panic("under reads...something's up")
-				}
+	var header [2]byte
+	data := getBuffer(0)
+
+	for {
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			if err == io.EOF && len(data) > 0 {
+				err = io.ErrUnexpectedEOF
 			}
-			pos = pos + n
+			putBuffer(data)
+			return nil, err
 		}
-	} else {
-		// We should have the msglen bytes in our temp buffer
-		// from the last time we processed a message and found
-		// we were chunking
-		c.buf[0] = c.temp[0]
-		c.buf[1] = c.temp[1]
-		pos = 2
-	}
+		data = append(growBuffer(data, 2), header[:]...)
 
-	msglen := int(binary.BigEndian.Uint16(c.buf[:pos]))
-	endOfData := pos + msglen
+		size := int(binary.BigEndian.Uint16(header[:]))
+		if size == 0 {
+			break
+		}
+		if limit := c.queue.getLimit(); limit > 0 && len(data)+size+2 > limit {
+			putBuffer(data)
+			return nil, ErrMessageTooLarge
+		}
 
-	// handle short reads of user data
-	for pos < endOfData {
-		n, err := c.conn.Read(c.buf[pos:endOfData])
-		if err != nil {
+		start := len(data)
+		data = growBuffer(data, size)[:start+size]
+		if _, err := io.ReadFull(c.reader, data[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			putBuffer(data)
 			return nil, err
 		}
-		pos = pos + n
-	}
-
-	// read another 2 bytes...wasteful syscalls, but for now keep it simple
-	// if the next 2 bytes are 0x00, 0x00 we're done the message, but
-	// if the next 2 bytes are something else, we know we're chunking
-	// this shouldn't block (for long) as if chunking there should always
-	// be another message on the wire.
-	endOfData = pos + 2
-	underreads = 0
-	for pos < endOfData {
-		n, err := c.conn.Read(c.buf[pos:endOfData])
+	}
+
+	return &Message{T: IdentifyType(data), Data: data, pooled: true}, nil
+}
+
+// Zero out a buffer so secrets (e.g. credentials in a HELLO) don't linger
+// in memory
+func scrub(buf []byte) {
+	for i := range buf {
+		buf[i] = 0x00
+	}
+}
+
+// Write all of buf, looping over short writes. Well-behaved Writers
+// return an error on a short write, but not every conn is well-behaved.
+func writeFully(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if n < 2 {
-			underreads++
-			if underreads > 5 {
-				panic("too many under reads!")
-			}
+		if n == 0 {
+			return io.ErrShortWrite
 		}
-		pos = pos + n
+		buf = buf[n:]
 	}
+	return nil
+}
 
-	// We can only inspect the type if we haven't yet been in chunking mode
-	if !c.chunking {
-		t = IdentifyType(c.buf[:pos])
-	} else {
-		t = ChunkedMsg
+// Write all of buffers with a single vectored write (i.e. writev) if w is
+// a socket. Otherwise, we join them up so it's still a single Write, which
+// for a TLS conn means a single record.
+func writeBuffers(w io.Writer, buffers net.Buffers) error {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		_, err := buffers.WriteTo(w)
+		return err
 	}
 
-	// Check last 2 bytes to see if we're starting or ending chunking
-	if bytes.Equal([]byte{0x00, 0x00}, c.buf[pos-2:pos]) {
-		c.chunking = false
-		// scrub our temp buffer as we're done chunking
-		c.temp[0] = 0xff
-		c.temp[1] = 0xff
-	} else {
-		c.chunking = true
-		// preserve these 2 bytes as they're the msglen of the next
-		// chunked message coming on the wire
-		c.temp[0] = c.buf[pos-2]
-		c.temp[1] = c.buf[pos-1]
-		// scrubbin' bubbles
-		c.buf[pos-2] = 0xff
-		c.buf[pos-1] = 0xff
-		// backup 2 bytes...these aren't part of our message!
-		pos = pos - 2
+	if len(buffers) == 1 {
+		return writeFully(w, buffers[0])
+	}
+	size := 0
+	for _, buf := range buffers {
+		size = size + len(buf)
 	}
+	joined := make([]byte, 0, size)
+	for _, buf := range buffers {
+		joined = append(joined, buf...)
+	}
+	return writeFully(w, joined)
+}
 
-	// Copy data into Message...
-	data := make([]byte, pos)
-	copy(data, c.buf[:pos])
+func (c DirectConn) WriteMessage(m *Message) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return writeFully(c.conn, m.Data)
+}
 
-	for i := 0; i < pos; i++ {
-		c.buf[i] = 0xff
+func (c DirectConn) WriteMessages(msgs []*Message) error {
+	buffers := make(net.Buffers, len(msgs))
+	for i, m := range msgs {
+		buffers[i] = m.Data
 	}
 
-	return &Message{
-		T:    t,
-		Data: data,
-	}, nil
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return writeBuffers(c.conn, buffers)
 }
 
-func (c DirectConn) WriteMessage(m *Message) error {
-	// TODO validate message?
+func (c DirectConn) Close() error {
+	c.queue.close()
+	return c.conn.Close()
+}
 
-	n, err := c.conn.Write(m.Data)
-	if err != nil {
-		return err
+func NewWsConn(c io.ReadWriteCloser) WsConn {
+	return newWsConn(c, false, 0)
+}
+
+// Create a WsConn for a client that negotiated permessage-deflate (see
+// NegotiateDeflate). Outgoing messages of at least threshold bytes get
+// compressed; smaller ones aren't worth the trouble.
+func NewDeflateWsConn(c io.ReadWriteCloser, threshold int) WsConn {
+	return newWsConn(c, true, threshold)
+}
+
+func newWsConn(c io.ReadWriteCloser, deflate bool, threshold int) WsConn {
+	wc := WsConn{
+		conn:  c,
+		queue: newMessageQueue(),
+		reader: &wsReader{
+			state: ws.StateServerSide,
+		},
+		writer: &wsWriter{},
 	}
-	if n != len(m.Data) {
-		// TODO: loop to write all data?
-		panic("incomplete message written")
+	if deflate {
+		wc.reader.state = wc.reader.state.Set(ws.StateExtended)
+		wc.writer.deflater = &deflater{}
+		wc.writer.threshold = threshold
 	}
 
+	go wc.queue.fill(wc.readMessage)
+
+	return wc
+}
+
+func (c WsConn) ReadMessage(ctx context.Context) (*Message, error) {
+	return c.queue.next(ctx)
+}
+
+func (c WsConn) SetDeadline(t time.Time) error {
+	c.queue.setDeadline(t)
+	return setWriteDeadline(c.conn, t)
+}
+
+func (c WsConn) SetReadDeadline(t time.Time) error {
+	c.queue.setDeadline(t)
 	return nil
 }
 
-func (c DirectConn) Close() error {
-	return c.conn.Close()
+func (c WsConn) SetBudget(b *Budget) {
+	c.queue.setBudget(b)
 }
 
-func NewWsConn(c io.ReadWriteCloser) WsConn {
-	msgchan := make(chan *Message)
-	ws := WsConn{
-		conn:     c,
-		buf:      make([]byte, 1024*32),
-		r:        msgchan,
-		chunking: false,
-	}
-
-	// 0xff out the buffer
-	for i := 0; i < len(ws.buf); i++ {
-		ws.buf[i] = 0xff
-	}
-
-	go func() {
-		for {
-			messages, err := ws.readMessages()
-			if err != nil {
-				if err == io.EOF {
-					// log.Println("bolt ws connection hung-up")
-					close(msgchan)
-					return
-				}
-				// log.Printf("ws bolt connection disconnect: %s\n", err)
-				return
-			}
-			for _, message := range messages {
-				if message == nil {
-					panic("ws message = nil!")
-				}
-				msgchan <- message
-			}
-		}
-	}()
+// Close the connection on any frame or message bigger than size bytes, or
+// lift the limit if 0. Until then, it's DefaultMaxMessageSize.
+func (c WsConn) SetMaxMessageSize(size int) {
+	c.queue.setLimit(size)
+}
 
-	return ws
+func (c WsConn) Err() error {
+	return c.queue.Err()
 }
 
-func (c WsConn) R() <-chan *Message {
-	return c.r
+// Read the next Message, reading more frames only once we've handed out
+// everything from the last ones. Returns io.EOF after a close handshake.
+func (c WsConn) readMessage() (*Message, error) {
+	r := c.reader
+	if len(r.ready) == 0 {
+		messages, err := c.readMessages()
+		if err != nil {
+			return nil, err
+		}
+		r.ready = messages
+	}
+
+	msg := r.ready[0]
+	r.ready[0] = nil
+	r.ready = r.ready[1:]
+	return msg, nil
 }
 
 func (c WsConn) String() string {
@@ -286,99 +346,232 @@ func (c WsConn) String() string {
 	}
 }
 
-// Read 0 or many Bolt Messages from a WebSocket frame since, apparently,
-// small Bolt Messages sometimes get packed into a single Frame(?!).
+// Read WebSocket frames until we have 1 or more complete Bolt Messages.
+// Small messages often get packed into a single frame (e.g. RUN + PULL),
+// while large ones (or just their chunks) can span several frames or
+// fragments, so we let our Dechunker sort it out.
 //
-// For example, I've seen RUN + PULL all in 1 WebSocket frame.
+// Control frames are handled as they arrive: pings get ponged, and a
+// close gets echoed before we return io.EOF. Protocol violations close
+// the connection with the appropriate status code, as do frames or
+// messages over our size limit, before we buffer them.
 func (c WsConn) readMessages() ([]*Message, error) {
-	messages := make([]*Message, 0)
+	for {
+		header, err := ws.ReadHeader(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if err = ws.CheckHeader(header, c.reader.state); err != nil {
+			c.closeWith(ws.StatusProtocolError, err.Error())
+			return nil, err
+		}
+		// RSV1 is only allowed (and only means "compressed") on the
+		// first frame of a data message, and only with deflate
+		if header.Rsv != 0 && (header.Rsv != ws.Rsv(true, false, false) ||
+			header.OpCode.IsControl() || header.OpCode == ws.OpContinuation) {
+			c.closeWith(ws.StatusProtocolError, "unexpected rsv bits")
+			return nil, errors.New("unexpected rsv bits")
+		}
 
-	header, err := ws.ReadHeader(c.conn)
+		if limit := c.queue.getLimit(); header.Length > maxFrameSize ||
+			(limit > 0 && header.Length > int64(limit)) {
+			c.closeWith(ws.StatusMessageTooBig, "")
+			return nil, ErrMessageTooLarge
+		}
+
+		// the payload buffer is only ours until we're done with the frame
+		payload := getBuffer(int(header.Length))
+		messages, err := c.readFrame(header, payload)
+		putBuffer(payload)
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+	}
+}
+
+// Read and handle the payload of the frame with the given header,
+// returning any Bolt Messages it completed.
+func (c WsConn) readFrame(header ws.Header, payload []byte) ([]*Message, error) {
+	r := c.reader
+	_, err := io.ReadFull(c.conn, payload)
 	if err != nil {
 		return nil, err
 	}
-
-	if !header.Fin {
-		panic("unsupported header fin")
+	if header.Masked {
+		ws.Cipher(payload, header.Mask, 0)
 	}
 
 	switch header.OpCode {
+	case ws.OpPing:
+		return nil, c.writeFrame(ws.NewPongFrame(payload))
+	case ws.OpPong:
+		return nil, nil
 	case ws.OpClose:
+		code, reason := ws.ParseCloseFrameData(payload)
+		if len(payload) == 0 {
+			code = ws.StatusNormalClosure
+		} else if err = ws.CheckCloseFrameData(code, reason); err != nil {
+			code = ws.StatusProtocolError
+		}
+		c.closeWith(code, "")
 		return nil, io.EOF
-	case ws.OpPing, ws.OpPong, ws.OpContinuation, ws.OpText:
-		panic(fmt.Sprintf("unsupported websocket opcode: %v\n", header.OpCode))
-		// return nil, errors.New(msg)
+	case ws.OpText:
+		c.closeWith(ws.StatusUnsupportedData, "bolt requires binary frames")
+		return nil, errors.New("received text frame")
 	}
 
-	// TODO: handle header.Length == 0 situations?
-	if header.Length == 0 {
-		return nil, errors.New("zero length header?!")
+	// Binary frames and their continuations are all just more of
+	// the Bolt byte stream, unless compressed, in which case we need
+	// the whole message before we can inflate it
+	if header.Fin {
+		r.state = r.state.Clear(ws.StateFragmented)
+	} else {
+		r.state = r.state.Set(ws.StateFragmented)
 	}
-
-	// TODO: under-reads!!!
-	n, err := c.conn.Read(c.buf[:header.Length])
-	if err != nil {
-		return nil, err
+	if header.OpCode != ws.OpContinuation {
+		r.compressed = header.Rsv1()
 	}
 
-	if header.Masked {
-		ws.Cipher(c.buf[:n], header.Mask, 0)
-		header.Masked = false
+	limit := c.queue.getLimit()
+	data := payload
+	if r.compressed {
+		if limit > 0 && len(r.pending)+len(payload) > limit {
+			c.closeWith(ws.StatusMessageTooBig, "")
+			return nil, ErrMessageTooLarge
+		}
+		r.pending = append(r.pending, payload...)
+		if !header.Fin {
+			return nil, nil
+		}
+		data, err = Inflate(r.pending, limit)
+		scrub(r.pending)
+		r.pending = nil
+		if err == ErrMessageTooLarge {
+			c.closeWith(ws.StatusMessageTooBig, "")
+			return nil, err
+		} else if err != nil {
+			c.closeWith(ws.StatusProtocolError, "invalid compressed message")
+			return nil, err
+		}
 	}
+	r.d.Write(data)
 
-	// WebSocket frames might contain multiple bolt messages...oh, joy
-	// XXX: for now we don't look for chunks across frame boundaries
-	pos := 0
-
-	for pos < int(header.Length) {
-		msglen := int(binary.BigEndian.Uint16(c.buf[pos : pos+2]))
+	// we need to 0x00 out the buffer to prevent any secrets residing
+	// in memory (payload gets scrubbed when it's handed back)
+	if r.compressed {
+		scrub(data)
+	}
 
-		// since we've already got the data in our buffer, we can
-		// peek to see if we're about to or still chunking (or not)
-		if bytes.Equal([]byte{0x0, 0x0}, c.buf[pos+msglen+2:pos+msglen+4]) {
-			c.chunking = false
-		} else {
-			c.chunking = true
+	messages := make([]*Message, 0)
+	for {
+		msg, ok := r.d.Next()
+		if !ok {
+			break
 		}
+		messages = append(messages, msg)
+	}
 
-		// we'll let the combination of the type and the chunking
-		// flag dictate behavior as we're not cleaning our buffer
-		// afterwards, so maaaaaybe there was a false positive
-		sizeOfMsg := msglen + 4
-		msgtype := IdentifyType(c.buf[pos:])
-		if msgtype == UnknownMsg {
-			msgtype = ChunkedMsg
-		}
-		if c.chunking {
-			sizeOfMsg = msglen + 2
+	// what's left is the start of a message still to come
+	if limit > 0 && r.d.Buffered() > limit {
+		for _, msg := range messages {
+			msg.Release()
 		}
+		c.closeWith(ws.StatusMessageTooBig, "")
+		return nil, ErrMessageTooLarge
+	}
+	return messages, nil
+}
 
-		data := make([]byte, sizeOfMsg)
-		copy(data, c.buf[pos:pos+sizeOfMsg])
-		msg := Message{
-			T:    msgtype,
-			Data: data,
-		}
-		messages = append(messages, &msg)
+// Write a single frame, unless we've already sent a close frame
+func (c WsConn) writeFrame(frame ws.Frame) error {
+	c.writer.Lock()
+	defer c.writer.Unlock()
+	return c.writeFrameLocked(frame)
+}
 
-		pos = pos + sizeOfMsg
+func (c WsConn) writeFrameLocked(frame ws.Frame) error {
+	return c.writeFrameParts(frame.Header, frame.Payload)
+}
+
+// Write a frame whose payload comes in parts, header and all in a single
+// (vectored) write. The header's Length must be the parts' total.
+func (c WsConn) writeFrameParts(header ws.Header, parts ...[]byte) error {
+	if c.writer.closed {
+		return errors.New("websocket is closed")
+	}
+	if header.OpCode == ws.OpClose {
+		c.writer.closed = true
 	}
 
-	// we need to 0xff out the buffer to prevent any secrets residing
-	// in memory, but also so we don't get false 0x00 0x00 padding
-	for i := 0; i < n; i++ {
-		c.buf[i] = 0xff
+	hdr := bytes.NewBuffer(make([]byte, 0, ws.MaxHeaderSize))
+	if err := ws.WriteHeader(hdr, header); err != nil {
+		return err
 	}
+	return writeBuffers(c.conn, append(net.Buffers{hdr.Bytes()}, parts...))
+}
 
-	return messages, nil
+// Send a close frame with the given status, if we haven't already
+func (c WsConn) closeWith(code ws.StatusCode, reason string) error {
+	return c.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
 }
+
+// Write a Message as a single binary frame, compressing it if we
+// negotiated permessage-deflate and it's big enough
 func (c WsConn) WriteMessage(m *Message) error {
-	frame := ws.NewBinaryFrame(m.Data)
-	err := ws.WriteFrame(c.conn, frame)
+	w := c.writer
+	w.Lock()
+	defer w.Unlock()
+
+	if w.deflater == nil || len(m.Data) < w.threshold {
+		return c.writeFrameLocked(ws.NewBinaryFrame(m.Data))
+	}
+
+	compressed, err := w.deflater.deflate(m.Data)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewBinaryFrame(compressed)
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	return c.writeFrameLocked(frame)
+}
 
-	return err
+// Write Messages as a single binary frame, compressed as a whole if we
+// negotiated permessage-deflate and they're big enough
+func (c WsConn) WriteMessages(msgs []*Message) error {
+	w := c.writer
+	w.Lock()
+	defer w.Unlock()
+
+	size := 0
+	parts := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		parts[i] = m.Data
+		size = size + len(m.Data)
+	}
+
+	if w.deflater == nil || size < w.threshold {
+		header := ws.Header{Fin: true, OpCode: ws.OpBinary, Length: int64(size)}
+		return c.writeFrameParts(header, parts...)
+	}
+
+	joined := make([]byte, 0, size)
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	compressed, err := w.deflater.deflate(joined)
+	scrub(joined)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewBinaryFrame(compressed)
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	return c.writeFrameLocked(frame)
 }
 
+// Start the close handshake with a normal closure status and close the
+// underlying connection.
 func (c WsConn) Close() error {
+	c.queue.close()
+	c.closeWith(ws.StatusNormalClosure, "")
 	return c.conn.Close()
 }
@@ -2,7 +2,18 @@ package bolt
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
 )
 
 type TestBuffer struct {
@@ -25,13 +36,24 @@ func (t TestBuffer) Write(buf []byte) (int, error) {
 	return t.b.Write(buf)
 }
 
+// Read a message, giving up if it takes suspiciously long
+func readMessage(t *testing.T, conn BoltConn) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := conn.ReadMessage(ctx)
+	if err == context.DeadlineExceeded {
+		t.Fatal("timed out reading message")
+	}
+	return msg, err
+}
+
 func TestReadMessage(t *testing.T) {
 	recordData := []byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x1, 0x0, 0x0}
 	conn := NewDirectConn(NewTestBuffer(recordData))
 
-	msg, err := conn.readMessage()
-	if err != nil {
-		t.Fatal(err)
+	msg, _ := readMessage(t, conn)
+	if msg == nil {
+		t.Fatal("expected a message")
 	}
 	if msg.T != RecordMsg {
 		t.Fatalf("expected RecordMsg, got %s\n", msg.T)
@@ -39,4 +61,589 @@ func TestReadMessage(t *testing.T) {
 	if !bytes.Equal(msg.Data, recordData) {
 		t.Fatalf("expected bytes to match input, got %#v\n", msg.Data)
 	}
+	if _, err := readMessage(t, conn); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v\n", err)
+	}
+}
+
+func TestReadChunkedMessage(t *testing.T) {
+	// RECORD [1, 2, 3] split across 3 chunks, followed by a SUCCESS
+	data := []byte{
+		0x0, 0x2, 0xb1, 0x71,
+		0x0, 0x2, 0x93, 0x01,
+		0x0, 0x2, 0x02, 0x03,
+		0x0, 0x0,
+		0x0, 0x3, 0xb1, 0x70, 0xa0, 0x0, 0x0,
+	}
+	conn := NewDirectConn(NewTestBuffer(data))
+
+	msg, _ := readMessage(t, conn)
+	if msg.T != RecordMsg || !bytes.Equal(data[:14], msg.Data) {
+		t.Fatalf("expected whole RECORD, got %s %#v\n", msg.T, msg.Data)
+	}
+	msg, _ = readMessage(t, conn)
+	if msg.T != SuccessMsg || !bytes.Equal(data[14:], msg.Data) {
+		t.Fatalf("expected SUCCESS, got %s %#v\n", msg.T, msg.Data)
+	}
+}
+
+// A conn that never reads or writes more than size bytes at a time, like
+// a congested network connection. Reads come from in, writes go to out.
+type FragmentedBuffer struct {
+	in, out *bytes.Buffer
+	size    int
+}
+
+func (f FragmentedBuffer) Close() error {
+	return nil
+}
+
+func (f FragmentedBuffer) Read(buf []byte) (int, error) {
+	if len(buf) > f.size {
+		buf = buf[:f.size]
+	}
+	return f.in.Read(buf)
+}
+
+func (f FragmentedBuffer) Write(buf []byte) (int, error) {
+	if len(buf) > f.size {
+		buf = buf[:f.size]
+	}
+	return f.out.Write(buf)
+}
+
+func TestReadFragmentedLargeMessages(t *testing.T) {
+	// a RECORD well past our 32kb read buffer and a single chunk
+	big := make([]byte, 100*1024)
+	for i := range big {
+		big[i] = 'a' + byte(i%26)
+	}
+	record, err := (&Record{Values: []interface{}{string(big)}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	success, _ := (&Success{Metadata: map[string]interface{}{"has_more": false}}).Encode()
+	stream := append(append([]byte{}, record.Data...), success.Data...)
+
+	for _, size := range []int{1, 3, 7, 1500, 64 * 1024} {
+		buf := append([]byte{}, stream...)
+		conn := NewDirectConn(FragmentedBuffer{bytes.NewBuffer(buf), nil, size})
+
+		msg, _ := readMessage(t, conn)
+		if msg == nil || msg.T != RecordMsg || !bytes.Equal(record.Data, msg.Data) {
+			t.Fatalf("reads of %d: expected the whole RECORD\n", size)
+		}
+		msg, _ = readMessage(t, conn)
+		if msg == nil || msg.T != SuccessMsg || !bytes.Equal(success.Data, msg.Data) {
+			t.Fatalf("reads of %d: expected SUCCESS, got %#v\n", size, msg)
+		}
+		if _, err := readMessage(t, conn); err != io.EOF {
+			t.Fatalf("reads of %d: expected io.EOF, got %v\n", size, err)
+		}
+	}
+}
+
+// A conn sending one full chunk after another, never ending the message
+type EndlessChunks struct{}
+
+func (e EndlessChunks) Close() error {
+	return nil
+}
+
+func (e EndlessChunks) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	return len(buf), nil
+}
+
+func (e EndlessChunks) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func TestReadOversizedMessages(t *testing.T) {
+	big, err := (&Record{Values: []interface{}{string(make([]byte, 100*1024))}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := NewPipeBuffer()
+	conn := NewDirectConn(pipe)
+	defer conn.Close()
+	conn.SetMaxMessageSize(64 * 1024)
+	go pipe.w.Write(big.Data)
+	if _, err = readMessage(t, conn); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v\n", err)
+	}
+
+	// no limit, no problem
+	conn = NewDirectConn(NewTestBuffer(append([]byte{}, big.Data...)))
+	conn.SetMaxMessageSize(0)
+	if msg, err := readMessage(t, conn); err != nil || !bytes.Equal(big.Data, msg.Data) {
+		t.Fatalf("expected the whole RECORD, got %v\n", err)
+	}
+
+	// a message that never ends runs into the default limit
+	conn = NewDirectConn(EndlessChunks{})
+	defer conn.Close()
+	if _, err = readMessage(t, conn); err != ErrMessageTooLarge || conn.Err() != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v\n", err)
+	}
+}
+
+func TestReadTruncatedMessage(t *testing.T) {
+	data := []byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x1, 0x0, 0x3, 0xb1}
+	conn := NewDirectConn(FragmentedBuffer{bytes.NewBuffer(data), nil, 2})
+
+	if msg, err := readMessage(t, conn); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF from a truncated stream, got %#v (%v)\n", msg, err)
+	}
+	if conn.Err() != io.ErrUnexpectedEOF {
+		t.Fatalf("expected Err() to explain, got %v\n", conn.Err())
+	}
+}
+
+// A conn that blocks reads until it's given something to read
+type PipeBuffer struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func NewPipeBuffer() PipeBuffer {
+	r, w := io.Pipe()
+	return PipeBuffer{r, w}
+}
+
+func (p PipeBuffer) Close() error {
+	return p.r.Close()
+}
+
+func (p PipeBuffer) Read(buf []byte) (int, error) {
+	return p.r.Read(buf)
+}
+
+func (p PipeBuffer) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func TestReadMessageCancellation(t *testing.T) {
+	pipe := NewPipeBuffer()
+	conn := NewDirectConn(pipe)
+
+	// a cancelled read gives up, but doesn't lose its place in the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		pipe.w.Write([]byte{0x0, 0x4, 0xb1, 0x71})
+		cancel()
+	}()
+	if _, err := conn.ReadMessage(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v\n", err)
+	}
+
+	go pipe.w.Write([]byte{0x91, 0x1, 0x0, 0x0})
+	msg, err := readMessage(t, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != RecordMsg || len(msg.Data) != 8 {
+		t.Fatalf("expected the whole RECORD, got %#v\n", msg)
+	}
+
+	// deadlines work like a net.Conn's
+	conn.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err = readMessage(t, conn); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v\n", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if conn.Err() != nil {
+		t.Fatalf("expected no error yet, got %v\n", conn.Err())
+	}
+	conn.Close()
+	if _, err = readMessage(t, conn); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v\n", err)
+	}
+}
+
+func TestReadDeadlineSparesWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewDirectConn(server)
+	defer conn.Close()
+	success := NewSuccess()
+
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := readMessage(t, conn); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v\n", err)
+	}
+	go io.Copy(ioutil.Discard, client)
+	if err := conn.WriteMessage(success); err != nil {
+		t.Fatalf("expected writes to carry on, got %v\n", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	if err := conn.WriteMessage(success); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded writing, got %v\n", err)
+	}
+}
+
+func TestReadBackpressure(t *testing.T) {
+	pipe := NewPipeBuffer()
+	conn := NewDirectConn(pipe)
+	defer conn.Close()
+	budget := NewBudget(10, nil)
+	conn.SetBudget(budget)
+
+	record := []byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x1, 0x0, 0x0}
+	written := make(chan bool, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			pipe.w.Write(record)
+			written <- true
+		}
+	}()
+
+	// one RECORD fits the budget, the next gets read but stalls...
+	waitForStall(t, budget)
+	<-written
+	<-written
+	if stats := budget.Stats(); stats.InFlight != 8 || stats.Queued != 1 {
+		t.Fatalf("expected 1 RECORD in flight, got %+v\n", stats)
+	}
+
+	// ...so we stop reading the pipe, and the last write is stuck
+	select {
+	case <-written:
+		t.Fatal("expected the last write to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, err := readMessage(t, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.T != RecordMsg {
+			t.Fatalf("expected RECORD, got %s\n", msg.T)
+		}
+	}
+	<-written
+	if stats := budget.Stats(); stats.InFlight != 0 || stats.Stalls == 0 {
+		t.Fatalf("expected an empty budget after a stall, got %+v\n", stats)
+	}
+}
+
+func TestWriteFragmented(t *testing.T) {
+	out := &bytes.Buffer{}
+	conn := NewDirectConn(FragmentedBuffer{&bytes.Buffer{}, out, 3})
+
+	msg, err := (&Record{Values: []interface{}{"not so short a message"}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WriteMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Data, out.Bytes()) {
+		t.Fatalf("expected %#v, got %#v\n", msg.Data, out.Bytes())
+	}
+}
+
+// A pipelined BEGIN, RUN, and PULL like a driver would send
+func pipelined(tb testing.TB) ([]*Message, []byte) {
+	begin := Chunker{}.Message([]byte{0xb1, 0x11, 0xa0})
+	run := Chunker{}.Message([]byte{0xb3, 0x10, 0x88, 'R', 'E', 'T', 'U', 'R', 'N', ' ', '1', 0xa0, 0xa0})
+	pull := Chunker{}.Message([]byte{0xb1, 0x3f, 0xa1, 0x81, 'n', 0xff})
+
+	msgs := []*Message{begin, run, pull}
+	joined := []byte{}
+	for _, msg := range msgs {
+		joined = append(joined, msg.Data...)
+	}
+	return msgs, joined
+}
+
+func TestWriteMessages(t *testing.T) {
+	msgs, joined := pipelined(t)
+
+	out := &bytes.Buffer{}
+	conn := NewDirectConn(FragmentedBuffer{&bytes.Buffer{}, out, 3})
+	if err := conn.WriteMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, out.Bytes()) {
+		t.Fatalf("expected %#v, got %#v\n", joined, out.Bytes())
+	}
+
+	// over WebSockets, they all fit in one frame...
+	out = &bytes.Buffer{}
+	wsConn := NewWsConn(FragmentedBuffer{&bytes.Buffer{}, out, 5})
+	if err := wsConn.WriteMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+	frames := serverFrames(t, out)
+	if len(frames) != 1 || !bytes.Equal(joined, frames[0].Payload) {
+		t.Fatalf("expected a single frame with all messages, got %#v\n", frames)
+	}
+
+	// ...which gets compressed as a whole
+	out = &bytes.Buffer{}
+	wsConn = NewDeflateWsConn(FragmentedBuffer{&bytes.Buffer{}, out, 1 << 16}, 0)
+	if err := wsConn.WriteMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+	frames = serverFrames(t, out)
+	if len(frames) != 1 || !frames[0].Header.Rsv1() {
+		t.Fatalf("expected a single compressed frame, got %#v\n", frames)
+	}
+	payload, err := Inflate(frames[0].Payload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, payload) {
+		t.Fatalf("expected %#v, got %#v\n", joined, payload)
+	}
+}
+
+// Write syscalls (including writev) made by this process so far, if
+// we're on Linux
+func writeSyscalls() (int64, bool) {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw:") {
+			n, err := strconv.ParseInt(strings.TrimSpace(line[6:]), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// Compare writing pipelined messages one at a time against all at once
+// over loopback TCP, reporting the write syscalls it took where we can
+func BenchmarkPipelinedWrites(b *testing.B) {
+	msgs, _ := pipelined(b)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("can't listen on loopback: %s\n", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	benchmarks := []struct {
+		name  string
+		write func(BoltConn) error
+	}{
+		{"WriteMessage", func(conn BoltConn) error {
+			for _, msg := range msgs {
+				if err := conn.WriteMessage(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"WriteMessages", func(conn BoltConn) error {
+			return conn.WriteMessages(msgs)
+		}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			c, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := NewDirectConn(c)
+			defer conn.Close()
+
+			before, counting := writeSyscalls()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bm.write(conn); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			if after, ok := writeSyscalls(); counting && ok {
+				b.ReportMetric(float64(after-before)/float64(b.N), "syscalls/op")
+			}
+		})
+	}
+}
+
+// Frames as a browser would send them, i.e. masked
+func clientFrames(t *testing.T, frames ...ws.Frame) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	for _, frame := range frames {
+		if err := ws.WriteFrame(buf, ws.MaskFrame(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+// Parse the frames our WsConn wrote
+func serverFrames(t *testing.T, buf *bytes.Buffer) []ws.Frame {
+	frames := []ws.Frame{}
+	for buf.Len() > 0 {
+		frame, err := ws.ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestWsMessagesSpanningFrames(t *testing.T) {
+	record := Chunker{Size: 3}.Message([]byte{0xb1, 0x71, 0x93, 0x01, 0x02, 0x03})
+	success := NewSuccess()
+	stream := append(append([]byte{}, record.Data...), success.Data...)
+
+	// split mid-chunk, then mid-header, so neither frame boundary lines
+	// up with a chunk boundary. the middle is a fragmented message with
+	// an empty continuation frame, just because we can.
+	in := clientFrames(t,
+		ws.NewBinaryFrame(stream[:4]),
+		ws.NewFrame(ws.OpBinary, false, stream[4:8]),
+		ws.NewFrame(ws.OpContinuation, false, []byte{}),
+		ws.NewFrame(ws.OpContinuation, true, stream[8:10]),
+		ws.NewBinaryFrame(stream[10:]))
+	conn := NewWsConn(TestBuffer{in})
+
+	msg, _ := readMessage(t, conn)
+	if msg.T != RecordMsg || !bytes.Equal(record.Data, msg.Data) {
+		t.Fatalf("expected whole RECORD, got %s %#v\n", msg.T, msg.Data)
+	}
+	msg, _ = readMessage(t, conn)
+	if msg.T != SuccessMsg || !bytes.Equal(success.Data, msg.Data) {
+		t.Fatalf("expected SUCCESS, got %s %#v\n", msg.T, msg.Data)
+	}
+}
+
+func TestWsPingAndClose(t *testing.T) {
+	success := NewSuccess()
+	in := clientFrames(t,
+		ws.NewPingFrame([]byte("hi")),
+		ws.NewBinaryFrame(success.Data),
+		ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "bye")))
+	out := &bytes.Buffer{}
+	conn := NewWsConn(FragmentedBuffer{in, out, 1 << 16})
+
+	if msg, _ := readMessage(t, conn); msg == nil || msg.T != SuccessMsg {
+		t.Fatalf("expected SUCCESS, got %#v\n", msg)
+	}
+	if _, err := readMessage(t, conn); err != io.EOF {
+		t.Fatalf("expected io.EOF after close frame, got %v\n", err)
+	}
+
+	frames := serverFrames(t, out)
+	if len(frames) != 2 {
+		t.Fatalf("expected a pong and a close, got %d frames\n", len(frames))
+	}
+	if frames[0].Header.OpCode != ws.OpPong || string(frames[0].Payload) != "hi" {
+		t.Fatalf("expected pong of 'hi', got %#v\n", frames[0])
+	}
+	if frames[1].Header.OpCode != ws.OpClose {
+		t.Fatalf("expected close, got %#v\n", frames[1])
+	}
+	if code, _ := ws.ParseCloseFrameData(frames[1].Payload); code != ws.StatusGoingAway {
+		t.Fatalf("expected close status to be echoed, got %d\n", code)
+	}
+
+	if err := conn.WriteMessage(success); err == nil {
+		t.Fatal("expected error writing after close")
+	}
+}
+
+func TestWsProtocolErrors(t *testing.T) {
+	type test struct {
+		in       *bytes.Buffer
+		expected ws.StatusCode
+	}
+
+	unmasked := &bytes.Buffer{}
+	ws.WriteFrame(unmasked, ws.NewBinaryFrame([]byte{0x0, 0x0}))
+
+	tests := []test{
+		{unmasked, ws.StatusProtocolError},
+		{clientFrames(t, ws.NewTextFrame([]byte("RETURN 1"))), ws.StatusUnsupportedData},
+		{clientFrames(t, ws.NewFrame(ws.OpContinuation, true, []byte{0x0})), ws.StatusProtocolError},
+		{clientFrames(t, ws.NewFrame(ws.OpPing, false, []byte{})), ws.StatusProtocolError},
+	}
+
+	for i, test := range tests {
+		out := &bytes.Buffer{}
+		conn := NewWsConn(FragmentedBuffer{test.in, out, 1 << 16})
+		if msg, err := readMessage(t, conn); err == nil {
+			t.Fatalf("test %d: expected no messages, got %#v\n", i, msg)
+		}
+
+		frames := serverFrames(t, out)
+		if len(frames) != 1 || frames[0].Header.OpCode != ws.OpClose {
+			t.Fatalf("test %d: expected a close frame, got %#v\n", i, frames)
+		}
+		if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != test.expected {
+			t.Fatalf("test %d: expected status %d, got %d\n", i, test.expected, code)
+		}
+	}
+}
+
+// A conn reading from r and writing to w
+type pipedConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (p pipedConn) Close() error {
+	return nil
+}
+
+func TestWsOversized(t *testing.T) {
+	// a frame claiming to be huge is turned away before we allocate
+	huge := &bytes.Buffer{}
+	ws.WriteHeader(huge, ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 1 << 62,
+		Masked: true, Mask: ws.NewMask()})
+
+	// as are messages outgrowing our limit over several frames, whether
+	// a chunk at a time or compressed
+	chunks := clientFrames(t,
+		ws.NewFrame(ws.OpBinary, false, []byte{0xff, 0xff}),
+		ws.NewFrame(ws.OpContinuation, false, make([]byte, 40)),
+		ws.NewFrame(ws.OpContinuation, true, make([]byte, 40)))
+	first := ws.NewFrame(ws.OpBinary, false, make([]byte, 40))
+	first.Header.Rsv = ws.Rsv(true, false, false)
+	compressed := clientFrames(t, first, ws.NewFrame(ws.OpContinuation, true, make([]byte, 40)))
+
+	for i, in := range []*bytes.Buffer{huge, chunks, compressed} {
+		r, w := io.Pipe()
+		out := &bytes.Buffer{}
+		conn := NewDeflateWsConn(pipedConn{r, out}, 0)
+		conn.SetMaxMessageSize(64)
+		go w.Write(in.Bytes())
+
+		if _, err := readMessage(t, conn); err != ErrMessageTooLarge {
+			t.Fatalf("test %d: expected ErrMessageTooLarge, got %v\n", i, err)
+		}
+		r.Close()
+		frames := serverFrames(t, out)
+		if len(frames) != 1 || frames[0].Header.OpCode != ws.OpClose {
+			t.Fatalf("test %d: expected a close frame, got %#v\n", i, frames)
+		}
+		if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != ws.StatusMessageTooBig {
+			t.Fatalf("test %d: expected status %d, got %d\n", i, ws.StatusMessageTooBig, code)
+		}
+	}
 }
@@ -0,0 +1,134 @@
+package bolt
+
+import (
+	"fmt"
+	"io"
+)
+
+// What a Credentials looks like when formatted
+const redacted = "[REDACTED]"
+
+// Map keys whose values never make it into our logs, wherever they
+// appear in a message
+var secretKeys = map[string]bool{
+	"credentials": true,
+}
+
+// A secret from a HELLO, e.g. a password, kept as bytes so we can scrub it
+// once we're done authenticating instead of leaving an immutable string
+// lying around the heap. It formats as [REDACTED] with any verb, so it
+// can't end up in a log by accident.
+type Credentials struct {
+	secret []byte
+}
+
+// Wrap a copy of secret
+func NewCredentials(secret []byte) *Credentials {
+	return &Credentials{secret: append([]byte{}, secret...)}
+}
+
+// The secret itself, aliasing our copy. Empty once zeroed.
+func (c *Credentials) Bytes() []byte {
+	if c == nil {
+		return nil
+	}
+	return c.secret
+}
+
+// Scrub the secret. Anything encoded with it afterwards goes out empty.
+func (c *Credentials) Zero() {
+	if c == nil {
+		return
+	}
+	scrub(c.secret)
+	c.secret = nil
+}
+
+func (c *Credentials) String() string {
+	return redacted
+}
+
+func (c *Credentials) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// Copy the chunked message data with the contents of any string or bytes
+// value found under one of our secretKeys overwritten, for logging. The
+// lengths stay put so the chunking still adds up. Data we can't make sense
+// of is cut down to its first chunk header and structure marker.
+func Redact(data []byte) []byte {
+	payload, err := dechunk(data)
+	if err == nil {
+		s := NewScanner(payload)
+		for s.Pos() < len(payload) && err == nil {
+			err = s.redact(false, 0)
+		}
+	}
+	if err != nil {
+		scrub(payload)
+		if len(data) > 4 {
+			data = data[:4]
+		}
+		return append([]byte{}, data...)
+	}
+
+	// put the payload back into a copy of the original chunks
+	out := append([]byte{}, data...)
+	pos, rest := 0, payload
+	for pos+2 <= len(out) && len(rest) > 0 {
+		size := int(out[pos])<<8 | int(out[pos+1])
+		pos = pos + 2
+		copy(out[pos:pos+size], rest[:size])
+		pos, rest = pos+size, rest[size:]
+	}
+	scrub(payload)
+	return out
+}
+
+// Walk the value at the current position, found inside depth containers,
+// masking string and bytes contents if it's secret or is found in a map
+// under a secret key.
+func (s *Scanner) redact(secret bool, depth int) error {
+	kind, size, n, err := s.header()
+	if err != nil {
+		return err
+	}
+	if depth >= MaxDepth && (kind == ListKind || kind == StructKind || kind == MapKind) {
+		return errTooDeep
+	}
+
+	switch kind {
+	case StringKind, BytesKind:
+		start := s.pos + n
+		if len(s.buf)-start < size {
+			return errShortBuffer
+		}
+		if secret {
+			for i := start; i < start+size; i++ {
+				s.buf[i] = '*'
+			}
+		}
+		s.pos = start + size
+	case ListKind, StructKind:
+		s.pos = s.pos + n
+		for i := 0; i < size; i++ {
+			if err = s.redact(secret, depth+1); err != nil {
+				return err
+			}
+		}
+	case MapKind:
+		s.pos = s.pos + n
+		for i := 0; i < size; i++ {
+			key, err := s.ReadStringBytes()
+			if err != nil {
+				return err
+			}
+			if err = s.redact(secret || secretKeys[string(key)], depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return s.Skip()
+	}
+	return nil
+}
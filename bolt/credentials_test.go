@@ -0,0 +1,77 @@
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+var secret = []byte("sup3r-s3cret")
+
+func TestCredentials(t *testing.T) {
+	creds := NewCredentials(secret)
+	hello := &Hello{UserAgent: "bolt-proxy", Scheme: "basic", Principal: "neo4j",
+		Credentials: creds}
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%d"} {
+		for _, val := range []interface{}{creds, *hello, hello} {
+			out := fmt.Sprintf(verb, val)
+			if bytes.Contains([]byte(out), secret) || !bytes.Contains([]byte(out), []byte(redacted)) {
+				t.Fatalf("expected %s to redact the secret, got %s\n", verb, out)
+			}
+		}
+	}
+
+	msg, err := hello.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg.Data, secret) {
+		t.Fatal("expected the encoded HELLO to carry the secret")
+	}
+
+	creds.Zero()
+	if creds.Bytes() != nil {
+		t.Fatalf("expected zeroed credentials, got %q\n", creds.Bytes())
+	}
+	if msg, err = hello.Encode(); err != nil || bytes.Contains(msg.Data, secret) {
+		t.Fatalf("expected the secret gone after Zero, got %#v (%v)\n", msg.Data, err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	hello, err := (&Hello{UserAgent: "bolt-proxy", Scheme: "basic", Principal: "neo4j",
+		Credentials: NewCredentials(secret)}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a LOGON we have no type for, with the secret nested and split across
+	// chunks
+	logon, err := Pack(Structure{Tag: logonTag, Fields: []interface{}{
+		map[string]interface{}{"scheme": "custom", "principal": "neo4j",
+			"credentials": map[string]interface{}{"token": string(secret)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{hello.Data, Chunker{Size: 7}.Chunk(logon)} {
+		out := Redact(data)
+		if len(out) != len(data) {
+			t.Fatalf("expected %d bytes, got %d\n", len(data), len(out))
+		}
+		payload, err := dechunk(out)
+		if err != nil {
+			t.Fatalf("expected valid chunks, got %s\n", err)
+		}
+		if bytes.Contains(payload, secret) || !bytes.Contains(payload, []byte("neo4j")) {
+			t.Fatalf("expected only the secret masked, got %q\n", payload)
+		}
+	}
+
+	// secrets in a message we can't parse don't get a chance
+	truncated := hello.Data[:len(hello.Data)-3]
+	if out := Redact(truncated); !bytes.Equal(hello.Data[:4], out) {
+		t.Fatalf("expected only the header of a truncated HELLO, got %#v\n", out)
+	}
+}
@@ -0,0 +1,131 @@
+package bolt
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+)
+
+// Name of the WebSocket compression extension from RFC 7692
+const DeflateExtension = "permessage-deflate"
+
+// What we agree to when a client offers permessage-deflate. With no
+// context takeover in either direction, every message is compressed on
+// its own, so neither side has to keep a 32kb window around between
+// messages.
+var deflateResponse = httphead.NewOption(DeflateExtension, map[string]string{
+	"server_no_context_takeover": "",
+	"client_no_context_takeover": "",
+})
+
+// The end of a sync flush, which senders strip from each message, followed
+// by an empty final block so readers see a clean EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Check if we can honor a permessage-deflate offer. The only thing we can't
+// do is shrink our compression window, as compress/flate always uses 32kb.
+func deflateOfferAcceptable(offer httphead.Option) bool {
+	acceptable := true
+	offer.Parameters.ForEach(func(key, val []byte) bool {
+		switch string(key) {
+		case "server_no_context_takeover", "client_no_context_takeover",
+			"client_max_window_bits":
+		case "server_max_window_bits":
+			acceptable = string(val) == "15"
+		default:
+			acceptable = false
+		}
+		return acceptable
+	})
+	return acceptable
+}
+
+// Select the first permessage-deflate offer we can honor from a
+// Sec-WebSocket-Extensions header. Suitable for a ws.Upgrader's
+// ExtensionCustom.
+func NegotiateDeflate(header []byte, accepted []httphead.Option) ([]httphead.Option, bool) {
+	for _, option := range accepted {
+		if string(option.Name) == DeflateExtension {
+			return accepted, true
+		}
+	}
+
+	offers, ok := httphead.ParseOptions(header, nil)
+	if !ok {
+		return accepted, false
+	}
+	for _, offer := range offers {
+		if string(offer.Name) == DeflateExtension && deflateOfferAcceptable(offer) {
+			return append(accepted, deflateResponse), true
+		}
+	}
+	return accepted, true
+}
+
+// Check if a completed WebSocket handshake negotiated permessage-deflate
+func DeflateNegotiated(hs ws.Handshake) bool {
+	for _, option := range hs.Extensions {
+		if string(option.Name) == DeflateExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// Decompress the payload of a WebSocket message sent with permessage-deflate,
+// giving up with ErrMessageTooLarge once it's inflated past limit bytes
+// (unless limit is 0)
+func Inflate(payload []byte, limit int) ([]byte, error) {
+	inflater := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+	defer inflater.Close()
+	r := io.Reader(inflater)
+	if limit > 0 {
+		r = io.LimitReader(inflater, int64(limit)+1)
+	}
+
+	inflated, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(inflated) > limit {
+		scrub(inflated)
+		return nil, ErrMessageTooLarge
+	}
+	return inflated, nil
+}
+
+// Compresses outgoing messages, reusing its (rather large) flate.Writer.
+// Not safe for concurrent use.
+type deflater struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+// Compress payload, returning a slice that's only valid until the next call
+func (d *deflater) deflate(payload []byte) ([]byte, error) {
+	d.buf.Reset()
+	if d.w == nil {
+		w, err := flate.NewWriter(&d.buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		d.w = w
+	} else {
+		d.w.Reset(&d.buf)
+	}
+
+	if _, err := d.w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// drop the 0x00 0x00 0xff 0xff the flush ended with
+	compressed := d.buf.Bytes()
+	return compressed[:len(compressed)-4], nil
+}
@@ -0,0 +1,162 @@
+package bolt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	type test struct {
+		header   string
+		accepted bool
+	}
+
+	tests := []test{
+		{"permessage-deflate; client_max_window_bits", true},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", true},
+		{"permessage-deflate; server_max_window_bits=15; client_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10", false},
+		{"permessage-deflate; made_up_param", false},
+		{"x-webkit-deflate-frame", false},
+	}
+
+	for _, test := range tests {
+		options, ok := NegotiateDeflate([]byte(test.header), nil)
+		if !ok {
+			t.Fatalf("failed to parse %s\n", test.header)
+		}
+		accepted := DeflateNegotiated(ws.Handshake{Extensions: options})
+		if accepted != test.accepted {
+			t.Fatalf("%s: expected accepted to be %v\n", test.header, test.accepted)
+		}
+		if accepted && (len(options) != 1 || !options[0].Equal(deflateResponse)) {
+			t.Fatalf("%s: unexpected response %v\n", test.header, options)
+		}
+	}
+
+	// only ever accept it once
+	options := []httphead.Option{deflateResponse}
+	options, _ = NegotiateDeflate([]byte("permessage-deflate"), options)
+	if len(options) != 1 {
+		t.Fatalf("expected a single extension, got %v\n", options)
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("MATCH (n) RETURN n "), 100)
+
+	d := &deflater{}
+	for i := 0; i < 2; i++ {
+		compressed, err := d.deflate(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(payload) {
+			t.Fatalf("expected compression, got %d bytes\n", len(compressed))
+		}
+		out, err := Inflate(compressed, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, out) {
+			t.Fatal("payload didn't survive compression")
+		}
+	}
+
+	if _, err := Inflate([]byte{0xff, 0xff, 0xff}, 0); err == nil {
+		t.Fatal("expected error inflating garbage")
+	}
+}
+
+func TestInflateBomb(t *testing.T) {
+	// 100MB of nothing squeezes into a tiny frame
+	bomb, err := (&deflater{}).deflate(make([]byte, 100*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Inflate(bomb, 1024*1024); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v\n", err)
+	}
+
+	// and gets a WsConn closed before it's inflated past the limit
+	frame := ws.NewBinaryFrame(bomb)
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	out := &bytes.Buffer{}
+	conn := NewDeflateWsConn(FragmentedBuffer{clientFrames(t, frame), out, 1 << 16}, 1024)
+	if _, err = readMessage(t, conn); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v\n", err)
+	}
+	frames := serverFrames(t, out)
+	if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != ws.StatusMessageTooBig {
+		t.Fatalf("expected status %d, got %d\n", ws.StatusMessageTooBig, code)
+	}
+}
+
+func TestDeflateWsConn(t *testing.T) {
+	record, err := (&Record{Values: []interface{}{string(bytes.Repeat([]byte("z"), 4096))}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	success := NewSuccess()
+
+	// a compressed RECORD split over 2 frames, then an uncompressed SUCCESS
+	compressed, err := (&deflater{}).deflate(record.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ws.NewFrame(ws.OpBinary, false, compressed[:5])
+	first.Header.Rsv = ws.Rsv(true, false, false)
+	in := clientFrames(t,
+		first,
+		ws.NewFrame(ws.OpContinuation, true, compressed[5:]),
+		ws.NewBinaryFrame(success.Data))
+	out := &bytes.Buffer{}
+	conn := NewDeflateWsConn(FragmentedBuffer{in, out, 1 << 16}, 1024)
+
+	if msg, _ := readMessage(t, conn); msg == nil || !bytes.Equal(record.Data, msg.Data) {
+		t.Fatalf("expected the inflated RECORD, got %#v\n", msg)
+	}
+	if msg, _ := readMessage(t, conn); msg == nil || !bytes.Equal(success.Data, msg.Data) {
+		t.Fatalf("expected SUCCESS, got %#v\n", msg)
+	}
+
+	// only messages over the threshold get compressed on the way out
+	if err = conn.WriteMessage(record); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WriteMessage(success); err != nil {
+		t.Fatal(err)
+	}
+	frames := serverFrames(t, out)
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d\n", len(frames))
+	}
+	if !frames[0].Header.Rsv1() || len(frames[0].Payload) >= len(record.Data) {
+		t.Fatal("expected RECORD to be compressed")
+	}
+	inflated, err := Inflate(frames[0].Payload, 0)
+	if err != nil || !bytes.Equal(record.Data, inflated) {
+		t.Fatalf("expected RECORD to inflate, got error %v\n", err)
+	}
+	if frames[1].Header.Rsv1() || !bytes.Equal(success.Data, frames[1].Payload) {
+		t.Fatal("expected SUCCESS to be sent as-is")
+	}
+}
+
+func TestUncompressedWsConnRejectsRsv(t *testing.T) {
+	frame := ws.NewBinaryFrame([]byte{0x0, 0x0})
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	out := &bytes.Buffer{}
+	conn := NewWsConn(FragmentedBuffer{clientFrames(t, frame), out, 1 << 16})
+
+	if msg, err := readMessage(t, conn); err == nil {
+		t.Fatalf("expected no messages, got %#v\n", msg)
+	}
+	frames := serverFrames(t, out)
+	if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != ws.StatusProtocolError {
+		t.Fatalf("expected protocol error, got %d\n", code)
+	}
+}
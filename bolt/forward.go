@@ -0,0 +1,162 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// How long a server gets to send each chunk of a message we're relaying.
+// We hold dst's write lock until the message is through, so a server that
+// stalls mid-message mustn't keep everyone else waiting to write to dst.
+var relayChunkTimeout = 10 * time.Second
+
+// Where a DirectConn relays what it reads, if anywhere
+type forwarding struct {
+	sync.Mutex
+	dst BoltConn
+}
+
+func (f *forwarding) get() BoltConn {
+	f.Lock()
+	defer f.Unlock()
+	return f.dst
+}
+
+// Relay everything we read to dst, starting with the next message, until
+// told to stop with a nil dst.
+//
+// RECORDs are streamed to dst chunk by chunk as they arrive, without being
+// reassembled, and never show up in ReadMessage. Everything else (SUCCESS,
+// FAILURE, etc.) is small, so it's read whole, written to dst, and then
+// still returned by ReadMessage marked as Relayed so callers can track
+// where results end.
+//
+// If dst is also a DirectConn over TCP, RECORD chunks are spliced from
+// socket to socket where the platform supports it.
+func (c DirectConn) Forward(dst BoltConn) {
+	c.fwd.Lock()
+	defer c.fwd.Unlock()
+	c.fwd.dst = dst
+}
+
+// Read the next message, forwarding it if we've been asked to. Returns a
+// nil Message (and nil error) if there's nothing to hand to ReadMessage.
+func (c *DirectConn) nextMessage() (*Message, error) {
+	// Wait for the start of a message before deciding where it goes,
+	// without holding onto a buffer if we've nothing buffered
+	c.reader.release()
+	head, err := c.reader.Peek(2)
+	if err != nil {
+		if err == io.EOF && len(head) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	dst := c.fwd.get()
+	if dst == nil {
+		return c.readMessage()
+	}
+
+	// Chunks of 2 or more bytes guarantee we can peek at the tag
+	if binary.BigEndian.Uint16(head) > 1 {
+		head, err = c.reader.Peek(4)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if IdentifyType(head) == RecordMsg {
+			return nil, c.relay(dst)
+		}
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if err = dst.WriteMessage(msg); err != nil {
+		return nil, err
+	}
+	msg.Relayed = true
+	return msg, nil
+}
+
+// Stream a single message to dst a chunk at a time. Any failure, reading
+// or writing, leaves us somewhere in the middle of a message, so it's fatal
+// for the connection. That includes taking longer than relayChunkTimeout
+// to read a chunk.
+func (c *DirectConn) relay(dst BoltConn) error {
+	direct, ok := dst.(DirectConn)
+	if !ok {
+		// Without a raw conn to write to, the best we can do is to skip
+		// the trip through ReadMessage
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		defer msg.Release()
+		return dst.WriteMessage(msg)
+	}
+
+	// Hold the lock for the whole message so nothing else gets
+	// written to dst in between our chunks
+	direct.wlock.Lock()
+	defer direct.wlock.Unlock()
+	defer setReadDeadline(c.conn, time.Time{})
+
+	var header [2]byte
+	for {
+		setReadDeadline(c.conn, time.Now().Add(relayChunkTimeout))
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := writeFully(direct.conn, header[:]); err != nil {
+			return err
+		}
+
+		size := int(binary.BigEndian.Uint16(header[:]))
+		if size == 0 {
+			return nil
+		}
+		if err := c.copyN(direct.conn, size); err != nil {
+			return err
+		}
+	}
+}
+
+// Copy n bytes of the stream to w. Whatever's already buffered goes first,
+// after which the rest can be copied straight from our conn, letting io.Copy
+// use w's ReadFrom (and splice(2) for TCP to TCP on Linux) or, failing
+// that, a pooled buffer.
+func (c *DirectConn) copyN(w io.Writer, n int) error {
+	if buffered := c.reader.Buffered(); buffered > 0 {
+		if buffered > n {
+			buffered = n
+		}
+		pending, _ := c.reader.Peek(buffered)
+		if err := writeFully(w, pending); err != nil {
+			return err
+		}
+		c.reader.Discard(buffered)
+		n = n - buffered
+	}
+	if n == 0 {
+		return nil
+	}
+
+	// only borrow a buffer if io.CopyBuffer is going to need it
+	var buf []byte
+	if _, ok := w.(io.ReaderFrom); !ok {
+		buf = getBuffer(readBufferSize)
+		defer putBuffer(buf)
+	}
+	written, err := io.CopyBuffer(w, io.LimitReader(c.conn, int64(n)), buf)
+	if err == nil && written < int64(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
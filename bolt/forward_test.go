@@ -0,0 +1,147 @@
+package bolt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// RECORDs big enough to need several chunks, with a SUCCESS to end them
+func forwardingStream(tb testing.TB) ([]byte, *Message) {
+	big := make([]byte, 150*1024)
+	for i := range big {
+		big[i] = 'a' + byte(i%26)
+	}
+
+	stream := []byte{}
+	for i := 0; i < 3; i++ {
+		record, err := (&Record{Values: []interface{}{i, string(big)}}).Encode()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		stream = append(stream, record.Data...)
+	}
+	success, err := (&Success{Metadata: map[string]interface{}{"has_more": false}}).Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return append(stream, success.Data...), success
+}
+
+func TestForwardingToBuffer(t *testing.T) {
+	stream, success := forwardingStream(t)
+
+	out := &bytes.Buffer{}
+	client := NewDirectConn(FragmentedBuffer{&bytes.Buffer{}, out, 4096})
+	server := NewDirectConn(FragmentedBuffer{bytes.NewBuffer(stream), nil, 1000})
+	server.Forward(client)
+
+	msg, err := readMessage(t, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != SuccessMsg || !msg.Relayed || !bytes.Equal(success.Data, msg.Data) {
+		t.Fatalf("expected only the relayed SUCCESS, got %s (relayed: %v)\n", msg.T, msg.Relayed)
+	}
+	if _, err = readMessage(t, server); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v\n", err)
+	}
+	if !bytes.Equal(stream, out.Bytes()) {
+		t.Fatalf("expected %d bytes relayed as-is, got %d\n", len(stream), out.Len())
+	}
+}
+
+func TestForwardingOverTcp(t *testing.T) {
+	stream, _ := forwardingStream(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %s\n", err)
+	}
+	defer listener.Close()
+
+	// pairs of connected sockets: (backend, server) and (client, driver)
+	connect := func() (net.Conn, net.Conn) {
+		accepted := make(chan net.Conn)
+		go func() {
+			conn, _ := listener.Accept()
+			accepted <- conn
+		}()
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dialed, <-accepted
+	}
+	backend, serverSide := connect()
+	clientSide, driver := connect()
+	defer backend.Close()
+	defer driver.Close()
+
+	server := NewDirectConn(serverSide)
+	client := NewDirectConn(clientSide)
+	defer server.Close()
+	defer client.Close()
+	server.Forward(client)
+
+	go func() {
+		backend.Write(stream)
+	}()
+
+	received := make([]byte, len(stream))
+	if _, err = io.ReadFull(driver, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stream, received) {
+		t.Fatal("relayed bytes don't match the backend's")
+	}
+
+	msg, _ := readMessage(t, server)
+	if msg == nil || msg.T != SuccessMsg || !msg.Relayed {
+		t.Fatalf("expected a relayed SUCCESS, got %#v\n", msg)
+	}
+
+	// after we stop forwarding, we get every message again
+	server.Forward(nil)
+	backend.Write(stream)
+	for i := 0; i < 3; i++ {
+		msg, _ = readMessage(t, server)
+		if msg == nil || msg.T != RecordMsg || msg.Relayed {
+			t.Fatalf("expected an unrelayed RECORD, got %#v\n", msg)
+		}
+	}
+}
+
+func TestForwardingStalledServer(t *testing.T) {
+	timeout := relayChunkTimeout
+	relayChunkTimeout = 50 * time.Millisecond
+	defer func() { relayChunkTimeout = timeout }()
+
+	out := &bytes.Buffer{}
+	client := NewDirectConn(FragmentedBuffer{&bytes.Buffer{}, out, 4096})
+	conn, backend := net.Pipe()
+	defer backend.Close()
+	server := NewDirectConn(conn)
+	defer server.Close()
+	server.Forward(client)
+
+	// the server sends some of a RECORD's first chunk, then nothing
+	stream, _ := forwardingStream(t)
+	go backend.Write(stream[:100])
+
+	if _, err := readMessage(t, server); err == nil {
+		t.Fatal("expected relaying from a stalled server to fail")
+	}
+	written := make(chan error, 1)
+	go func() { written <- client.WriteMessage(NewSuccess()) }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out writing to the client after a stalled relay")
+	}
+}
@@ -0,0 +1,897 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Structure tags for Bolt messages
+const (
+	initTag       byte = 0x01 // Bolt v1 & v2 only
+	helloTag      byte = 0x01
+	goodbyeTag    byte = 0x02
+	ackFailureTag byte = 0x0e // Bolt v1 & v2 only
+	resetTag      byte = 0x0f
+	runTag        byte = 0x10
+	beginTag      byte = 0x11
+	commitTag     byte = 0x12
+	rollbackTag   byte = 0x13
+	discardTag    byte = 0x2f
+	pullTag       byte = 0x3f
+	telemetryTag  byte = 0x54
+	routeTag      byte = 0x66
+	logonTag      byte = 0x6a
+	logoffTag     byte = 0x6b
+	successTag    byte = 0x70
+	recordTag     byte = 0x71
+	ignoredTag    byte = 0x7e
+	failureTag    byte = 0x7f
+)
+
+// A typed view of a Bolt Message. Implementations can populate themselves
+// from a raw Message via Decode and produce a new, chunked Message via
+// Encode.
+type TypedMessage interface {
+	Type() Type
+	Decode(*Message) error
+	Encode() (*Message, error)
+}
+
+// Decode a raw Message into its typed equivalent based on the Message's
+// Type. Returns an error if the type is unknown or the data is malformed.
+func Decode(msg *Message) (TypedMessage, error) {
+	var typed TypedMessage
+
+	switch msg.T {
+	case HelloMsg:
+		typed = &Hello{}
+	case GoodbyeMsg:
+		typed = &Goodbye{}
+	case LogonMsg:
+		typed = &Logon{}
+	case LogoffMsg:
+		typed = &Logoff{}
+	case ResetMsg:
+		typed = &Reset{}
+	case RunMsg:
+		typed = &Run{}
+	case BeginMsg:
+		typed = &Begin{}
+	case CommitMsg:
+		typed = &Commit{}
+	case RollbackMsg:
+		typed = &Rollback{}
+	case DiscardMsg:
+		typed = &Discard{}
+	case PullMsg:
+		typed = &Pull{}
+	case RouteMsg:
+		typed = &Route{}
+	case SuccessMsg:
+		typed = &Success{}
+	case RecordMsg:
+		typed = &Record{}
+	case IgnoreMsg:
+		typed = &Ignored{}
+	case FailureMsg:
+		typed = &Failure{}
+	default:
+		return nil, fmt.Errorf("can't decode message of type %s", msg.T)
+	}
+
+	if err := typed.Decode(msg); err != nil {
+		return nil, err
+	}
+	return typed, nil
+}
+
+// Unpack the Structure carried by msg, validating its tag and that it has
+// at least min fields.
+func unpackMessage(msg *Message, tag byte, min int) ([]interface{}, error) {
+	if msg == nil {
+		return nil, errors.New("cannot decode nil message")
+	}
+
+	payload, err := dechunk(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	val, _, err := Unpack(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := val.(Structure)
+	if !ok {
+		return nil, fmt.Errorf("expected a structure for %s, got %T", msg.T, val)
+	}
+	if s.Tag != tag {
+		return nil, fmt.Errorf("expected tag %#x for %s, got %#x", tag, msg.T, s.Tag)
+	}
+	if len(s.Fields) < min {
+		return nil, fmt.Errorf("expected at least %d fields for %s, got %d",
+			min, msg.T, len(s.Fields))
+	}
+	return s.Fields, nil
+}
+
+// Pack the fields into a Structure and chunk it up into a new Message.
+// The unchunked payload gets scrubbed as it may hold Credentials.
+func packMessage(t Type, tag byte, fields ...interface{}) (*Message, error) {
+	payload, err := Pack(Structure{Tag: tag, Fields: fields})
+	defer scrub(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{T: t, Data: Chunker{}.Chunk(payload)}, nil
+}
+
+func mapField(fields []interface{}, i int) (map[string]interface{}, error) {
+	if fields[i] == nil {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := fields[i].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected field %d to be a map, got %T", i, fields[i])
+	}
+	return m, nil
+}
+
+// Unpack the map carried by a HELLO or LOGON, pulling out the credentials
+// as bytes instead of letting them become a string along with everything
+// else.
+func unpackAuthMessage(msg *Message, tag byte) (map[string]interface{}, *Credentials, error) {
+	if msg == nil {
+		return nil, nil, errors.New("cannot decode nil message")
+	}
+	payload, err := dechunk(msg.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer scrub(payload)
+
+	s := NewScanner(payload)
+	found, fields, err := s.ReadStruct()
+	if err != nil {
+		return nil, nil, err
+	}
+	if found != tag {
+		return nil, nil, fmt.Errorf("expected tag %#x for %s, got %#x", tag, msg.T, found)
+	}
+	if fields < 1 {
+		return nil, nil, fmt.Errorf("expected at least 1 fields for %s, got 0", msg.T)
+	}
+
+	m := map[string]interface{}{}
+	if kind, err := s.Peek(); err != nil || kind == NullKind {
+		return m, nil, err
+	}
+	size, err := s.ReadMap()
+	if err != nil {
+		return nil, nil, fmt.Errorf("expected field 0 to be a map: %s", err)
+	}
+
+	var creds *Credentials
+	for i := 0; i < size; i++ {
+		key, err := s.ReadString()
+		if err != nil {
+			return nil, nil, err
+		}
+		if key == "credentials" {
+			if kind, _ := s.Peek(); kind == NullKind {
+				s.Skip()
+				continue
+			}
+			secret, err := s.ReadStringBytes()
+			if err != nil {
+				return nil, nil, fmt.Errorf("credentials isn't a string: %s", err)
+			}
+			creds = NewCredentials(secret)
+			continue
+		}
+		val, n, err := Unpack(payload[s.Pos():])
+		if err != nil {
+			return nil, nil, err
+		}
+		s.pos = s.pos + n
+		m[key] = val
+	}
+	return m, creds, nil
+}
+
+// Copy all entries of m except those with the given keys, returning nil
+// if nothing is left.
+func extraFields(m map[string]interface{}, known ...string) map[string]interface{} {
+	extra := make(map[string]interface{})
+	for key, val := range m {
+		extra[key] = val
+	}
+	for _, key := range known {
+		delete(extra, key)
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	return extra
+}
+
+func stringsField(val interface{}) ([]string, error) {
+	if val == nil {
+		return nil, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of strings, got %T", val)
+	}
+	result := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of strings, found %T", item)
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+// Transaction details shared by RUN (for auto-commit transactions) and
+// BEGIN. Any keys we don't model are kept in Extra so they survive a
+// Decode/Encode round trip.
+type TxMetadata struct {
+	Bookmarks  []string
+	TxTimeout  int // milliseconds, 0 if not set
+	TxMetadata map[string]interface{}
+	Mode       Mode
+	DB         string
+	Extra      map[string]interface{}
+}
+
+func (t *TxMetadata) fromMap(m map[string]interface{}) error {
+	var err error
+
+	t.Bookmarks, err = stringsField(m["bookmarks"])
+	if err != nil {
+		return err
+	}
+
+	if val, found := m["tx_timeout"]; found && val != nil {
+		timeout, ok := val.(int)
+		if !ok {
+			return fmt.Errorf("tx_timeout isn't an int: %T", val)
+		}
+		t.TxTimeout = timeout
+	}
+
+	if val, found := m["tx_metadata"]; found && val != nil {
+		meta, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("tx_metadata isn't a map: %T", val)
+		}
+		t.TxMetadata = meta
+	}
+
+	t.Mode = WriteMode
+	if val, found := m["mode"]; found && val != nil {
+		mode, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("mode isn't a string: %T", val)
+		}
+		if mode == "r" {
+			t.Mode = ReadMode
+		}
+	}
+
+	if val, found := m["db"]; found && val != nil {
+		db, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("db isn't a string: %T", val)
+		}
+		t.DB = db
+	}
+
+	t.Extra = extraFields(m, "bookmarks", "tx_timeout", "tx_metadata", "mode", "db")
+	return nil
+}
+
+func (t TxMetadata) toMap() map[string]interface{} {
+	m := make(map[string]interface{}, len(t.Extra)+5)
+	for key, val := range t.Extra {
+		m[key] = val
+	}
+	if len(t.Bookmarks) > 0 {
+		m["bookmarks"] = t.Bookmarks
+	}
+	if t.TxTimeout > 0 {
+		m["tx_timeout"] = t.TxTimeout
+	}
+	if t.TxMetadata != nil {
+		m["tx_metadata"] = t.TxMetadata
+	}
+	if t.Mode == ReadMode {
+		m["mode"] = "r"
+	}
+	if t.DB != "" {
+		m["db"] = t.DB
+	}
+	return m
+}
+
+// HELLO { user_agent, scheme, principal, credentials, routing, ... }
+//
+// Credentials never pass through a string: Decode copies them straight
+// out of the message and Encode packs them back in from the bytes.
+type Hello struct {
+	UserAgent   string
+	Scheme      string
+	Principal   string
+	Credentials *Credentials
+	Routing     map[string]interface{}
+	Extra       map[string]interface{}
+}
+
+func (h *Hello) Type() Type { return HelloMsg }
+
+func (h *Hello) Decode(msg *Message) error {
+	m, creds, err := unpackAuthMessage(msg, helloTag)
+	if err != nil {
+		return err
+	}
+
+	*h = Hello{Credentials: creds}
+	for key, dst := range map[string]*string{
+		"user_agent": &h.UserAgent,
+		"scheme":     &h.Scheme,
+		"principal":  &h.Principal,
+	} {
+		if val, found := m[key]; found && val != nil {
+			str, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("%s isn't a string: %T", key, val)
+			}
+			*dst = str
+		}
+	}
+
+	if val, found := m["routing"]; found && val != nil {
+		routing, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("routing isn't a map: %T", val)
+		}
+		h.Routing = routing
+	}
+
+	h.Extra = extraFields(m, "user_agent", "scheme", "principal", "routing")
+	return nil
+}
+
+func (h *Hello) Encode() (*Message, error) {
+	m := make(map[string]interface{}, len(h.Extra)+5)
+	for key, val := range h.Extra {
+		m[key] = val
+	}
+	m["user_agent"] = h.UserAgent
+	if h.Scheme != "" {
+		m["scheme"] = h.Scheme
+	}
+	if h.Principal != "" {
+		m["principal"] = h.Principal
+	}
+	if h.Credentials != nil {
+		m["credentials"] = h.Credentials
+	}
+	if h.Routing != nil {
+		m["routing"] = h.Routing
+	}
+	return packMessage(HelloMsg, helloTag, m)
+}
+
+// HELLO keys, besides scheme, principal, and credentials, that are part of
+// the auth and so moved to LOGON in Bolt 5.1
+var authExtraKeys = []string{"realm", "parameters"}
+
+// Split the auth out of a HELLO into a LOGON, the way Bolt 5.1+ wants it.
+// The Credentials are shared, not copied.
+func (h *Hello) SplitAuth() (*Hello, *Logon) {
+	hello := *h
+	hello.Scheme, hello.Principal, hello.Credentials = "", "", nil
+	hello.Extra = extraFields(h.Extra, authExtraKeys...)
+
+	logon := &Logon{Scheme: h.Scheme, Principal: h.Principal, Credentials: h.Credentials}
+	for _, key := range authExtraKeys {
+		if val, found := h.Extra[key]; found {
+			if logon.Extra == nil {
+				logon.Extra = make(map[string]interface{})
+			}
+			logon.Extra[key] = val
+		}
+	}
+	return &hello, logon
+}
+
+// Take on the auth from a LOGON, as if it came in the HELLO the way it did
+// before Bolt 5.1. The Credentials are shared, not copied.
+func (h *Hello) MergeAuth(l *Logon) {
+	h.Scheme, h.Principal, h.Credentials = l.Scheme, l.Principal, l.Credentials
+	if len(l.Extra) > 0 && h.Extra == nil {
+		h.Extra = make(map[string]interface{}, len(l.Extra))
+	}
+	for key, val := range l.Extra {
+		h.Extra[key] = val
+	}
+}
+
+// LOGON { scheme, principal, credentials, ... }, which carries the auth
+// that HELLO did before Bolt 5.1
+type Logon struct {
+	Scheme      string
+	Principal   string
+	Credentials *Credentials
+	Extra       map[string]interface{}
+}
+
+func (l *Logon) Type() Type { return LogonMsg }
+
+func (l *Logon) Decode(msg *Message) error {
+	m, creds, err := unpackAuthMessage(msg, logonTag)
+	if err != nil {
+		return err
+	}
+
+	*l = Logon{Credentials: creds}
+	for key, dst := range map[string]*string{
+		"scheme":    &l.Scheme,
+		"principal": &l.Principal,
+	} {
+		if val, found := m[key]; found && val != nil {
+			str, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("%s isn't a string: %T", key, val)
+			}
+			*dst = str
+		}
+	}
+
+	l.Extra = extraFields(m, "scheme", "principal")
+	return nil
+}
+
+func (l *Logon) Encode() (*Message, error) {
+	m := make(map[string]interface{}, len(l.Extra)+3)
+	for key, val := range l.Extra {
+		m[key] = val
+	}
+	m["scheme"] = l.Scheme
+	if l.Principal != "" {
+		m["principal"] = l.Principal
+	}
+	if l.Credentials != nil {
+		m["credentials"] = l.Credentials
+	}
+	return packMessage(LogonMsg, logonTag, m)
+}
+
+// LOGOFF
+type Logoff struct{}
+
+func (l *Logoff) Type() Type { return LogoffMsg }
+
+func (l *Logoff) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, logoffTag, 0)
+	return err
+}
+
+func (l *Logoff) Encode() (*Message, error) {
+	return packMessage(LogoffMsg, logoffTag)
+}
+
+// GOODBYE
+type Goodbye struct{}
+
+func (g *Goodbye) Type() Type { return GoodbyeMsg }
+
+func (g *Goodbye) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, goodbyeTag, 0)
+	return err
+}
+
+func (g *Goodbye) Encode() (*Message, error) {
+	return packMessage(GoodbyeMsg, goodbyeTag)
+}
+
+// RESET
+type Reset struct{}
+
+func (r *Reset) Type() Type { return ResetMsg }
+
+func (r *Reset) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, resetTag, 0)
+	return err
+}
+
+func (r *Reset) Encode() (*Message, error) {
+	return packMessage(ResetMsg, resetTag)
+}
+
+// RUN query, params, { bookmarks, tx_timeout, tx_metadata, mode, db }
+type Run struct {
+	Query    string
+	Params   map[string]interface{}
+	Metadata TxMetadata
+}
+
+func (r *Run) Type() Type { return RunMsg }
+
+func (r *Run) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, runTag, 2)
+	if err != nil {
+		return err
+	}
+
+	*r = Run{}
+	query, ok := fields[0].(string)
+	if !ok {
+		return fmt.Errorf("expected query to be a string, got %T", fields[0])
+	}
+	r.Query = query
+
+	r.Params, err = mapField(fields, 1)
+	if err != nil {
+		return err
+	}
+
+	// Bolt v1/v2 RUN messages don't have metadata
+	meta := map[string]interface{}{}
+	if len(fields) > 2 {
+		meta, err = mapField(fields, 2)
+		if err != nil {
+			return err
+		}
+	}
+	return r.Metadata.fromMap(meta)
+}
+
+func (r *Run) Encode() (*Message, error) {
+	params := r.Params
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	return packMessage(RunMsg, runTag, r.Query, params, r.Metadata.toMap())
+}
+
+// BEGIN { bookmarks, tx_timeout, tx_metadata, mode, db }
+type Begin struct {
+	TxMetadata
+}
+
+func (b *Begin) Type() Type { return BeginMsg }
+
+func (b *Begin) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, beginTag, 0)
+	if err != nil {
+		return err
+	}
+
+	*b = Begin{}
+	meta := map[string]interface{}{}
+	if len(fields) > 0 {
+		meta, err = mapField(fields, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return b.fromMap(meta)
+}
+
+func (b *Begin) Encode() (*Message, error) {
+	return packMessage(BeginMsg, beginTag, b.toMap())
+}
+
+// COMMIT
+type Commit struct{}
+
+func (c *Commit) Type() Type { return CommitMsg }
+
+func (c *Commit) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, commitTag, 0)
+	return err
+}
+
+func (c *Commit) Encode() (*Message, error) {
+	return packMessage(CommitMsg, commitTag)
+}
+
+// ROLLBACK
+type Rollback struct{}
+
+func (r *Rollback) Type() Type { return RollbackMsg }
+
+func (r *Rollback) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, rollbackTag, 0)
+	return err
+}
+
+func (r *Rollback) Encode() (*Message, error) {
+	return packMessage(RollbackMsg, rollbackTag)
+}
+
+// ROUTE { routing } [ bookmarks ] db, which since Bolt 4.4 is a map of db
+// and imp_user instead. Encodes the 4.4 way.
+type Route struct {
+	Routing   map[string]interface{}
+	Bookmarks []string
+	DB        string
+	ImpUser   string
+}
+
+func (r *Route) Type() Type { return RouteMsg }
+
+func (r *Route) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, routeTag, 3)
+	if err != nil {
+		return err
+	}
+
+	*r = Route{}
+	if r.Routing, err = mapField(fields, 0); err != nil {
+		return err
+	}
+	if r.Bookmarks, err = stringsField(fields[1]); err != nil {
+		return err
+	}
+
+	switch db := fields[2].(type) {
+	case nil:
+	case string:
+		r.DB = db
+	case map[string]interface{}:
+		for key, dst := range map[string]*string{"db": &r.DB, "imp_user": &r.ImpUser} {
+			if val, found := db[key]; found && val != nil {
+				str, ok := val.(string)
+				if !ok {
+					return fmt.Errorf("%s isn't a string: %T", key, val)
+				}
+				*dst = str
+			}
+		}
+	default:
+		return fmt.Errorf("expected db to be a string or map, got %T", db)
+	}
+	return nil
+}
+
+func (r *Route) Encode() (*Message, error) {
+	routing := r.Routing
+	if routing == nil {
+		routing = map[string]interface{}{}
+	}
+	bookmarks := r.Bookmarks
+	if bookmarks == nil {
+		bookmarks = []string{}
+	}
+	extra := map[string]interface{}{}
+	if r.DB != "" {
+		extra["db"] = r.DB
+	}
+	if r.ImpUser != "" {
+		extra["imp_user"] = r.ImpUser
+	}
+	return packMessage(RouteMsg, routeTag, routing, bookmarks, extra)
+}
+
+// Decode the { n, qid } map shared by PULL and DISCARD. Older Bolt versions
+// (PULL_ALL and DISCARD_ALL) have no fields, which is the same as asking
+// for everything from the last query.
+func streamFields(msg *Message, tag byte) (int, int, error) {
+	fields, err := unpackMessage(msg, tag, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, qid := -1, -1
+	if len(fields) == 0 {
+		return n, qid, nil
+	}
+
+	m, err := mapField(fields, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if val, found := m["n"]; found {
+		if n, err = intValue("n", val); err != nil {
+			return 0, 0, err
+		}
+	}
+	if val, found := m["qid"]; found {
+		if qid, err = intValue("qid", val); err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, qid, nil
+}
+
+func intValue(name string, val interface{}) (int, error) {
+	i, ok := val.(int)
+	if !ok {
+		return 0, fmt.Errorf("%s isn't an int: %T", name, val)
+	}
+	return i, nil
+}
+
+func streamMap(n, qid int) map[string]interface{} {
+	m := map[string]interface{}{"n": n}
+	if qid != -1 {
+		m["qid"] = qid
+	}
+	return m
+}
+
+// PULL { n, qid }, where -1 means "all" for n and "last query" for qid
+type Pull struct {
+	N, Qid int
+}
+
+func (p *Pull) Type() Type { return PullMsg }
+
+func (p *Pull) Decode(msg *Message) error {
+	n, qid, err := streamFields(msg, pullTag)
+	if err != nil {
+		return err
+	}
+	p.N, p.Qid = n, qid
+	return nil
+}
+
+func (p *Pull) Encode() (*Message, error) {
+	return packMessage(PullMsg, pullTag, streamMap(p.N, p.Qid))
+}
+
+// DISCARD { n, qid }, where -1 means "all" for n and "last query" for qid
+type Discard struct {
+	N, Qid int
+}
+
+func (d *Discard) Type() Type { return DiscardMsg }
+
+func (d *Discard) Decode(msg *Message) error {
+	n, qid, err := streamFields(msg, discardTag)
+	if err != nil {
+		return err
+	}
+	d.N, d.Qid = n, qid
+	return nil
+}
+
+func (d *Discard) Encode() (*Message, error) {
+	return packMessage(DiscardMsg, discardTag, streamMap(d.N, d.Qid))
+}
+
+// SUCCESS { metadata }
+type Success struct {
+	Metadata map[string]interface{}
+}
+
+func (s *Success) Type() Type { return SuccessMsg }
+
+func (s *Success) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, successTag, 1)
+	if err != nil {
+		return err
+	}
+	s.Metadata, err = mapField(fields, 0)
+	return err
+}
+
+func (s *Success) Encode() (*Message, error) {
+	meta := s.Metadata
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	return packMessage(SuccessMsg, successTag, meta)
+}
+
+// FAILURE { code, message }
+type Failure struct {
+	Code    string
+	Message string
+}
+
+func (f *Failure) Type() Type { return FailureMsg }
+
+func (f *Failure) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, failureTag, 1)
+	if err != nil {
+		return err
+	}
+	m, err := mapField(fields, 0)
+	if err != nil {
+		return err
+	}
+
+	*f = Failure{}
+	for key, dst := range map[string]*string{
+		"code":    &f.Code,
+		"message": &f.Message,
+	} {
+		if val, found := m[key]; found && val != nil {
+			s, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("%s isn't a string: %T", key, val)
+			}
+			*dst = s
+		}
+	}
+	return nil
+}
+
+func (f *Failure) Encode() (*Message, error) {
+	return packMessage(FailureMsg, failureTag, map[string]interface{}{
+		"code":    f.Code,
+		"message": f.Message,
+	})
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s: %s", f.Code, f.Message)
+}
+
+// RECORD [ values ]
+type Record struct {
+	Values []interface{}
+}
+
+func (r *Record) Type() Type { return RecordMsg }
+
+func (r *Record) Decode(msg *Message) error {
+	fields, err := unpackMessage(msg, recordTag, 1)
+	if err != nil {
+		return err
+	}
+	values, ok := fields[0].([]interface{})
+	if !ok {
+		return fmt.Errorf("expected record values to be a list, got %T", fields[0])
+	}
+	r.Values = values
+	return nil
+}
+
+func (r *Record) Encode() (*Message, error) {
+	values := r.Values
+	if values == nil {
+		values = []interface{}{}
+	}
+	return packMessage(RecordMsg, recordTag, values)
+}
+
+// IGNORED
+type Ignored struct{}
+
+func (i *Ignored) Type() Type { return IgnoreMsg }
+
+func (i *Ignored) Decode(msg *Message) error {
+	_, err := unpackMessage(msg, ignoredTag, 0)
+	return err
+}
+
+func (i *Ignored) Encode() (*Message, error) {
+	return packMessage(IgnoreMsg, ignoredTag)
+}
+
+// Build a chunked SUCCESS message without metadata. One with metadata,
+// which might not pack, comes from encoding a Success.
+func NewSuccess() *Message {
+	return &Message{T: SuccessMsg, Data: []byte{0x00, 0x03, 0xb1, successTag, 0xa0, 0x00, 0x00}}
+}
+
+// Build a chunked FAILURE message. Codes should follow Neo4j's status code
+// convention, e.g. "Neo.ClientError.Request.Invalid".
+func NewFailure(code, message string) *Message {
+	// a map of two strings always packs, so there's no error to handle
+	msg, _ := (&Failure{Code: code, Message: message}).Encode()
+	return msg
+}
+
+// Build a chunked IGNORED message
+func NewIgnored() *Message {
+	return &Message{T: IgnoreMsg, Data: []byte{0x00, 0x02, 0xb0, ignoredTag, 0x00, 0x00}}
+}
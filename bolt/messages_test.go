@@ -0,0 +1,408 @@
+package bolt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodingRun(t *testing.T) {
+	// RUN "RETURN 1" {} {"db": "movies", "mode": "r", "bookmarks": ["bm:1"]}
+	msg := &Message{
+		T: RunMsg,
+		Data: []byte{0x0, 0x2e, 0xb3, 0x10,
+			0x88, 0x52, 0x45, 0x54, 0x55, 0x52, 0x4e, 0x20, 0x31,
+			0xa0,
+			0xa3,
+			0x89, 0x62, 0x6f, 0x6f, 0x6b, 0x6d, 0x61, 0x72, 0x6b, 0x73,
+			0x91, 0x84, 0x62, 0x6d, 0x3a, 0x31,
+			0x82, 0x64, 0x62,
+			0x86, 0x6d, 0x6f, 0x76, 0x69, 0x65, 0x73,
+			0x84, 0x6d, 0x6f, 0x64, 0x65,
+			0x81, 0x72,
+			0x0, 0x0},
+	}
+
+	run := Run{}
+	if err := run.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if run.Query != "RETURN 1" {
+		t.Fatalf("expected query 'RETURN 1', got %s\n", run.Query)
+	}
+	if run.Metadata.DB != "movies" {
+		t.Fatalf("expected db 'movies', got %s\n", run.Metadata.DB)
+	}
+	if run.Metadata.Mode != ReadMode {
+		t.Fatalf("expected read mode, got %s\n", run.Metadata.Mode)
+	}
+	if !reflect.DeepEqual([]string{"bm:1"}, run.Metadata.Bookmarks) {
+		t.Fatalf("unexpected bookmarks: %#v\n", run.Metadata.Bookmarks)
+	}
+
+	out, err := run.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Data, out.Data) {
+		t.Fatalf("expected %#v, got %#v\n", msg.Data, out.Data)
+	}
+}
+
+func TestDecodingBegin(t *testing.T) {
+	// BEGIN { "mode": "r" }
+	msg := &Message{
+		T:    BeginMsg,
+		Data: []byte{0x00, 0x0a, 0xb1, 0x11, 0xa1, 0x84, 0x6d, 0x6f, 0x64, 0x65, 0x81, 0x72, 0x0, 0x0},
+	}
+
+	typed, err := Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin, ok := typed.(*Begin)
+	if !ok {
+		t.Fatalf("expected a *Begin, got %T\n", typed)
+	}
+	if begin.Mode != ReadMode {
+		t.Fatalf("expected read mode, got %s\n", begin.Mode)
+	}
+	if begin.DB != "" {
+		t.Fatalf("expected no db, got %s\n", begin.DB)
+	}
+}
+
+func TestDecodingHello(t *testing.T) {
+	// HELLO with a null routing context, mirroring cypher-shell
+	payload := []byte{0xb1, 0x01, 0xa5, 0x89, 0x70, 0x72, 0x69, 0x6e, 0x63, 0x69, 0x70, 0x61, 0x6c, 0x85, 0x6e, 0x65, 0x6f, 0x34, 0x6a, 0x87, 0x72, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0xc0, 0x86, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x65, 0x85, 0x62, 0x61, 0x73, 0x69, 0x63, 0x8b, 0x63, 0x72, 0x65, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x6c, 0x73, 0x88, 0x70, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x8a, 0x75, 0x73, 0x65, 0x72, 0x5f, 0x61, 0x67, 0x65, 0x6e, 0x74, 0xd0, 0x19, 0x6e, 0x65, 0x6f, 0x34, 0x6a, 0x2d, 0x63, 0x79, 0x70, 0x68, 0x65, 0x72, 0x2d, 0x73, 0x68, 0x65, 0x6c, 0x6c, 0x2f, 0x76, 0x34, 0x2e, 0x32, 0x2e, 0x32}
+	msg := &Message{T: HelloMsg, Data: Chunker{}.Chunk(payload)}
+
+	hello := Hello{}
+	if err := hello.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	expected := Hello{
+		UserAgent:   "neo4j-cypher-shell/v4.2.2",
+		Scheme:      "basic",
+		Principal:   "neo4j",
+		Credentials: NewCredentials([]byte("password")),
+	}
+	if !reflect.DeepEqual(expected, hello) {
+		t.Fatalf("expected %#v, got %#v\n", expected, hello)
+	}
+}
+
+func TestDecodingMultipleChunks(t *testing.T) {
+	// RECORD [1, 2] split across two chunks
+	msg := &Message{
+		T:    RecordMsg,
+		Data: []byte{0x0, 0x2, 0xb1, 0x71, 0x0, 0x3, 0x92, 0x01, 0x02, 0x0, 0x0},
+	}
+
+	record := Record{}
+	if err := record.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]interface{}{1, 2}, record.Values) {
+		t.Fatalf("unexpected record values: %#v\n", record.Values)
+	}
+}
+
+func TestDecodingFailure(t *testing.T) {
+	failure := &Failure{
+		Code:    "Neo.ClientError.Security.Unauthorized",
+		Message: "The client is unauthorized due to authentication failure.",
+	}
+	msg, err := failure.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != FailureMsg || IdentifyType(msg.Data) != FailureMsg {
+		t.Fatalf("expected a FailureMsg, got %s\n", msg.T)
+	}
+
+	out := Failure{}
+	if err = out.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if out != *failure {
+		t.Fatalf("expected %#v, got %#v\n", failure, out)
+	}
+}
+
+func TestDecodingPullAll(t *testing.T) {
+	// Bolt v3 PULL_ALL has no fields
+	msg := &Message{T: PullMsg, Data: []byte{0x0, 0x2, 0xb0, 0x3f, 0x0, 0x0}}
+
+	pull := Pull{}
+	if err := pull.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if pull.N != -1 || pull.Qid != -1 {
+		t.Fatalf("expected n=-1, qid=-1, got %#v\n", pull)
+	}
+}
+
+func TestTypedRoundTrips(t *testing.T) {
+	messages := []TypedMessage{
+		&Hello{UserAgent: "bolt-proxy", Scheme: "basic", Principal: "neo4j",
+			Credentials: NewCredentials([]byte("password")),
+			Routing:     map[string]interface{}{"address": "localhost:8888"},
+			Extra:       map[string]interface{}{"patch_bolt": []interface{}{"utc"}}},
+		&Goodbye{},
+		&Reset{},
+		&Run{Query: "RETURN $x", Params: map[string]interface{}{"x": 1.5},
+			Metadata: TxMetadata{Mode: WriteMode, TxTimeout: 500,
+				TxMetadata: map[string]interface{}{"app": "test"}}},
+		&Begin{TxMetadata{Mode: ReadMode, DB: "neo4j", Bookmarks: []string{"a", "b"}}},
+		&Commit{},
+		&Rollback{},
+		&Pull{N: 1000, Qid: -1},
+		&Discard{N: -1, Qid: 3},
+		&Success{Metadata: map[string]interface{}{"fields": []interface{}{"x"}}},
+		&Failure{Code: "Neo.ClientError.Statement.SyntaxError", Message: "oops"},
+		&Record{Values: []interface{}{1, "two", nil}},
+		&Ignored{},
+	}
+
+	for _, typed := range messages {
+		msg, err := typed.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode %#v: %s\n", typed, err)
+		}
+		if msg.T != typed.Type() || IdentifyType(msg.Data) != typed.Type() {
+			t.Fatalf("expected type %s, got %s\n", typed.Type(), msg.T)
+		}
+
+		out, err := Decode(msg)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %s\n", typed.Type(), err)
+		}
+		if !reflect.DeepEqual(typed, out) {
+			t.Fatalf("expected %#v, got %#v\n", typed, out)
+		}
+	}
+}
+
+func TestDecodingWrongMessage(t *testing.T) {
+	commit, err := (&Commit{}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := Run{}
+	if err = run.Decode(commit); err == nil {
+		t.Fatal("expected decoding a COMMIT as a RUN to fail")
+	}
+
+	if _, err = Decode(&Message{T: NopMsg}); err == nil {
+		t.Fatal("expected decoding a NOP to fail")
+	}
+
+	begin := Begin{}
+	if err = begin.Decode(&Message{T: BeginMsg, Data: []byte{0x0, 0x9, 0xb1, 0x11}}); err == nil {
+		t.Fatal("expected decoding a truncated BEGIN to fail")
+	}
+}
+
+func TestResponseBuilders(t *testing.T) {
+	// the old hardcoded HELLO response from proxy.go
+	expected := []byte{
+		0x0, 0x2b, 0xb1, 0x70,
+		0xa2,
+		0x8d, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64,
+		0x86, 0x62, 0x6f, 0x6c, 0x74, 0x2d, 0x34,
+		0x86, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72,
+		0x8b, 0x4e, 0x65, 0x6f, 0x34, 0x6a, 0x2f, 0x34, 0x2e,
+		0x32, 0x2e, 0x30,
+		0x00, 0x00}
+	success, err := (&Success{Metadata: map[string]interface{}{
+		"server":        "Neo4j/4.2.0",
+		"connection_id": "bolt-4",
+	}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success.T != SuccessMsg || !bytes.Equal(expected, success.Data) {
+		t.Fatalf("expected %#v, got %#v\n", expected, success.Data)
+	}
+
+	// the old hardcoded RESET response, same as encoding no metadata
+	empty := NewSuccess()
+	if !bytes.Equal([]byte{0x0, 0x3, 0xb1, 0x70, 0xa0, 0x0, 0x0}, empty.Data) {
+		t.Fatalf("unexpected empty success: %#v\n", empty.Data)
+	}
+	if encoded, _ := (&Success{}).Encode(); !bytes.Equal(encoded.Data, empty.Data) ||
+		IdentifyType(empty.Data) != SuccessMsg {
+		t.Fatalf("expected an empty SUCCESS, got %#v\n", encoded.Data)
+	}
+
+	if _, err = (&Success{Metadata: map[string]interface{}{"bad": struct{}{}}}).Encode(); err == nil {
+		t.Fatal("expected error building SUCCESS with unsupported metadata")
+	}
+
+	failure := NewFailure("Neo.ClientError.Request.Invalid", "nope")
+	if failure.T != FailureMsg || IdentifyType(failure.Data) != FailureMsg {
+		t.Fatalf("expected a FAILURE, got %s\n", failure.T)
+	}
+	f := Failure{}
+	if err = f.Decode(failure); err != nil {
+		t.Fatal(err)
+	}
+	if f.Code != "Neo.ClientError.Request.Invalid" || f.Message != "nope" {
+		t.Fatalf("unexpected failure: %#v\n", f)
+	}
+
+	ignored := NewIgnored()
+	if ignored.T != IgnoreMsg || IdentifyType(ignored.Data) != IgnoreMsg {
+		t.Fatalf("expected IGNORED, got %s\n", ignored.T)
+	}
+	if err = (&Ignored{}).Decode(ignored); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Bolt 5.x messages, laid out the way the 5.x drivers send them
+var (
+	// HELLO {bolt_agent: {...}, notifications_minimum_severity: "WARNING",
+	// routing: {address: "localhost:7687"}, user_agent: "neo4j-python/5.14.0 ..."}
+	hello5 = []byte{
+		0x00, 0xf0, 0xb1, 0x01, 0xa4, 0x8a, 0x62, 0x6f, 0x6c, 0x74, 0x5f, 0x61, 0x67, 0x65, 0x6e, 0x74,
+		0xa3, 0x88, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0xd0, 0x15, 0x50, 0x79, 0x74, 0x68,
+		0x6f, 0x6e, 0x2f, 0x33, 0x2e, 0x31, 0x31, 0x2e, 0x34, 0x2d, 0x66, 0x69, 0x6e, 0x61, 0x6c, 0x2d,
+		0x30, 0x88, 0x70, 0x6c, 0x61, 0x74, 0x66, 0x6f, 0x72, 0x6d, 0xd0, 0x13, 0x4c, 0x69, 0x6e, 0x75,
+		0x78, 0x20, 0x36, 0x2e, 0x31, 0x2e, 0x30, 0x3b, 0x20, 0x78, 0x38, 0x36, 0x5f, 0x36, 0x34, 0x87,
+		0x70, 0x72, 0x6f, 0x64, 0x75, 0x63, 0x74, 0xd0, 0x13, 0x6e, 0x65, 0x6f, 0x34, 0x6a, 0x2d, 0x70,
+		0x79, 0x74, 0x68, 0x6f, 0x6e, 0x2f, 0x35, 0x2e, 0x31, 0x34, 0x2e, 0x30, 0xd0, 0x1e, 0x6e, 0x6f,
+		0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x5f, 0x6d, 0x69, 0x6e, 0x69,
+		0x6d, 0x75, 0x6d, 0x5f, 0x73, 0x65, 0x76, 0x65, 0x72, 0x69, 0x74, 0x79, 0x87, 0x57, 0x41, 0x52,
+		0x4e, 0x49, 0x4e, 0x47, 0x87, 0x72, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0xa1, 0x87, 0x61, 0x64,
+		0x64, 0x72, 0x65, 0x73, 0x73, 0x8e, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, 0x3a,
+		0x37, 0x36, 0x38, 0x37, 0x8a, 0x75, 0x73, 0x65, 0x72, 0x5f, 0x61, 0x67, 0x65, 0x6e, 0x74, 0xd0,
+		0x31, 0x6e, 0x65, 0x6f, 0x34, 0x6a, 0x2d, 0x70, 0x79, 0x74, 0x68, 0x6f, 0x6e, 0x2f, 0x35, 0x2e,
+		0x31, 0x34, 0x2e, 0x30, 0x20, 0x50, 0x79, 0x74, 0x68, 0x6f, 0x6e, 0x2f, 0x33, 0x2e, 0x31, 0x31,
+		0x2e, 0x34, 0x2d, 0x66, 0x69, 0x6e, 0x61, 0x6c, 0x2d, 0x30, 0x20, 0x28, 0x6c, 0x69, 0x6e, 0x75,
+		0x78, 0x29, 0x00, 0x00,
+	}
+	// LOGON {credentials: "password", principal: "neo4j", scheme: "basic"}
+	logon5 = []byte{
+		0x00, 0x35, 0xb1, 0x6a, 0xa3, 0x8b, 0x63, 0x72, 0x65, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x6c,
+		0x73, 0x88, 0x70, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x89, 0x70, 0x72, 0x69, 0x6e, 0x63,
+		0x69, 0x70, 0x61, 0x6c, 0x85, 0x6e, 0x65, 0x6f, 0x34, 0x6a, 0x86, 0x73, 0x63, 0x68, 0x65, 0x6d,
+		0x65, 0x85, 0x62, 0x61, 0x73, 0x69, 0x63, 0x00, 0x00,
+	}
+	// LOGOFF
+	logoff5 = []byte{0x00, 0x02, 0xb0, 0x6b, 0x00, 0x00}
+	// TELEMETRY 1 (the transaction function API)
+	telemetry5 = []byte{0x00, 0x03, 0xb1, 0x54, 0x01, 0x00, 0x00}
+	// RECORD [(:Person {name: "Dave"}) with an element id, a UTC DateTime]
+	record5 = []byte{
+		0x00, 0x4e, 0xb1, 0x71, 0x92, 0xb4, 0x4e, 0x07, 0x91, 0x86, 0x50, 0x65, 0x72, 0x73, 0x6f, 0x6e,
+		0xa1, 0x84, 0x6e, 0x61, 0x6d, 0x65, 0x84, 0x44, 0x61, 0x76, 0x65, 0xd0, 0x28, 0x34, 0x3a, 0x36,
+		0x64, 0x34, 0x65, 0x34, 0x63, 0x31, 0x32, 0x2d, 0x38, 0x63, 0x62, 0x63, 0x2d, 0x34, 0x64, 0x37,
+		0x37, 0x2d, 0x38, 0x61, 0x39, 0x32, 0x2d, 0x61, 0x65, 0x36, 0x64, 0x36, 0x61, 0x31, 0x61, 0x62,
+		0x33, 0x34, 0x65, 0x3a, 0x37, 0xb3, 0x49, 0xca, 0x65, 0x53, 0xf1, 0x00, 0x00, 0xc9, 0x0e, 0x10,
+		0x00, 0x00,
+	}
+)
+
+func TestBolt5Messages(t *testing.T) {
+	v54 := CatalogFor(Version{5, 4})
+	for data, expected := range map[*[]byte]Type{
+		&hello5: HelloMsg, &logon5: LogonMsg, &logoff5: LogoffMsg,
+		&telemetry5: TelemetryMsg, &record5: RecordMsg,
+	} {
+		if found := v54.IdentifyType(*data); found != expected {
+			t.Fatalf("expected %s, got %s\n", expected, found)
+		}
+	}
+	if CatalogFor(Version{5, 3}).Allows(TelemetryMsg) {
+		t.Fatal("expected no TELEMETRY before 5.4")
+	}
+
+	// HELLO carries no auth, and keeps what we don't model
+	hello := &Hello{}
+	if err := hello.Decode(&Message{T: HelloMsg, Data: hello5}); err != nil {
+		t.Fatal(err)
+	}
+	if hello.Credentials != nil || hello.Routing["address"] != "localhost:7687" ||
+		hello.Extra["notifications_minimum_severity"] != "WARNING" || hello.Extra["bolt_agent"] == nil {
+		t.Fatalf("unexpected HELLO %#v\n", hello)
+	}
+
+	logon := &Logon{}
+	if err := logon.Decode(&Message{T: LogonMsg, Data: logon5}); err != nil {
+		t.Fatal(err)
+	}
+	if logon.Scheme != "basic" || logon.Principal != "neo4j" ||
+		string(logon.Credentials.Bytes()) != "password" {
+		t.Fatalf("unexpected LOGON %#v\n", logon)
+	}
+	msg, err := logon.Encode()
+	if err != nil || !bytes.Equal(logon5, msg.Data) {
+		t.Fatalf("expected LOGON to round trip, got %#v (%v)\n", msg, err)
+	}
+	if _, err = Decode(&Message{T: LogoffMsg, Data: logoff5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// merging and splitting the auth gets us back where we started
+	hello.MergeAuth(&Logon{Scheme: "kerberos", Credentials: logon.Credentials,
+		Extra: map[string]interface{}{"realm": "EXAMPLE.COM"}})
+	if hello.Scheme != "kerberos" || hello.Extra["realm"] != "EXAMPLE.COM" {
+		t.Fatalf("expected the LOGON's auth in the HELLO, got %#v\n", hello)
+	}
+	bare, split := hello.SplitAuth()
+	if bare.Credentials != nil || bare.Scheme != "" || bare.Extra["realm"] != nil ||
+		bare.Extra["bolt_agent"] == nil {
+		t.Fatalf("expected a HELLO without auth, got %#v\n", bare)
+	}
+	if split.Scheme != "kerberos" || split.Credentials != logon.Credentials ||
+		split.Extra["realm"] != "EXAMPLE.COM" {
+		t.Fatalf("expected a LOGON with the auth, got %#v\n", split)
+	}
+
+	// element ids and UTC datetimes
+	record := Record{}
+	if err = record.Decode(&Message{T: RecordMsg, Data: record5}); err != nil {
+		t.Fatal(err)
+	}
+	node, err := DecodeStructure(record.Values[0].(Structure))
+	if err != nil || node.(Node).ElementId != "4:6d4e4c12-8cbc-4d77-8a92-ae6d6a1ab34e:7" {
+		t.Fatalf("expected a node with an element id, got %#v (%v)\n", node, err)
+	}
+	when, err := DecodeStructure(record.Values[1].(Structure))
+	if err != nil || when.(DateTime).Legacy || when.(DateTime).Time().Unix() != 1700000000 {
+		t.Fatalf("expected a UTC datetime, got %#v (%v)\n", when, err)
+	}
+}
+
+func TestDecodingRoute(t *testing.T) {
+	routing := map[string]interface{}{"address": "localhost:7687"}
+	bookmarks := []interface{}{"bm1"}
+
+	// 4.3 takes the db as is, 4.4 in a map
+	for _, db := range []interface{}{"movies", map[string]interface{}{"db": "movies", "imp_user": "bob"}} {
+		msg, err := packMessage(RouteMsg, routeTag, routing, bookmarks, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := &Route{}
+		if err = route.Decode(msg); err != nil {
+			t.Fatal(err)
+		}
+		if route.DB != "movies" || len(route.Bookmarks) != 1 || route.Routing["address"] != "localhost:7687" {
+			t.Fatalf("unexpected ROUTE %#v\n", route)
+		}
+	}
+
+	msg, _ := packMessage(RouteMsg, routeTag, routing, bookmarks, nil)
+	route := &Route{}
+	if err := route.Decode(msg); err != nil || route.DB != "" {
+		t.Fatalf("expected no db, got %#v (%v)\n", route, err)
+	}
+	route.ImpUser = "bob"
+	if msg, err := route.Encode(); err != nil || route.Decode(msg) != nil || route.ImpUser != "bob" {
+		t.Fatalf("expected ROUTE to round trip, got %#v (%v)\n", route, err)
+	}
+}
@@ -0,0 +1,425 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A PackStream Structure, identified by its tag byte and holding zero or
+// many fields. Bolt messages themselves are Structures, as are the graph
+// and temporal types Neo4j sends back in records.
+type Structure struct {
+	Tag    byte
+	Fields []interface{}
+}
+
+func (s Structure) String() string {
+	return fmt.Sprintf("Structure{Tag: %#x, Fields: %v}", s.Tag, s.Fields)
+}
+
+// How deeply lists, maps and structures may nest before we give up on a
+// value instead of recursing any further
+const MaxDepth = 100
+
+var errShortBuffer = errors.New("packstream: unexpected end of buffer")
+
+var errTooDeep = fmt.Errorf("packstream: values nested more than %d deep", MaxDepth)
+
+// Decode the first PackStream value found in buf, returning it as a Go value
+// along with the number of bytes consumed.
+//
+// Values are decoded into the following Go types:
+//
+//	null      -> nil
+//	boolean   -> bool
+//	integer   -> int
+//	float     -> float64
+//	bytes     -> []byte
+//	string    -> string
+//	list      -> []interface{}
+//	map       -> map[string]interface{}
+//	structure -> Structure
+//
+// Malformed or truncated input, or containers nested more than MaxDepth
+// deep, results in a nil value, the number of bytes consumed before the
+// problem was found, and an error. Unpack never panics.
+func Unpack(buf []byte) (interface{}, int, error) {
+	return unpack(buf, 0)
+}
+
+// Unpack a value found inside depth containers
+func unpack(buf []byte, depth int) (interface{}, int, error) {
+	if len(buf) < 1 {
+		return nil, 0, errShortBuffer
+	}
+
+	marker := buf[0]
+	switch {
+	case marker < 0x80: // tiny-int
+		return int(marker), 1, nil
+	case marker >= 0xf0: // negative tiny-int
+		return int(int8(marker)), 1, nil
+	case marker>>4 == 0x8: // tiny-string
+		return unpackString(buf, 1, int(marker&0xf))
+	case marker>>4 == 0x9: // tiny-list
+		return unpackList(buf, 1, int(marker&0xf), depth)
+	case marker>>4 == 0xa: // tiny-map
+		return unpackMap(buf, 1, int(marker&0xf), depth)
+	case marker>>4 == 0xb: // structure
+		return unpackStructure(buf, int(marker&0xf), depth)
+	}
+
+	switch marker {
+	case 0xc0:
+		return nil, 1, nil
+	case 0xc1:
+		if len(buf) < 9 {
+			return nil, 0, errShortBuffer
+		}
+		bits := binary.BigEndian.Uint64(buf[1:9])
+		return math.Float64frombits(bits), 9, nil
+	case 0xc2:
+		return false, 1, nil
+	case 0xc3:
+		return true, 1, nil
+	case 0xc8, 0xc9, 0xca, 0xcb:
+		width := 1 << (marker - 0xc8)
+		if len(buf) < 1+width {
+			return nil, 0, errShortBuffer
+		}
+		var i int
+		switch width {
+		case 1:
+			i = int(int8(buf[1]))
+		case 2:
+			i = int(int16(binary.BigEndian.Uint16(buf[1:3])))
+		case 4:
+			i = int(int32(binary.BigEndian.Uint32(buf[1:5])))
+		case 8:
+			i = int(int64(binary.BigEndian.Uint64(buf[1:9])))
+		}
+		return i, 1 + width, nil
+	case 0xcc, 0xcd, 0xce:
+		size, pos, err := unpackSize(buf, marker-0xcc)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(buf)-pos < size {
+			return nil, pos, errShortBuffer
+		}
+		data := make([]byte, size)
+		copy(data, buf[pos:pos+size])
+		return data, pos + size, nil
+	case 0xd0, 0xd1, 0xd2:
+		size, pos, err := unpackSize(buf, marker-0xd0)
+		if err != nil {
+			return nil, 0, err
+		}
+		return unpackString(buf, pos, size)
+	case 0xd4, 0xd5, 0xd6:
+		size, pos, err := unpackSize(buf, marker-0xd4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return unpackList(buf, pos, size, depth)
+	case 0xd8, 0xd9, 0xda:
+		size, pos, err := unpackSize(buf, marker-0xd8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return unpackMap(buf, pos, size, depth)
+	}
+
+	return nil, 0, fmt.Errorf("packstream: invalid marker %#x", marker)
+}
+
+// Read the 8, 16, or 32-bit unsigned size following a marker byte. The
+// width argument is 0, 1, or 2 respectively, which conveniently is the low
+// bits of the marker for bytes, strings, lists, and maps.
+func unpackSize(buf []byte, width byte) (int, int, error) {
+	n := 1 << width
+	if len(buf) < 1+n {
+		return 0, 0, errShortBuffer
+	}
+
+	var size int
+	switch n {
+	case 1:
+		size = int(buf[1])
+	case 2:
+		size = int(binary.BigEndian.Uint16(buf[1:3]))
+	case 4:
+		size = int(binary.BigEndian.Uint32(buf[1:5]))
+	}
+	return size, 1 + n, nil
+}
+
+func unpackString(buf []byte, pos, size int) (interface{}, int, error) {
+	if len(buf)-pos < size {
+		return nil, pos, errShortBuffer
+	}
+	return string(buf[pos : pos+size]), pos + size, nil
+}
+
+func unpackList(buf []byte, pos, size, depth int) (interface{}, int, error) {
+	if depth >= MaxDepth {
+		return nil, pos, errTooDeep
+	}
+	// every member takes at least a byte, so don't trust a size that
+	// can't possibly fit in what's left of the buffer
+	if len(buf)-pos < size {
+		return nil, pos, errShortBuffer
+	}
+
+	list := make([]interface{}, size)
+	for i := 0; i < size; i++ {
+		val, n, err := unpack(buf[pos:], depth+1)
+		if err != nil {
+			return nil, pos + n, err
+		}
+		list[i] = val
+		pos = pos + n
+	}
+	return list, pos, nil
+}
+
+func unpackMap(buf []byte, pos, size, depth int) (interface{}, int, error) {
+	if depth >= MaxDepth {
+		return nil, pos, errTooDeep
+	}
+	// each entry is at least 2 bytes: an empty tiny-string key and a
+	// tiny value
+	if (len(buf)-pos)/2 < size {
+		return nil, pos, errShortBuffer
+	}
+
+	m := make(map[string]interface{}, size)
+	for i := 0; i < size; i++ {
+		key, n, err := unpack(buf[pos:], depth+1)
+		if err != nil {
+			return nil, pos + n, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, pos, fmt.Errorf("packstream: map key must be a string, got %T", key)
+		}
+		pos = pos + n
+
+		val, n, err := unpack(buf[pos:], depth+1)
+		if err != nil {
+			return nil, pos + n, err
+		}
+		m[name] = val
+		pos = pos + n
+	}
+	return m, pos, nil
+}
+
+func unpackStructure(buf []byte, size, depth int) (interface{}, int, error) {
+	if depth >= MaxDepth {
+		return nil, 0, errTooDeep
+	}
+	if len(buf) < 2 {
+		return nil, 0, errShortBuffer
+	}
+
+	s := Structure{Tag: buf[1], Fields: make([]interface{}, size)}
+	pos := 2
+	for i := 0; i < size; i++ {
+		val, n, err := unpack(buf[pos:], depth+1)
+		if err != nil {
+			return nil, pos + n, err
+		}
+		s.Fields[i] = val
+		pos = pos + n
+	}
+	return s, pos, nil
+}
+
+// Encode a Go value into PackStream bytes, choosing the smallest marker
+// that fits. Supported types mirror what Unpack produces, plus a few
+// conveniences (sized ints and uints, float32, []string, map[string]string)
+// that make building messages by hand less painful. *Credentials pack as
+// strings.
+//
+// Map keys are written in sorted order so the same map always encodes to
+// the same bytes.
+func Pack(v interface{}) ([]byte, error) {
+	return appendPack(make([]byte, 0, 64), v)
+}
+
+func appendPack(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendInt(buf, int64(val)), nil
+	case int8:
+		return appendInt(buf, int64(val)), nil
+	case int16:
+		return appendInt(buf, int64(val)), nil
+	case int32:
+		return appendInt(buf, int64(val)), nil
+	case int64:
+		return appendInt(buf, val), nil
+	case uint8:
+		return appendInt(buf, int64(val)), nil
+	case uint16:
+		return appendInt(buf, int64(val)), nil
+	case uint32:
+		return appendInt(buf, int64(val)), nil
+	case uint:
+		if uint64(val) > math.MaxInt64 {
+			return buf, fmt.Errorf("packstream: integer %d overflows int64", val)
+		}
+		return appendInt(buf, int64(val)), nil
+	case uint64:
+		if val > math.MaxInt64 {
+			return buf, fmt.Errorf("packstream: integer %d overflows int64", val)
+		}
+		return appendInt(buf, int64(val)), nil
+	case float32:
+		return appendFloat(buf, float64(val)), nil
+	case float64:
+		return appendFloat(buf, val), nil
+	case []byte:
+		buf, err := appendHeader(buf, len(val), 0xff, 0xcc)
+		if err != nil {
+			return buf, err
+		}
+		return append(buf, val...), nil
+	case string:
+		buf, err := appendHeader(buf, len(val), 0x80, 0xd0)
+		if err != nil {
+			return buf, err
+		}
+		return append(buf, val...), nil
+	case *Credentials:
+		buf, err := appendHeader(buf, len(val.Bytes()), 0x80, 0xd0)
+		if err != nil {
+			return buf, err
+		}
+		return append(buf, val.Bytes()...), nil
+	case []interface{}:
+		buf, err := appendHeader(buf, len(val), 0x90, 0xd4)
+		if err != nil {
+			return buf, err
+		}
+		for _, member := range val {
+			if buf, err = appendPack(buf, member); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case []string:
+		buf, err := appendHeader(buf, len(val), 0x90, 0xd4)
+		if err != nil {
+			return buf, err
+		}
+		for _, member := range val {
+			if buf, err = appendPack(buf, member); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf, err := appendHeader(buf, len(val), 0xa0, 0xd8)
+		if err != nil {
+			return buf, err
+		}
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if buf, err = appendPack(buf, key); err != nil {
+				return buf, err
+			}
+			if buf, err = appendPack(buf, val[key]); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case map[string]string:
+		m := make(map[string]interface{}, len(val))
+		for key, value := range val {
+			m[key] = value
+		}
+		return appendPack(buf, m)
+	case Structure:
+		if len(val.Fields) > 0xf {
+			return buf, fmt.Errorf("packstream: too many structure fields (%d)", len(val.Fields))
+		}
+		buf = append(buf, 0xb0+byte(len(val.Fields)), val.Tag)
+		var err error
+		for _, field := range val.Fields {
+			if buf, err = appendPack(buf, field); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case *Structure:
+		if val == nil {
+			return append(buf, 0xc0), nil
+		}
+		return appendPack(buf, *val)
+	}
+
+	return buf, fmt.Errorf("packstream: unsupported type %T", v)
+}
+
+func appendInt(buf []byte, i int64) []byte {
+	switch {
+	case -0x10 <= i && i < 0x80:
+		return append(buf, byte(i))
+	case math.MinInt8 <= i && i <= math.MaxInt8:
+		return append(buf, 0xc8, byte(i))
+	case math.MinInt16 <= i && i <= math.MaxInt16:
+		buf = append(buf, 0xc9, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(i))
+	case math.MinInt32 <= i && i <= math.MaxInt32:
+		buf = append(buf, 0xca, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(i))
+	default:
+		buf = append(buf, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(i))
+	}
+	return buf
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	buf = append(buf, 0xc1, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(f))
+	return buf
+}
+
+// Write the marker and size for a sized type. If tiny is 0xff, the type
+// has no tiny form (i.e. bytes). Otherwise sizes under 16 are packed into
+// the low nibble of the tiny marker. The sized marker is the 8-bit variant;
+// the 16 and 32-bit variants follow it.
+func appendHeader(buf []byte, size int, tiny, sized byte) ([]byte, error) {
+	switch {
+	case tiny != 0xff && size < 0x10:
+		return append(buf, tiny+byte(size)), nil
+	case size <= math.MaxUint8:
+		return append(buf, sized, byte(size)), nil
+	case size <= math.MaxUint16:
+		buf = append(buf, sized+1, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(size))
+		return buf, nil
+	case uint64(size) <= math.MaxUint32:
+		buf = append(buf, sized+2, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(size))
+		return buf, nil
+	}
+	return buf, fmt.Errorf("packstream: size %d too large", size)
+}
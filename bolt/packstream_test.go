@@ -0,0 +1,338 @@
+package bolt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestUnpackScalars(t *testing.T) {
+	type test struct {
+		buf          []byte
+		expected     interface{}
+		expectedSize int
+	}
+
+	tests := []test{
+		{[]byte{0xc0}, nil, 1},
+		{[]byte{0xc2}, false, 1},
+		{[]byte{0xc3}, true, 1},
+		{[]byte{0x2a}, 42, 1},
+		{[]byte{0xf0}, -16, 1},
+		{[]byte{0xff}, -1, 1},
+		{[]byte{0xc8, 0xbb}, -69, 2},
+		{[]byte{0xc9, 0xfa, 0xc7}, -1337, 3},
+		{[]byte{0xca, 0x6b, 0x4b, 0xb4, 0x40}, 1800123456, 5},
+		{[]byte{0xcb, 0x00, 0x00, 0x5a, 0xf3, 0x10, 0x7a, 0x3f, 0xff},
+			99999999999999, 9},
+		// 1.1
+		{[]byte{0xc1, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a},
+			1.1, 9},
+		// -1.5
+		{[]byte{0xc1, 0xbf, 0xf8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+			-1.5, 9},
+		{[]byte{0xcc, 0x03, 0x01, 0x02, 0x03}, []byte{0x01, 0x02, 0x03}, 5},
+		{[]byte{0xcd, 0x00, 0x01, 0xff}, []byte{0xff}, 4},
+		{[]byte{0x80}, "", 1},
+		{[]byte{0x84, 0x64, 0x61, 0x76, 0x65}, "dave", 5},
+		{[]byte{0xd0, 0x04, 0x64, 0x61, 0x76, 0x65}, "dave", 6},
+		{[]byte{0xd1, 0x00, 0x04, 0x64, 0x61, 0x76, 0x65}, "dave", 7},
+		{[]byte{0xd2, 0x00, 0x00, 0x00, 0x04, 0x64, 0x61, 0x76, 0x65},
+			"dave", 9},
+	}
+
+	for _, test := range tests {
+		val, n, err := Unpack(test.buf)
+		if err != nil {
+			t.Fatalf("failed test %#v: %s\n", test, err)
+		}
+		if !reflect.DeepEqual(val, test.expected) || n != test.expectedSize {
+			t.Fatalf("expected (%#v, %d), got (%#v, %d)\n",
+				test.expected, test.expectedSize, val, n)
+		}
+	}
+}
+
+func TestUnpackContainers(t *testing.T) {
+	// RUN "RETURN $x" {"x": 1.5} {"db": "neo4j", "tx_metadata": {}}
+	// with the params as an 8-bit sized map and a nested 8-bit list
+	msg := []byte{0xb3, 0x10,
+		0x89, 0x52, 0x45, 0x54, 0x55, 0x52, 0x4e, 0x20, 0x24, 0x78,
+		0xd8, 0x02,
+		0x81, 0x78,
+		0xc1, 0x3f, 0xf8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x81, 0x79,
+		0xd4, 0x02, 0x01, 0xcc, 0x01, 0x00,
+		0xa2,
+		0x82, 0x64, 0x62,
+		0x85, 0x6e, 0x65, 0x6f, 0x34, 0x6a,
+		0x8b, 0x74, 0x78, 0x5f, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61,
+		0xa0,
+	}
+
+	val, n, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) {
+		t.Fatalf("expected to consume %d bytes, got %d\n", len(msg), n)
+	}
+
+	expected := Structure{
+		Tag: 0x10,
+		Fields: []interface{}{
+			"RETURN $x",
+			map[string]interface{}{
+				"x": 1.5,
+				"y": []interface{}{1, []byte{0x00}},
+			},
+			map[string]interface{}{
+				"db":          "neo4j",
+				"tx_metadata": map[string]interface{}{},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, val) {
+		t.Fatalf("expected %#v, got %#v\n", expected, val)
+	}
+
+	// ParseMap should now happily handle the params map
+	params, _, err := ParseMap(msg[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["x"] != 1.5 {
+		t.Fatalf("expected x to be 1.5, got %#v\n", params["x"])
+	}
+}
+
+func TestUnpackMalformed(t *testing.T) {
+	tests := [][]byte{
+		{},
+		// invalid markers
+		{0xc4}, {0xd3}, {0xdf},
+		// truncated values
+		{0xc1, 0x3f, 0xf8},
+		{0xcb, 0x00, 0x00},
+		{0x85, 0x64, 0x61},
+		{0xd0},
+		{0xd2, 0xff, 0xff, 0xff, 0xff, 0x64},
+		{0xcc, 0x03, 0x01},
+		{0x93, 0x01, 0x02},
+		{0xd6, 0x7f, 0xff, 0xff, 0xff},
+		{0xa1, 0x81, 0x78},
+		{0xda, 0x7f, 0xff, 0xff, 0xff, 0x80, 0x80},
+		{0xb1},
+		{0xb2, 0x70, 0x01},
+		// non-string map key
+		{0xa1, 0x01, 0x02},
+	}
+
+	for _, test := range tests {
+		val, _, err := Unpack(test)
+		if err == nil {
+			t.Fatalf("expected error unpacking %#v, got %#v\n", test, val)
+		}
+	}
+
+	// the old panic-prone helpers should error, too
+	if _, _, err := ParseMap([]byte{0xa1, 0x81}); err == nil {
+		t.Fatal("expected ParseMap to fail on truncated map")
+	}
+	if _, _, err := ParseArray([]byte{}); err == nil {
+		t.Fatal("expected ParseArray to fail on empty input")
+	}
+	if _, _, err := ParseString([]byte{0x01}); err == nil {
+		t.Fatal("expected ParseString to fail on an int")
+	}
+	if _, err := ValidateMode([]byte{0x0, 0x3, 0xb1, 0x11, 0xa1, 0x0, 0x0}); err == nil {
+		t.Fatal("expected ValidateMode to fail on malformed BEGIN")
+	}
+}
+
+func TestUnpackDeepNesting(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x91}, depth), 0x01)
+	}
+
+	if _, _, err := Unpack(nested(MaxDepth)); err != nil {
+		t.Fatalf("expected %d nested lists to unpack, got %s\n", MaxDepth, err)
+	}
+	for _, buf := range [][]byte{nested(MaxDepth + 1), nested(1 << 20),
+		append(bytes.Repeat([]byte{0xb1, 0x4e}, 1<<20), 0x01),
+		append(bytes.Repeat([]byte{0xa1, 0x80}, 1<<20), 0x01)} {
+		if _, _, err := Unpack(buf); err == nil {
+			t.Fatalf("expected %d bytes of nesting to fail\n", len(buf))
+		}
+	}
+
+	// a HELLO is decoded, and logged, before anyone's authenticated
+	payload := append([]byte{0xb1, 0x01, 0xa1, 0x8a, 0x75, 0x73, 0x65, 0x72,
+		0x5f, 0x61, 0x67, 0x65, 0x6e, 0x74}, nested(1<<20)...)
+	msg := Chunker{}.Message(payload)
+	if err := (&Hello{}).Decode(msg); err == nil {
+		t.Fatal("expected a deeply nested HELLO to fail")
+	}
+	if out := Redact(msg.Data); !bytes.Equal(msg.Data[:4], out) {
+		t.Fatalf("expected only the header of a deeply nested HELLO, got %#v\n", out)
+	}
+}
+
+func TestUnpackBytesAreCopied(t *testing.T) {
+	buf := []byte{0xcc, 0x02, 0x01, 0x02}
+	val, _, err := Unpack(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[2] = 0xff
+	if !bytes.Equal([]byte{0x01, 0x02}, val.([]byte)) {
+		t.Fatalf("expected unpacked bytes to not alias input, got %#v\n", val)
+	}
+}
+
+func TestPackMarkers(t *testing.T) {
+	type test struct {
+		val      interface{}
+		expected []byte
+	}
+
+	tests := []test{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{-16, []byte{0xf0}},
+		{-17, []byte{0xc8, 0xef}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xc9, 0x00, 0x80}},
+		{-129, []byte{0xc9, 0xff, 0x7f}},
+		{int64(1800123456), []byte{0xca, 0x6b, 0x4b, 0xb4, 0x40}},
+		{uint32(0x80000000), []byte{0xcb, 0x0, 0x0, 0x0, 0x0, 0x80, 0x0, 0x0, 0x0}},
+		{1.1, []byte{0xc1, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{[]byte{}, []byte{0xcc, 0x00}},
+		{"dave", []byte{0x84, 0x64, 0x61, 0x76, 0x65}},
+		{[]string{"a"}, []byte{0x91, 0x81, 0x61}},
+		{map[string]string{"b": "", "a": ""}, []byte{0xa2, 0x81, 0x61, 0x80, 0x81, 0x62, 0x80}},
+		{Structure{Tag: 0x70, Fields: []interface{}{map[string]interface{}{}}},
+			[]byte{0xb1, 0x70, 0xa0}},
+	}
+
+	for _, test := range tests {
+		buf, err := Pack(test.val)
+		if err != nil {
+			t.Fatalf("failed to pack %#v: %s\n", test.val, err)
+		}
+		if !bytes.Equal(test.expected, buf) {
+			t.Fatalf("packing %#v: expected %#v, got %#v\n", test.val, test.expected, buf)
+		}
+	}
+}
+
+func TestPackSizedMarkers(t *testing.T) {
+	type test struct {
+		size   int
+		header []byte
+	}
+
+	tests := []test{
+		{16, []byte{0xd0, 0x10}},
+		{255, []byte{0xd0, 0xff}},
+		{256, []byte{0xd1, 0x01, 0x00}},
+		{65535, []byte{0xd1, 0xff, 0xff}},
+		{65536, []byte{0xd2, 0x00, 0x01, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		buf, err := Pack(string(bytes.Repeat([]byte{0x61}, test.size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(test.header, buf[:len(test.header)]) {
+			t.Fatalf("size %d: expected header %#v, got %#v\n",
+				test.size, test.header, buf[:len(test.header)])
+		}
+		if len(buf) != len(test.header)+test.size {
+			t.Fatalf("size %d: unexpected encoded length %d\n", test.size, len(buf))
+		}
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	big := make(map[string]interface{}, 300)
+	for i := 0; i < 300; i++ {
+		big[string(rune('A'+i%26))+string(rune('a'+i/26))] = i * -1000
+	}
+	list := make([]interface{}, 20)
+	for i := range list {
+		list[i] = float64(i) / 3
+	}
+
+	values := []interface{}{
+		nil,
+		true,
+		-9223372036854775808,
+		9223372036854775807,
+		-0.0,
+		[]byte{0x00, 0x01, 0x02},
+		"¯\\_(ツ)_/¯",
+		list,
+		big,
+		map[string]interface{}{
+			"nested": map[string]interface{}{
+				"list": []interface{}{nil, false, "x", []byte{0xff}},
+			},
+		},
+		Structure{Tag: 0x4e, Fields: []interface{}{
+			1, []interface{}{"Person"}, map[string]interface{}{"name": "Dave"},
+		}},
+	}
+
+	for _, value := range values {
+		buf, err := Pack(value)
+		if err != nil {
+			t.Fatalf("failed to pack %#v: %s\n", value, err)
+		}
+		out, n, err := Unpack(buf)
+		if err != nil {
+			t.Fatalf("failed to unpack %#v: %s\n", buf, err)
+		}
+		if n != len(buf) {
+			t.Fatalf("expected to consume %d bytes, got %d\n", len(buf), n)
+		}
+		if !reflect.DeepEqual(value, out) {
+			t.Fatalf("expected %#v, got %#v\n", value, out)
+		}
+	}
+}
+
+func TestPackIsDeterministic(t *testing.T) {
+	m := map[string]interface{}{}
+	for _, key := range []string{"z", "mode", "db", "bookmarks", "a"} {
+		m[key] = key
+	}
+
+	first, err := Pack(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		buf, err := Pack(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, buf) {
+			t.Fatalf("expected %#v, got %#v\n", first, buf)
+		}
+	}
+}
+
+func TestPackUnsupported(t *testing.T) {
+	if _, err := Pack(struct{}{}); err == nil {
+		t.Fatal("expected error packing a struct{}")
+	}
+	if _, err := Pack(uint64(1 << 63)); err == nil {
+		t.Fatal("expected error packing an overflowing uint64")
+	}
+	if _, err := Pack(Structure{Fields: make([]interface{}, 16)}); err == nil {
+		t.Fatal("expected error packing a structure with 16 fields")
+	}
+}
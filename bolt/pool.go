@@ -0,0 +1,155 @@
+package bolt
+
+import (
+	"io"
+	"sync"
+)
+
+// Size classes for pooled buffers. Anything bigger comes and goes with the
+// garbage collector.
+var bufferClasses = [...]int{512, 4 * 1024, 32 * 1024, 256 * 1024}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+// How much a connReader borrows to read into
+const readBufferSize = 32 * 1024
+
+// Borrow a buffer of length size, with the capacity of its size class
+func getBuffer(size int) []byte {
+	for i, class := range bufferClasses {
+		if size <= class {
+			if buf, ok := bufferPools[i].Get().(*[]byte); ok {
+				return (*buf)[:size]
+			}
+			return make([]byte, size, class)
+		}
+	}
+	return make([]byte, size)
+}
+
+// Scrub a buffer (up to its length, so that must cover everything that
+// was written to it) and hand it back to its pool, if it belongs in one.
+// It must not be used afterwards.
+func putBuffer(buf []byte) {
+	scrub(buf)
+	for i, class := range bufferClasses {
+		if cap(buf) == class {
+			buf = buf[:class]
+			bufferPools[i].Put(&buf)
+			return
+		}
+	}
+}
+
+// Grow buf, if needed, to fit n more bytes, moving to a buffer of a larger
+// size class and handing back the old one.
+func growBuffer(buf []byte, n int) []byte {
+	if len(buf)+n <= cap(buf) {
+		return buf
+	}
+	bigger := getBuffer(2*cap(buf) + n)[:len(buf)]
+	copy(bigger, buf)
+	putBuffer(buf)
+	return bigger
+}
+
+// A buffered reader like bufio.Reader, except it can hand its buffer back
+// to our pools whenever it has no unread bytes, and only borrows one once
+// there's data to put in it. So waiting on an idle conn ties up next to
+// nothing.
+//
+// Not safe for concurrent use.
+type connReader struct {
+	rd   io.Reader
+	buf  []byte
+	r, w int
+	// how much of buf we've ever used, i.e. what needs scrubbing
+	used int
+	// an error from rd we'll report once we've handed out what came with it
+	err error
+}
+
+func newConnReader(rd io.Reader) *connReader {
+	return &connReader{rd: rd}
+}
+
+// Read more from rd. Without a buffer, we wait for data with a tiny read
+// and borrow one once there's something to put in it.
+func (c *connReader) fill() error {
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return err
+	}
+
+	if c.buf == nil {
+		var first [16]byte
+		n, err := c.rd.Read(first[:])
+		if n == 0 {
+			return err
+		}
+		c.buf = getBuffer(readBufferSize)
+		c.r, c.w = 0, copy(c.buf, first[:n])
+		c.used = c.w
+		scrub(first[:n])
+		c.err = err
+		return nil
+	}
+
+	if c.r > 0 {
+		copy(c.buf, c.buf[c.r:c.w])
+		c.w = c.w - c.r
+		c.r = 0
+	}
+	n, err := c.rd.Read(c.buf[c.w:])
+	c.w = c.w + n
+	if c.w > c.used {
+		c.used = c.w
+	}
+	if n == 0 {
+		return err
+	}
+	c.err = err
+	return nil
+}
+
+func (c *connReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.r == c.w {
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf[c.r:c.w])
+	c.Discard(n)
+	return n, nil
+}
+
+// Return the next n bytes without consuming them. n must be small.
+func (c *connReader) Peek(n int) ([]byte, error) {
+	for c.w-c.r < n {
+		if err := c.fill(); err != nil {
+			return c.buf[c.r:c.w], err
+		}
+	}
+	return c.buf[c.r : c.r+n], nil
+}
+
+func (c *connReader) Buffered() int {
+	return c.w - c.r
+}
+
+func (c *connReader) Discard(n int) {
+	c.r = c.r + n
+}
+
+// Hand back our buffer if it's empty, e.g. before waiting on more data
+func (c *connReader) release() {
+	if c.buf != nil && c.r == c.w {
+		putBuffer(c.buf[:c.used])
+		c.buf = nil
+		c.r, c.w, c.used = 0, 0, 0
+	}
+}
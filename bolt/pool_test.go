@@ -0,0 +1,144 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestBufferClasses(t *testing.T) {
+	for _, size := range []int{0, 1, 512, 513, 32 * 1024, 256 * 1024} {
+		buf := getBuffer(size)
+		if len(buf) != size || cap(buf) < size {
+			t.Fatalf("expected a buffer of %d, got len %d, cap %d\n", size, len(buf), cap(buf))
+		}
+		putBuffer(buf)
+	}
+
+	// handed back buffers get scrubbed
+	buf := getBuffer(4)
+	copy(buf, "neo4j")
+	putBuffer(buf)
+	if !bytes.Equal(buf[:4], []byte{0, 0, 0, 0}) {
+		t.Fatalf("expected a scrubbed buffer, got %#v\n", buf[:4])
+	}
+
+	// growing moves up through the size classes, keeping what we had
+	buf = append(getBuffer(0), "bolt"...)
+	buf = growBuffer(buf, 1000)
+	if cap(buf) != 4*1024 || string(buf) != "bolt" {
+		t.Fatalf("expected a 4kb buffer starting with bolt, got cap %d: %q\n", cap(buf), buf)
+	}
+	putBuffer(buf)
+}
+
+func TestMessageRelease(t *testing.T) {
+	data := []byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x1, 0x0, 0x0}
+	conn := NewDirectConn(NewTestBuffer(append([]byte{}, data...)))
+
+	msg, err := readMessage(t, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.pooled || !bytes.Equal(data, msg.Data) {
+		t.Fatalf("expected a pooled copy of the RECORD, got %#v\n", msg)
+	}
+	msg.Release()
+	if msg.Data != nil {
+		t.Fatal("expected Data to be gone after Release")
+	}
+
+	// Messages we build ourselves are only scrubbed
+	success := NewSuccess()
+	data = success.Data
+	success.Release()
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatalf("expected scrubbed data, got %#v\n", data)
+	}
+}
+
+func TestConnReader(t *testing.T) {
+	stream := []byte("hello bolt")
+	r := newConnReader(FragmentedBuffer{bytes.NewBuffer(stream), nil, 3})
+
+	head, err := r.Peek(2)
+	if err != nil || string(head) != "he" {
+		t.Fatalf("expected to peek at he, got %q (%v)\n", head, err)
+	}
+	if r.buf == nil {
+		t.Fatal("expected a borrowed buffer once we have data")
+	}
+
+	rest := make([]byte, len(stream))
+	if _, err = io.ReadFull(r, rest); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stream, rest) {
+		t.Fatalf("expected %q, got %q\n", stream, rest)
+	}
+	r.release()
+	if r.buf != nil || r.Buffered() != 0 {
+		t.Fatal("expected the buffer handed back once drained")
+	}
+	if _, err = r.Peek(1); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v\n", err)
+	}
+}
+
+// Heap in use after a collection
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// Memory held by idle connections that have each already read a message,
+// like a client's conns to each cluster member between transactions.
+// Doesn't count their go routines' stacks.
+func BenchmarkIdleConnMemory(b *testing.B) {
+	record := []byte{0x0, 0x4, 0xb1, 0x71, 0x91, 0x1, 0x0, 0x0}
+	frame := &bytes.Buffer{}
+	if err := ws.WriteFrame(frame, ws.MaskFrame(ws.NewBinaryFrame(record))); err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name    string
+		connect func(PipeBuffer) BoltConn
+		first   []byte
+	}{
+		{"DirectConn", func(p PipeBuffer) BoltConn { return NewDirectConn(p) }, record},
+		{"WsConn", func(p PipeBuffer) BoltConn { return NewWsConn(p) }, frame.Bytes()},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			conns := make([]BoltConn, 0, b.N)
+			before := heapInUse()
+
+			for i := 0; i < b.N; i++ {
+				pipe := NewPipeBuffer()
+				conn := bm.connect(pipe)
+				go pipe.w.Write(bm.first)
+				msg, err := conn.ReadMessage(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				msg.Release()
+				conns = append(conns, conn)
+			}
+
+			b.StopTimer()
+			after := heapInUse()
+			b.ReportMetric(float64(int64(after)-int64(before))/float64(b.N), "heap-bytes/conn")
+			for _, conn := range conns {
+				conn.Close()
+			}
+		})
+	}
+}
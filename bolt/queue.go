@@ -0,0 +1,228 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Returned by ReadMessage once a BoltConn has been closed
+var ErrClosed = errors.New("bolt connection closed")
+
+// Returned by ReadMessage once the peer sent a message bigger than we allow
+var ErrMessageTooLarge = errors.New("bolt message too large")
+
+// The biggest message a BoltConn reads unless told otherwise
+const DefaultMaxMessageSize = 64 * 1024 * 1024
+
+// Messages read by a BoltConn's reading go routine, waiting to be picked
+// up by ReadMessage.
+//
+// Reading in the background is what lets ReadMessage give up on a context
+// or deadline without losing its place in the stream. Whatever message we
+// were in the middle of reading simply waits for the next caller.
+//
+// How far we read ahead is bounded by a Budget, charged for each queued
+// message until it's picked up.
+type messageQueue struct {
+	msgs   chan queued
+	closed chan struct{}
+	once   sync.Once
+
+	lock     sync.Mutex
+	err      error
+	deadline time.Time
+	budget   *Budget
+	// the most bytes a message may take, or 0 for no limit
+	limit int
+}
+
+// A Message along with the Budget it was charged to
+type queued struct {
+	msg    *Message
+	budget *Budget
+}
+
+// The most messages we'll queue, no matter how small
+const maxQueued = 32
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{
+		msgs:   make(chan queued, maxQueued),
+		closed: make(chan struct{}),
+		budget: NewBudget(DefaultReadAhead, nil),
+		limit:  DefaultMaxMessageSize,
+	}
+}
+
+// Fill the queue using read until it fails or the queue is closed. Meant
+// to be run as a go routine.
+func (q *messageQueue) fill(read func() (*Message, error)) {
+	defer close(q.msgs)
+
+	for {
+		msg, err := read()
+		if err != nil {
+			q.fail(err)
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		budget := q.getBudget()
+		size := int64(len(msg.Data))
+		if err = budget.acquire(size, q.closed); err != nil {
+			return
+		}
+		select {
+		case q.msgs <- queued{msg, budget}:
+		case <-q.closed:
+			budget.release(size)
+			return
+		}
+
+		// we may have raced with close() draining the queue
+		select {
+		case <-q.closed:
+			q.drain()
+			return
+		default:
+		}
+	}
+}
+
+// Release what's left in the queue back to its Budgets
+func (q *messageQueue) drain() {
+	for {
+		select {
+		case e, ok := <-q.msgs:
+			if !ok {
+				return
+			}
+			e.budget.release(int64(len(e.msg.Data)))
+		default:
+			return
+		}
+	}
+}
+
+// Record why we stopped reading, keeping the first reason
+func (q *messageQueue) fail(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *messageQueue) Err() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.err
+}
+
+func (q *messageQueue) getBudget() *Budget {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.budget
+}
+
+// Charge future reads to the given Budget. Messages already queued stay
+// charged to the old one.
+func (q *messageQueue) setBudget(b *Budget) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.budget = b
+}
+
+func (q *messageQueue) getLimit() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.limit
+}
+
+// Limit messages read from now on to size bytes, or none if 0
+func (q *messageQueue) setLimit(size int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limit = size
+}
+
+func (q *messageQueue) setDeadline(t time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.deadline = t
+}
+
+// Wait for the next Message until ctx is done or our deadline passes. A
+// Message that's already waiting is returned regardless, so a done ctx
+// can be used to poll.
+func (q *messageQueue) next(ctx context.Context) (*Message, error) {
+	select {
+	case e, ok := <-q.msgs:
+		return q.take(e, ok)
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	deadline := q.deadline
+	q.lock.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case e, ok := <-q.msgs:
+		return q.take(e, ok)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// Hand out a Message we've received from the queue, releasing its bytes
+// back to its Budget
+func (q *messageQueue) take(e queued, ok bool) (*Message, error) {
+	if !ok {
+		return nil, q.Err()
+	}
+	e.budget.release(int64(len(e.msg.Data)))
+	return e.msg, nil
+}
+
+// Stop handing out messages, unblocking our go routine if it's waiting
+// on a reader
+func (q *messageQueue) close() {
+	q.once.Do(func() {
+		q.fail(ErrClosed)
+		close(q.closed)
+		q.drain()
+	})
+}
+
+// Apply a write deadline to a conn, if it supports them
+func setWriteDeadline(conn interface{}, t time.Time) error {
+	if c, ok := conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return c.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// Apply a read deadline to a conn, if it supports them
+func setReadDeadline(conn interface{}, t time.Time) error {
+	if c, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return c.SetReadDeadline(t)
+	}
+	return nil
+}
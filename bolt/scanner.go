@@ -0,0 +1,437 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The kind of PackStream value found by a Scanner
+type Kind string
+
+const (
+	NullKind   Kind = "NULL"
+	BoolKind        = "BOOLEAN"
+	IntKind         = "INTEGER"
+	FloatKind       = "FLOAT"
+	BytesKind       = "BYTES"
+	StringKind      = "STRING"
+	ListKind        = "LIST"
+	MapKind         = "MAP"
+	StructKind      = "STRUCTURE"
+)
+
+// Returned by Scanner.Lookup when a key, index, or field isn't present
+var ErrNotFound = errors.New("packstream: key not found")
+
+// A Scanner walks PackStream tokens in place without materializing them,
+// making it cheap to pluck a value or two out of a message on the hot path.
+//
+// Read* methods consume the value at the current position. Container reads
+// (ReadMap, ReadList, ReadStruct) only consume the header, leaving the
+// scanner at the first member. Nothing is allocated unless a method says
+// otherwise; byte slices returned alias the underlying buffer.
+//
+// A Scanner is a small value type, so copying it is a cheap way to
+// bookmark a position.
+type Scanner struct {
+	buf []byte
+	pos int
+}
+
+func NewScanner(buf []byte) Scanner {
+	return Scanner{buf: buf}
+}
+
+// Position a Scanner at the start of a Message's structure. Single-chunk
+// messages (the common case) are scanned in place; messages spanning
+// multiple chunks get dechunked into a new buffer first.
+func ScanMessage(msg *Message) (Scanner, error) {
+	data := msg.Data
+	if len(data) < 2 {
+		return Scanner{}, errShortBuffer
+	}
+
+	size := int(binary.BigEndian.Uint16(data[:2]))
+	if size+2 == len(data) || (size+4 == len(data) && data[size+2] == 0 && data[size+3] == 0) {
+		return Scanner{buf: data[2 : 2+size]}, nil
+	}
+
+	payload, err := dechunk(data)
+	if err != nil {
+		return Scanner{}, err
+	}
+	return Scanner{buf: payload}, nil
+}
+
+// Current offset into the buffer
+func (s *Scanner) Pos() int {
+	return s.pos
+}
+
+// Read the marker at the current position, returning the Kind, the size
+// (value for tiny ints, length for bytes/strings, member count for
+// containers), and the length of the header itself.
+func (s *Scanner) header() (Kind, int, int, error) {
+	buf := s.buf[s.pos:]
+	if len(buf) < 1 {
+		return "", 0, 0, errShortBuffer
+	}
+
+	marker := buf[0]
+	switch {
+	case marker < 0x80 || marker >= 0xf0:
+		return IntKind, 0, 1, nil
+	case marker>>4 == 0x8:
+		return StringKind, int(marker & 0xf), 1, nil
+	case marker>>4 == 0x9:
+		return ListKind, int(marker & 0xf), 1, nil
+	case marker>>4 == 0xa:
+		return MapKind, int(marker & 0xf), 1, nil
+	case marker>>4 == 0xb:
+		if len(buf) < 2 {
+			return "", 0, 0, errShortBuffer
+		}
+		return StructKind, int(marker & 0xf), 2, nil
+	}
+
+	var kind Kind
+	switch marker {
+	case 0xc0:
+		return NullKind, 0, 1, nil
+	case 0xc1:
+		return FloatKind, 8, 1, nil
+	case 0xc2, 0xc3:
+		return BoolKind, 0, 1, nil
+	case 0xc8, 0xc9, 0xca, 0xcb:
+		return IntKind, 1 << (marker - 0xc8), 1, nil
+	case 0xcc, 0xcd, 0xce:
+		kind = BytesKind
+	case 0xd0, 0xd1, 0xd2:
+		kind = StringKind
+	case 0xd4, 0xd5, 0xd6:
+		kind = ListKind
+	case 0xd8, 0xd9, 0xda:
+		kind = MapKind
+	default:
+		return "", 0, 0, fmt.Errorf("packstream: invalid marker %#x", marker)
+	}
+
+	size, n, err := unpackSize(buf, marker&0x3)
+	return kind, size, n, err
+}
+
+// The Kind of the value at the current position
+func (s *Scanner) Peek() (Kind, error) {
+	kind, _, _, err := s.header()
+	return kind, err
+}
+
+// Skip over the entire value at the current position, including any
+// nested members.
+func (s *Scanner) Skip() error {
+	for remaining := 1; remaining > 0; remaining-- {
+		kind, size, n, err := s.header()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case IntKind, FloatKind, BytesKind, StringKind:
+			// size is the payload length for everything but tiny ints,
+			// which have a size of 0
+			if len(s.buf)-s.pos-n < size {
+				return errShortBuffer
+			}
+			s.pos = s.pos + n + size
+		case ListKind, StructKind:
+			remaining = remaining + size
+			s.pos = s.pos + n
+		case MapKind:
+			remaining = remaining + 2*size
+			s.pos = s.pos + n
+		default:
+			s.pos = s.pos + n
+		}
+	}
+	return nil
+}
+
+func (s *Scanner) expect(want Kind) (int, int, error) {
+	kind, size, n, err := s.header()
+	if err != nil {
+		return 0, 0, err
+	}
+	if kind != want {
+		return 0, 0, fmt.Errorf("packstream: expected %s, found %s", want, kind)
+	}
+	return size, n, nil
+}
+
+func (s *Scanner) ReadNull() error {
+	_, n, err := s.expect(NullKind)
+	s.pos = s.pos + n
+	return err
+}
+
+func (s *Scanner) ReadBool() (bool, error) {
+	_, n, err := s.expect(BoolKind)
+	if err != nil {
+		return false, err
+	}
+	b := s.buf[s.pos] == 0xc3
+	s.pos = s.pos + n
+	return b, nil
+}
+
+func (s *Scanner) ReadInt() (int, error) {
+	size, n, err := s.expect(IntKind)
+	if err != nil {
+		return 0, err
+	}
+	buf := s.buf[s.pos+n:]
+	if len(buf) < size {
+		return 0, errShortBuffer
+	}
+
+	var i int
+	switch size {
+	case 0:
+		i = int(int8(s.buf[s.pos]))
+	case 1:
+		i = int(int8(buf[0]))
+	case 2:
+		i = int(int16(binary.BigEndian.Uint16(buf)))
+	case 4:
+		i = int(int32(binary.BigEndian.Uint32(buf)))
+	case 8:
+		i = int(int64(binary.BigEndian.Uint64(buf)))
+	}
+	s.pos = s.pos + n + size
+	return i, nil
+}
+
+func (s *Scanner) ReadFloat() (float64, error) {
+	size, n, err := s.expect(FloatKind)
+	if err != nil {
+		return 0, err
+	}
+	buf := s.buf[s.pos+n:]
+	if len(buf) < size {
+		return 0, errShortBuffer
+	}
+	s.pos = s.pos + n + size
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+}
+
+func (s *Scanner) readSized(kind Kind) ([]byte, error) {
+	size, n, err := s.expect(kind)
+	if err != nil {
+		return nil, err
+	}
+	start := s.pos + n
+	if len(s.buf)-start < size {
+		return nil, errShortBuffer
+	}
+	s.pos = start + size
+	return s.buf[start:s.pos], nil
+}
+
+// Read a bytes value, returning a slice aliasing the scanner's buffer
+func (s *Scanner) ReadBytes() ([]byte, error) {
+	return s.readSized(BytesKind)
+}
+
+// Read a string value's raw UTF-8 bytes, aliasing the scanner's buffer
+func (s *Scanner) ReadStringBytes() ([]byte, error) {
+	return s.readSized(StringKind)
+}
+
+// Read a string value. Unlike ReadStringBytes, this allocates a new string.
+func (s *Scanner) ReadString() (string, error) {
+	b, err := s.readSized(StringKind)
+	return string(b), err
+}
+
+// Consume a list header, returning the number of members
+func (s *Scanner) ReadList() (int, error) {
+	size, n, err := s.expect(ListKind)
+	s.pos = s.pos + n
+	return size, err
+}
+
+// Consume a map header, returning the number of key/value pairs
+func (s *Scanner) ReadMap() (int, error) {
+	size, n, err := s.expect(MapKind)
+	s.pos = s.pos + n
+	return size, err
+}
+
+// Consume a structure header, returning its tag and number of fields
+func (s *Scanner) ReadStruct() (byte, int, error) {
+	size, n, err := s.expect(StructKind)
+	if err != nil {
+		return 0, 0, err
+	}
+	tag := s.buf[s.pos+1]
+	s.pos = s.pos + n
+	return tag, size, nil
+}
+
+// Names for the fields of Bolt message structures so lookups can say
+// "metadata.db" instead of "2.db" for a RUN.
+func structFieldIndex(tag byte, name string) int {
+	switch tag {
+	case runTag:
+		switch name {
+		case "query":
+			return 0
+		case "params":
+			return 1
+		case "metadata":
+			return 2
+		}
+	case beginTag, successTag, failureTag:
+		if name == "metadata" {
+			return 0
+		}
+	case helloTag, pullTag, discardTag:
+		if name == "extra" {
+			return 0
+		}
+	case recordTag:
+		if name == "values" {
+			return 0
+		}
+	}
+	return -1
+}
+
+// Parse a path segment as a list or structure index
+func segmentIndex(seg string) int {
+	if len(seg) == 0 {
+		return -1
+	}
+	i := 0
+	for j := 0; j < len(seg); j++ {
+		if seg[j] < '0' || seg[j] > '9' {
+			return -1
+		}
+		i = i*10 + int(seg[j]-'0')
+	}
+	return i
+}
+
+// Move the scanner to the value found at the given dot-separated path,
+// starting from the value at the current position. Segments select map
+// keys, list indexes, or structure fields (by index, or by name for Bolt
+// messages, e.g. "metadata.db" on a RUN or BEGIN).
+//
+// Returns ErrNotFound if any segment is missing, in which case the
+// scanner's position is undefined.
+func (s *Scanner) Lookup(path string) error {
+	for len(path) > 0 {
+		seg := path
+		rest := ""
+		for i := 0; i < len(path); i++ {
+			if path[i] == '.' {
+				seg, rest = path[:i], path[i+1:]
+				break
+			}
+		}
+		path = rest
+
+		kind, size, n, err := s.header()
+		if err != nil {
+			return err
+		}
+
+		index := -1
+		switch kind {
+		case MapKind:
+			s.pos = s.pos + n
+			found := false
+			for i := 0; i < size; i++ {
+				key, err := s.ReadStringBytes()
+				if err != nil {
+					return err
+				}
+				if string(key) == seg {
+					found = true
+					break
+				}
+				if err = s.Skip(); err != nil {
+					return err
+				}
+			}
+			if !found {
+				return ErrNotFound
+			}
+			continue
+		case StructKind:
+			index = structFieldIndex(s.buf[s.pos+1], seg)
+			if index < 0 {
+				index = segmentIndex(seg)
+			}
+		case ListKind:
+			index = segmentIndex(seg)
+		default:
+			return ErrNotFound
+		}
+
+		if index < 0 || index >= size {
+			return ErrNotFound
+		}
+		s.pos = s.pos + n
+		for i := 0; i < index; i++ {
+			if err = s.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Pull the access mode and database name out of a BEGIN or RUN message
+// without decoding the rest of it. Missing (or null) values result in
+// WriteMode and an empty db name.
+func ScanTxMetadata(msg *Message) (Mode, string, error) {
+	start, err := ScanMessage(msg)
+	if err != nil {
+		return WriteMode, "", err
+	}
+
+	var mode Mode = WriteMode
+	s := start
+	err = s.Lookup("metadata.mode")
+	if err == nil {
+		if kind, _ := s.Peek(); kind != NullKind {
+			raw, err := s.ReadStringBytes()
+			if err != nil {
+				return WriteMode, "", err
+			}
+			if string(raw) == "r" {
+				mode = ReadMode
+			}
+		}
+	} else if err != ErrNotFound {
+		return WriteMode, "", err
+	}
+
+	db := ""
+	s = start
+	err = s.Lookup("metadata.db")
+	if err == nil {
+		if kind, _ := s.Peek(); kind != NullKind {
+			db, err = s.ReadString()
+			if err != nil {
+				return WriteMode, "", err
+			}
+		}
+	} else if err != ErrNotFound {
+		return WriteMode, "", err
+	}
+
+	return mode, db, nil
+}
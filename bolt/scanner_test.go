@@ -0,0 +1,283 @@
+package bolt
+
+import (
+	"testing"
+)
+
+// Build a RUN with a few nested params and full tx metadata, so lookups
+// have to skip over something realistic before finding the db name.
+func benchmarkRun(tb testing.TB) *Message {
+	run := Run{
+		Query: "MATCH (n) RETURN n LIMIT $x",
+		Params: map[string]interface{}{
+			"x": 25,
+			"y": []interface{}{1.5, "two", map[string]interface{}{"three": 3}},
+		},
+		Metadata: TxMetadata{
+			Bookmarks: []string{
+				"FB:kcwQ8gr+UHiQT5SzW9ZAgBpWKgGQ",
+				"FB:kcwQ8gr+UHiQT5SzW9ZAgBpWKgGR",
+			},
+			TxMetadata: map[string]interface{}{"app": "bench"},
+			Mode:       ReadMode,
+			DB:         "movies",
+		},
+	}
+	msg, err := run.Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return msg
+}
+
+func TestScannerLookup(t *testing.T) {
+	msg := benchmarkRun(t)
+
+	type test struct {
+		path     string
+		expected interface{}
+	}
+
+	tests := []test{
+		{"query", "MATCH (n) RETURN n LIMIT $x"},
+		{"0", "MATCH (n) RETURN n LIMIT $x"},
+		{"params.x", 25},
+		{"params.y.0", 1.5},
+		{"params.y.1", "two"},
+		{"params.y.2.three", 3},
+		{"metadata.db", "movies"},
+		{"metadata.mode", "r"},
+		{"metadata.bookmarks.1", "FB:kcwQ8gr+UHiQT5SzW9ZAgBpWKgGR"},
+		{"metadata.tx_metadata.app", "bench"},
+		{"2.tx_metadata.app", "bench"},
+	}
+
+	for _, test := range tests {
+		s, err := ScanMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Lookup(test.path); err != nil {
+			t.Fatalf("failed to find %s: %s\n", test.path, err)
+		}
+
+		var val interface{}
+		kind, _ := s.Peek()
+		switch kind {
+		case IntKind:
+			val, err = s.ReadInt()
+		case FloatKind:
+			val, err = s.ReadFloat()
+		case StringKind:
+			val, err = s.ReadString()
+		default:
+			t.Fatalf("unexpected kind %s at %s\n", kind, test.path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != test.expected {
+			t.Fatalf("%s: expected %#v, got %#v\n", test.path, test.expected, val)
+		}
+	}
+
+	for _, path := range []string{"metadata.nope", "params.y.3", "params.x.y", "5", "extra", "metadata.db.x"} {
+		s, _ := ScanMessage(msg)
+		if err := s.Lookup(path); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound for %s, got %v\n", path, err)
+		}
+	}
+}
+
+func TestScannerSkip(t *testing.T) {
+	values := []interface{}{
+		nil, true, -16, 1000, -9223372036854775808, 1.5, []byte{0x01},
+		"a string longer than sixteen bytes",
+		[]interface{}{1, []interface{}{2, 3}, map[string]interface{}{"a": nil}},
+		map[string]interface{}{"k": Structure{Tag: 0x4e, Fields: []interface{}{1, "x"}}},
+	}
+
+	buf := []byte{}
+	for _, val := range values {
+		packed, err := Pack(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, packed...)
+	}
+
+	s := NewScanner(buf)
+	for i := range values {
+		if err := s.Skip(); err != nil {
+			t.Fatalf("failed skipping value %d: %s\n", i, err)
+		}
+	}
+	if s.Pos() != len(buf) {
+		t.Fatalf("expected to be at %d, got %d\n", len(buf), s.Pos())
+	}
+	if err := s.Skip(); err == nil {
+		t.Fatal("expected an error skipping past the end")
+	}
+
+	// truncated containers shouldn't trip us up
+	for _, bad := range [][]byte{{0x92, 0x01}, {0xd0, 0x05, 0x61}, {0xb1}, {0xc4}} {
+		s = NewScanner(bad)
+		if err := s.Skip(); err == nil {
+			t.Fatalf("expected error skipping %#v\n", bad)
+		}
+	}
+}
+
+func TestScannerReads(t *testing.T) {
+	buf, err := Pack([]interface{}{nil, false, -1, 2.5, []byte{0x07}, "x", Structure{Tag: 0x70}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewScanner(buf)
+	if n, err := s.ReadList(); err != nil || n != 7 {
+		t.Fatalf("expected list of 7, got %d (%v)\n", n, err)
+	}
+	if err = s.ReadNull(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.ReadBool(); err != nil || b {
+		t.Fatalf("expected false, got %v (%v)\n", b, err)
+	}
+	if i, err := s.ReadInt(); err != nil || i != -1 {
+		t.Fatalf("expected -1, got %d (%v)\n", i, err)
+	}
+	if f, err := s.ReadFloat(); err != nil || f != 2.5 {
+		t.Fatalf("expected 2.5, got %f (%v)\n", f, err)
+	}
+	if b, err := s.ReadBytes(); err != nil || len(b) != 1 || b[0] != 0x07 {
+		t.Fatalf("expected [0x07], got %#v (%v)\n", b, err)
+	}
+	if _, err := s.ReadInt(); err == nil {
+		t.Fatal("expected error reading a string as an int")
+	}
+	if str, err := s.ReadString(); err != nil || str != "x" {
+		t.Fatalf("expected 'x', got %s (%v)\n", str, err)
+	}
+	if tag, n, err := s.ReadStruct(); err != nil || tag != 0x70 || n != 0 {
+		t.Fatalf("expected empty SUCCESS struct, got %#x, %d (%v)\n", tag, n, err)
+	}
+}
+
+func TestScanTxMetadata(t *testing.T) {
+	mode, db, err := ScanTxMetadata(benchmarkRun(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != ReadMode || db != "movies" {
+		t.Fatalf("expected (READ, movies), got (%s, %s)\n", mode, db)
+	}
+
+	// BEGIN {} and a Bolt v1 style RUN without metadata
+	begin, _ := (&Begin{}).Encode()
+	legacy := &Message{T: RunMsg, Data: []byte{0x0, 0x4, 0xb2, 0x10, 0x80, 0xa0, 0x0, 0x0}}
+	for _, msg := range []*Message{begin, legacy} {
+		mode, db, err = ScanTxMetadata(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != WriteMode || db != "" {
+			t.Fatalf("expected (WRITE, ''), got (%s, %s)\n", mode, db)
+		}
+	}
+
+	// a "db" that isn't a string is an error, not a panic
+	bad, _ := (&Begin{TxMetadata{Extra: map[string]interface{}{"db": 1}}}).Encode()
+	if _, _, err = ScanTxMetadata(bad); err == nil {
+		t.Fatal("expected error for non-string db")
+	}
+}
+
+func TestScannerDoesNotAllocate(t *testing.T) {
+	msg := benchmarkRun(t)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s, err := ScanMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Lookup("metadata.db"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.ReadStringBytes(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %f\n", allocs)
+	}
+}
+
+func BenchmarkScannerLookup(b *testing.B) {
+	msg := benchmarkRun(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s, _ := ScanMessage(msg)
+		if err := s.Lookup("metadata.db"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := s.ReadStringBytes(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanTxMetadata(b *testing.B) {
+	msg := benchmarkRun(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ScanTxMetadata(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The old approach from proxy.go: walk RUN fields with Parse* helpers
+func BenchmarkParseMapRun(b *testing.B) {
+	msg := benchmarkRun(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pos := 4
+		_, n, err := ParseString(msg.Data[pos:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		pos = pos + n
+		_, n, err = ParseMap(msg.Data[pos:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		pos = pos + n
+		m, _, err := ParseMap(msg.Data[pos:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, ok := m["db"].(string); !ok {
+			b.Fatal("expected to find db")
+		}
+	}
+}
+
+func BenchmarkDecodeRun(b *testing.B) {
+	msg := benchmarkRun(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		run := Run{}
+		if err := run.Decode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
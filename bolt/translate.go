@@ -0,0 +1,508 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HELLO keys and the version that introduced them, which older servers
+// don't get sent. The utc patch only ever existed in 4.3 & 4.4.
+var helloKeys = map[string]Version{
+	"patch_bolt":                        v4_3,
+	"notifications_minimum_severity":    v5_2,
+	"notifications_disabled_categories": v5_2,
+	"bolt_agent":                        v5_3,
+}
+
+// Notification filters in RUN and BEGIN only make the server quieter, so
+// older servers can do without them
+var notificationKeys = []string{
+	"notifications_minimum_severity",
+	"notifications_disabled_categories",
+}
+
+// Rewrites messages between the Bolt version a client speaks and an older
+// one a server speaks, e.g. PULL { n } into a Bolt 3 PULL_ALL. Things the
+// server can't honour, like selecting a database over Bolt 3, are errors
+// for the client to get as a FAILURE instead.
+type Translator struct {
+	Client, Server Version
+}
+
+// Returns true if there's anything to translate
+func (t Translator) Needed() bool {
+	return t.Client != t.Server
+}
+
+// The HELLO to send the server in place of the client's, without what it
+// wouldn't understand. The Credentials are shared, not copied.
+func (t Translator) Hello(h *Hello) *Hello {
+	hello := *h
+	if !t.Server.AtLeast(v4_1) {
+		hello.Routing = nil
+	}
+	hello.Extra = map[string]interface{}{}
+	for key, val := range h.Extra {
+		since, found := helloKeys[key]
+		if found && (!t.Server.AtLeast(since) ||
+			(key == "patch_bolt" && t.Server.AtLeast(v5_0))) {
+			continue
+		}
+		hello.Extra[key] = val
+	}
+	return &hello
+}
+
+// Rewrite a client's message for the server. A nil Message with no error
+// means the server has no use for it (e.g. TELEMETRY before Bolt 5.4) and
+// the client should just get a SUCCESS.
+func (t Translator) Request(msg *Message) (*Message, error) {
+	if !t.Needed() {
+		return msg, nil
+	}
+
+	switch msg.T {
+	case TelemetryMsg:
+		if !t.Server.AtLeast(v5_4) {
+			return nil, nil
+		}
+	case RunMsg:
+		run := &Run{}
+		if err := run.Decode(msg); err != nil {
+			return nil, err
+		}
+		if err := t.txMetadata(&run.Metadata); err != nil {
+			return nil, err
+		}
+		if !t.Server.AtLeast(v5_0) && t.Client.AtLeast(v5_0) {
+			params, err := downgradeValue(run.Params)
+			if err != nil {
+				return nil, err
+			}
+			run.Params = params.(map[string]interface{})
+		}
+		return run.Encode()
+	case BeginMsg:
+		begin := &Begin{}
+		if err := begin.Decode(msg); err != nil {
+			return nil, err
+		}
+		if err := t.txMetadata(&begin.TxMetadata); err != nil {
+			return nil, err
+		}
+		return begin.Encode()
+	case PullMsg, DiscardMsg:
+		if t.Server.AtLeast(v4_0) {
+			break
+		}
+		tag := pullTag
+		if msg.T == DiscardMsg {
+			tag = discardTag
+		}
+		_, qid, err := streamFields(msg, tag)
+		if err != nil {
+			return nil, err
+		}
+		if qid != -1 {
+			return nil, fmt.Errorf("backend speaks %s, which can't %s from query %d",
+				t.Server, msg.T, qid)
+		}
+		// PULL_ALL or DISCARD_ALL, so a PULL gets all the records,
+		// however many it asked for, and no has_more
+		return packMessage(msg.T, tag)
+	case RouteMsg:
+		return t.route(msg)
+	}
+	return msg, nil
+}
+
+// Drop or refuse what the server's version doesn't know about
+func (t Translator) txMetadata(meta *TxMetadata) error {
+	if meta.DB != "" && !t.Server.AtLeast(v4_0) {
+		return fmt.Errorf("backend speaks %s, which can't select database %q",
+			t.Server, meta.DB)
+	}
+	if user, found := meta.Extra["imp_user"]; found && user != nil && !t.Server.AtLeast(v4_4) {
+		return fmt.Errorf("backend speaks %s, which can't impersonate %v",
+			t.Server, user)
+	}
+	if !t.Server.AtLeast(v5_2) {
+		meta.Extra = extraFields(meta.Extra, notificationKeys...)
+	}
+	return nil
+}
+
+// ROUTE came with 4.3, taking a db name, which 4.4 turned into a map of
+// db and imp_user
+func (t Translator) route(msg *Message) (*Message, error) {
+	if !t.Server.AtLeast(v4_3) {
+		return nil, fmt.Errorf("backend speaks %s, which can't ROUTE", t.Server)
+	}
+	if t.Server.AtLeast(v4_4) || !t.Client.AtLeast(v4_4) {
+		return msg, nil
+	}
+
+	fields, err := unpackMessage(msg, routeTag, 3)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := mapField(fields, 2)
+	if err != nil {
+		return nil, err
+	}
+	if user, found := extra["imp_user"]; found && user != nil {
+		return nil, fmt.Errorf("backend speaks %s, which can't impersonate %v",
+			t.Server, user)
+	}
+	return packMessage(RouteMsg, routeTag, fields[0], fields[1], extra["db"])
+}
+
+// Rewrite a server's message for the client. Before Bolt 5.0, RECORDs
+// have no element ids and datetimes count seconds in local time, so for
+// newer clients we make up the former (the legacy id as a string, like
+// the drivers do) and convert the latter to UTC.
+func (t Translator) Response(msg *Message) (*Message, error) {
+	if msg.T != RecordMsg || t.Server.AtLeast(v5_0) || !t.Client.AtLeast(v5_0) {
+		return msg, nil
+	}
+
+	record := &Record{}
+	if err := record.Decode(msg); err != nil {
+		return nil, err
+	}
+	for i, val := range record.Values {
+		val, err := upgradeValue(val)
+		if err != nil {
+			return nil, err
+		}
+		record.Values[i] = val
+	}
+	return record.Encode()
+}
+
+// Walk an unpacked value, turning any pre-5.0 structures in it into their
+// 5.0 form
+func upgradeValue(val interface{}) (interface{}, error) {
+	var err error
+
+	switch v := val.(type) {
+	case []interface{}:
+		for i := range v {
+			if v[i], err = upgradeValue(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for key := range v {
+			if v[key], err = upgradeValue(v[key]); err != nil {
+				return nil, err
+			}
+		}
+	case Structure:
+		return upgradeStructure(v)
+	}
+	return val, nil
+}
+
+func upgradeStructure(s Structure) (Structure, error) {
+	r := fieldReader{s: s}
+
+	// properties can hold datetimes, too
+	switch s.Tag {
+	case NodeTag, RelationshipTag, UnboundRelationshipTag, PathTag:
+		for i := range s.Fields {
+			val, err := upgradeValue(s.Fields[i])
+			if err != nil {
+				return s, err
+			}
+			s.Fields[i] = val
+		}
+	}
+
+	switch s.Tag {
+	case NodeTag, UnboundRelationshipTag:
+		r.fields(3)
+		id := r.int(0)
+		if r.err != nil {
+			return s, r.err
+		}
+		s.Fields = append(s.Fields, strconv.Itoa(id))
+	case RelationshipTag:
+		r.fields(5)
+		id, start, end := r.int(0), r.int(1), r.int(2)
+		if r.err != nil {
+			return s, r.err
+		}
+		s.Fields = append(s.Fields, strconv.Itoa(id), strconv.Itoa(start),
+			strconv.Itoa(end))
+	case LegacyDateTimeTag:
+		r.fields(3)
+		seconds, nanos, offset := r.int(0), r.int(1), r.int(2)
+		if r.err != nil {
+			return s, r.err
+		}
+		s = Structure{Tag: DateTimeTag, Fields: []interface{}{
+			seconds - offset, nanos, offset}}
+	case LegacyDateTimeZoneTag:
+		r.fields(3)
+		legacy := DateTimeZoneId{Seconds: r.int(0), Nanoseconds: r.int(1),
+			TzId: r.string(2), Legacy: true}
+		if r.err != nil {
+			return s, r.err
+		}
+		when, err := legacy.Time()
+		if err != nil {
+			return s, fmt.Errorf("can't convert datetime in %s to UTC: %s",
+				legacy.TzId, err)
+		}
+		s = Structure{Tag: DateTimeZoneIdTag, Fields: []interface{}{
+			int(when.Unix()), legacy.Nanoseconds, legacy.TzId}}
+	}
+	return s, nil
+}
+
+// Walk an unpacked value, turning any 5.0 datetimes in it back into their
+// pre-5.0 form, counting seconds in local time
+func downgradeValue(val interface{}) (interface{}, error) {
+	var err error
+
+	switch v := val.(type) {
+	case []interface{}:
+		for i := range v {
+			if v[i], err = downgradeValue(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for key := range v {
+			if v[key], err = downgradeValue(v[key]); err != nil {
+				return nil, err
+			}
+		}
+	case Structure:
+		return downgradeStructure(v)
+	}
+	return val, nil
+}
+
+func downgradeStructure(s Structure) (Structure, error) {
+	r := fieldReader{s: s}
+
+	switch s.Tag {
+	case DateTimeTag:
+		r.fields(3)
+		seconds, nanos, offset := r.int(0), r.int(1), r.int(2)
+		if r.err != nil {
+			return s, r.err
+		}
+		s = Structure{Tag: LegacyDateTimeTag, Fields: []interface{}{
+			seconds + offset, nanos, offset}}
+	case DateTimeZoneIdTag:
+		r.fields(3)
+		utc := DateTimeZoneId{Seconds: r.int(0), Nanoseconds: r.int(1),
+			TzId: r.string(2)}
+		if r.err != nil {
+			return s, r.err
+		}
+		when, err := utc.Time()
+		if err != nil {
+			return s, fmt.Errorf("can't convert datetime in %s from UTC: %s",
+				utc.TzId, err)
+		}
+		_, offset := when.Zone()
+		s = Structure{Tag: LegacyDateTimeZoneTag, Fields: []interface{}{
+			utc.Seconds + offset, utc.Nanoseconds, utc.TzId}}
+	}
+	return s, nil
+}
+
+// What a request sent through a TranslatingConn gets in reply
+type reply struct {
+	// made up by us, if not nil
+	local *Message
+	// swallow everything the server sends for it
+	drop bool
+	// give the client IGNORED instead of whatever the server says
+	ignore bool
+}
+
+// A BoltConn to a server that speaks an older Bolt version than the client
+// whose messages it carries, translating them both ways. Replies we make
+// up ourselves (a FAILURE for something the server can't honour, say) are
+// handed out in order with the server's.
+//
+// Like a Bolt server, once it fails a message, it IGNOREs the rest until a
+// RESET. A TranslatingConn doesn't do forwarding, since every message it
+// reads might need rewriting.
+type TranslatingConn struct {
+	conn BoltConn
+	t    Translator
+	*translatingState
+}
+
+type translatingState struct {
+	sync.Mutex
+	pending []*reply
+	failed  bool
+	// interrupts a ReadMessage waiting on the server
+	wake context.CancelFunc
+}
+
+// Wrap a BoltConn speaking the server's version for a client speaking a
+// newer one
+func NewTranslatingConn(conn BoltConn, client, server Version) TranslatingConn {
+	return TranslatingConn{
+		conn:             conn,
+		t:                Translator{Client: client, Server: server},
+		translatingState: &translatingState{},
+	}
+}
+
+func (c TranslatingConn) String() string {
+	return fmt.Sprintf("Translating[%s->%s %s]", c.t.Client, c.t.Server, c.conn)
+}
+
+func (c TranslatingConn) ReadMessage(ctx context.Context) (*Message, error) {
+	for {
+		c.Lock()
+		if len(c.pending) > 0 && c.pending[0].local != nil {
+			msg := c.pending[0].local
+			c.pending = c.pending[1:]
+			c.Unlock()
+			return msg, nil
+		}
+		readCtx, wake := context.WithCancel(ctx)
+		c.wake = wake
+		c.Unlock()
+
+		msg, err := c.conn.ReadMessage(readCtx)
+		wake()
+		if err != nil {
+			if ctx.Err() == nil && readCtx.Err() != nil {
+				// woken up, there's a reply of ours to hand out
+				continue
+			}
+			return nil, err
+		}
+
+		// a keep-alive isn't a reply to anything
+		if msg.T == NopMsg {
+			return msg, nil
+		}
+
+		c.Lock()
+		var r *reply
+		if len(c.pending) > 0 {
+			r = c.pending[0]
+			if msg.T != RecordMsg {
+				c.pending = c.pending[1:]
+			}
+		}
+		if r != nil && (r.drop || r.ignore) {
+			c.Unlock()
+			msg.Release()
+			if msg.T == RecordMsg || r.drop {
+				continue
+			}
+			return NewIgnored(), nil
+		}
+
+		translated, err := c.t.Response(msg)
+		if err != nil {
+			// fail the stream, and everything after it
+			if r != nil {
+				r.drop = true
+			}
+			for _, rest := range c.pending {
+				if rest.local == nil {
+					rest.ignore = true
+				}
+			}
+			c.failed = true
+			c.Unlock()
+			msg.Release()
+			return NewFailure("Neo.ClientError.Request.Invalid", err.Error()), nil
+		}
+		c.Unlock()
+		if translated != msg {
+			msg.Release()
+		}
+		return translated, nil
+	}
+}
+
+func (c TranslatingConn) WriteMessage(msg *Message) error {
+	return c.WriteMessages([]*Message{msg})
+}
+
+// Translate the messages, keeping track of what each gets in reply, and
+// write what's left for the server
+func (c TranslatingConn) WriteMessages(messages []*Message) error {
+	out := make([]*Message, 0, len(messages))
+
+	c.Lock()
+	local := false
+	for _, msg := range messages {
+		// the server never answers these, so there's nothing to track
+		if msg.T == NopMsg || msg.T == GoodbyeMsg {
+			out = append(out, msg)
+			continue
+		}
+		if msg.T == ResetMsg {
+			c.failed = false
+		}
+		if c.failed {
+			c.pending = append(c.pending, &reply{local: NewIgnored()})
+			local = true
+			continue
+		}
+
+		translated, err := c.t.Request(msg)
+		switch {
+		case err != nil:
+			c.pending = append(c.pending, &reply{
+				local: NewFailure("Neo.ClientError.Request.Invalid", err.Error())})
+			c.failed = true
+			local = true
+		case translated == nil:
+			success := NewSuccess()
+			c.pending = append(c.pending, &reply{local: success})
+			local = true
+		default:
+			c.pending = append(c.pending, &reply{})
+			out = append(out, translated)
+		}
+	}
+	if local && c.wake != nil {
+		c.wake()
+	}
+	c.Unlock()
+
+	if len(out) == 0 {
+		return nil
+	}
+	return c.conn.WriteMessages(out)
+}
+
+func (c TranslatingConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c TranslatingConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c TranslatingConn) SetBudget(b *Budget) {
+	c.conn.SetBudget(b)
+}
+
+func (c TranslatingConn) Err() error {
+	return c.conn.Err()
+}
+
+func (c TranslatingConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,332 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTranslateRequests(t *testing.T) {
+	bolt3 := Translator{Client: Version{4, 4}, Server: Version{3, 0}}
+
+	// PULL { n } and DISCARD { n } become PULL_ALL and DISCARD_ALL
+	for _, typed := range []TypedMessage{&Pull{N: 1000, Qid: -1}, &Discard{N: 10, Qid: -1}} {
+		msg, _ := typed.Encode()
+		out, err := bolt3.Request(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []byte{0x00, 0x02, 0xb0, msg.Data[3], 0x00, 0x00}
+		if !bytes.Equal(expected, out.Data) {
+			t.Fatalf("expected %#v, got %#v\n", expected, out.Data)
+		}
+	}
+
+	// what Bolt 3 can't do is an error
+	pull, _ := (&Pull{N: -1, Qid: 2}).Encode()
+	run, _ := (&Run{Query: "RETURN 1", Metadata: TxMetadata{DB: "movies"}}).Encode()
+	route, _ := packMessage(RouteMsg, routeTag, map[string]interface{}{},
+		[]interface{}{}, map[string]interface{}{})
+	for _, msg := range []*Message{pull, run, route} {
+		if _, err := bolt3.Request(msg); err == nil {
+			t.Fatalf("expected %s to fail for Bolt 3\n", msg.T)
+		}
+	}
+
+	// impersonation needs 4.4, notification filters get dropped
+	begin, _ := (&Begin{TxMetadata{Extra: map[string]interface{}{
+		"imp_user": "bob", "notifications_minimum_severity": "OFF"}}}).Encode()
+	if _, err := (Translator{Client: Version{5, 4}, Server: Version{4, 2}}).Request(begin); err == nil {
+		t.Fatal("expected impersonation to fail for 4.2")
+	}
+	out, err := (Translator{Client: Version{5, 4}, Server: Version{4, 4}}).Request(begin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	translated := &Begin{}
+	if err = translated.Decode(out); err != nil {
+		t.Fatal(err)
+	}
+	if translated.Extra["imp_user"] != "bob" || translated.Extra["notifications_minimum_severity"] != nil {
+		t.Fatalf("unexpected BEGIN %#v\n", translated)
+	}
+
+	// TELEMETRY only gets a SUCCESS from us before 5.4
+	telemetry := &Message{T: TelemetryMsg, Data: []byte{0x00, 0x03, 0xb1, 0x54, 0x01, 0x00, 0x00}}
+	if out, err = (Translator{Client: Version{5, 4}, Server: Version{5, 3}}).Request(telemetry); out != nil || err != nil {
+		t.Fatalf("expected no TELEMETRY for 5.3, got %#v (%v)\n", out, err)
+	}
+
+	// 4.4 ROUTE { extra } to 4.3 ROUTE db
+	route, _ = packMessage(RouteMsg, routeTag, map[string]interface{}{},
+		[]interface{}{}, map[string]interface{}{"db": "movies"})
+	out, err = (Translator{Client: Version{4, 4}, Server: Version{4, 3}}).Request(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := unpackMessage(out, routeTag, 3)
+	if err != nil || fields[2] != "movies" {
+		t.Fatalf("expected a 4.3 ROUTE for movies, got %#v (%v)\n", fields, err)
+	}
+}
+
+func TestTranslateHello(t *testing.T) {
+	hello := &Hello{UserAgent: "test", Routing: map[string]interface{}{"address": "localhost:7687"},
+		Extra: map[string]interface{}{"patch_bolt": []interface{}{"utc"},
+			"bolt_agent": map[string]interface{}{"product": "test"}}}
+
+	bolt3 := (Translator{Client: Version{5, 4}, Server: Version{3, 0}}).Hello(hello)
+	if bolt3.Routing != nil || len(bolt3.Extra) != 0 || bolt3.UserAgent != "test" {
+		t.Fatalf("expected a bare HELLO for Bolt 3, got %#v\n", bolt3)
+	}
+	v44 := (Translator{Client: Version{5, 4}, Server: Version{4, 4}}).Hello(hello)
+	if v44.Routing == nil || v44.Extra["patch_bolt"] == nil || v44.Extra["bolt_agent"] != nil {
+		t.Fatalf("expected routing and patch_bolt for 4.4, got %#v\n", v44)
+	}
+	if len(hello.Extra) != 2 {
+		t.Fatal("expected the client's HELLO left alone")
+	}
+}
+
+func TestTranslateRecords(t *testing.T) {
+	stockholm := Structure{Tag: LegacyDateTimeZoneTag, Fields: []interface{}{
+		1700000000 + 3600, 0, "Europe/Stockholm"}}
+	props := map[string]interface{}{"born": Structure{Tag: LegacyDateTimeTag,
+		Fields: []interface{}{1700000000 + 3600, 5, 3600}}}
+	node := Structure{Tag: NodeTag, Fields: []interface{}{7, []interface{}{"Person"}, props}}
+	rel := Structure{Tag: RelationshipTag, Fields: []interface{}{
+		9, 7, 8, "KNOWS", map[string]interface{}{}}}
+	record, _ := (&Record{Values: []interface{}{node, rel, stockholm}}).Encode()
+
+	out, err := (Translator{Client: Version{5, 0}, Server: Version{4, 4}}).Response(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	translated := &Record{}
+	if err = translated.Decode(out); err != nil {
+		t.Fatal(err)
+	}
+	values, err := DecodeValue(translated.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := values.([]interface{})[0].(Node)
+	born := n.Properties["born"].(DateTime)
+	if n.ElementId != "7" || born.Legacy || born.Time().Unix() != 1700000000 {
+		t.Fatalf("unexpected node %#v\n", n)
+	}
+	r := values.([]interface{})[1].(Relationship)
+	if r.ElementId != "9" || r.StartNodeElementId != "7" || r.EndNodeElementId != "8" {
+		t.Fatalf("unexpected relationship %#v\n", r)
+	}
+	when := values.([]interface{})[2].(DateTimeZoneId)
+	if when.Legacy || when.Seconds != 1700000000 {
+		t.Fatalf("expected 1700000000 UTC, got %#v\n", when)
+	}
+
+	// nothing to do for a 4.x client
+	if out, _ = (Translator{Client: Version{4, 4}, Server: Version{4, 0}}).Response(record); out != record {
+		t.Fatal("expected the RECORD untouched")
+	}
+
+	// zones we can't look up can't be converted
+	stockholm.Fields[2] = "Nowhere/Special"
+	record, _ = (&Record{Values: []interface{}{stockholm}}).Encode()
+	if _, err = (Translator{Client: Version{5, 0}, Server: Version{4, 4}}).Response(record); err == nil {
+		t.Fatal("expected an unknown timezone to fail")
+	}
+}
+
+func TestTranslateParams(t *testing.T) {
+	params := map[string]interface{}{
+		"when": Structure{Tag: DateTimeTag, Fields: []interface{}{1700000000, 5, 3600}},
+		"where": []interface{}{Structure{Tag: DateTimeZoneIdTag, Fields: []interface{}{
+			1700000000, 0, "Europe/Stockholm"}}},
+	}
+	run, _ := (&Run{Query: "RETURN $when, $where", Params: params}).Encode()
+
+	out, err := (Translator{Client: Version{5, 0}, Server: Version{4, 4}}).Request(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	translated := &Run{}
+	if err = translated.Decode(out); err != nil {
+		t.Fatal(err)
+	}
+	values, err := DecodeValue(translated.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	when := values.(map[string]interface{})["when"].(DateTime)
+	if !when.Legacy || when.Seconds != 1700000000+3600 || when.Time().Unix() != 1700000000 {
+		t.Fatalf("expected a legacy datetime, got %#v\n", when)
+	}
+	where := values.(map[string]interface{})["where"].([]interface{})[0].(DateTimeZoneId)
+	if !where.Legacy || where.Seconds != 1700000000+3600 {
+		t.Fatalf("expected a legacy datetime in Stockholm, got %#v\n", where)
+	}
+
+	// 5.x servers know them as they are
+	out, err = (Translator{Client: Version{5, 4}, Server: Version{5, 0}}).Request(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(run.Data, out.Data) {
+		t.Fatal("expected the RUN untouched for 5.0")
+	}
+}
+
+// A pretend Bolt 3 server replying to what it gets, which it hands to seen
+func fakeBolt3Server(conn net.Conn, seen chan<- Type) {
+	server := NewDirectConn(conn)
+	success := NewSuccess()
+	record, _ := (&Record{Values: []interface{}{
+		Structure{Tag: NodeTag, Fields: []interface{}{1, []interface{}{}, map[string]interface{}{}}},
+	}}).Encode()
+
+	for {
+		msg, err := server.ReadMessage(context.Background())
+		if err != nil {
+			return
+		}
+		seen <- msg.T
+		if msg.T == NopMsg || msg.T == GoodbyeMsg {
+			continue
+		}
+		if msg.T == PullMsg {
+			server.WriteMessage(record)
+		}
+		server.WriteMessage(success)
+	}
+}
+
+func TestTranslatingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	seen := make(chan Type, 10)
+	go fakeBolt3Server(server, seen)
+	conn := NewTranslatingConn(NewDirectConn(client), Version{5, 4}, Version{3, 0})
+
+	expect := func(types ...Type) {
+		for _, expected := range types {
+			msg, err := readMessage(t, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.T != expected {
+				t.Fatalf("expected %s, got %s\n", expected, msg.T)
+			}
+		}
+	}
+
+	// selecting a database fails, then we ignore until a RESET
+	run, _ := (&Run{Query: "RETURN 1", Metadata: TxMetadata{DB: "movies"}}).Encode()
+	pull, _ := (&Pull{N: 1000, Qid: -1}).Encode()
+	reset, _ := (&Reset{}).Encode()
+	if err := conn.WriteMessages([]*Message{run, pull, reset}); err != nil {
+		t.Fatal(err)
+	}
+	expect(FailureMsg, IgnoreMsg, SuccessMsg)
+	if found := <-seen; found != ResetMsg {
+		t.Fatalf("expected only the RESET to reach the server, got %s\n", found)
+	}
+
+	// our replies get to a reader already waiting on the server
+	read := make(chan *Message, 1)
+	go func() {
+		msg, _ := conn.ReadMessage(context.Background())
+		read <- msg
+	}()
+	time.Sleep(10 * time.Millisecond)
+	telemetry := &Message{T: TelemetryMsg, Data: []byte{0x00, 0x03, 0xb1, 0x54, 0x01, 0x00, 0x00}}
+	if err := conn.WriteMessage(telemetry); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-read:
+		if msg == nil || msg.T != SuccessMsg {
+			t.Fatalf("expected a SUCCESS for TELEMETRY, got %#v\n", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a SUCCESS for TELEMETRY")
+	}
+
+	// records get element ids
+	run, _ = (&Run{Query: "MATCH (n) RETURN n"}).Encode()
+	if err := conn.WriteMessages([]*Message{run, pull}); err != nil {
+		t.Fatal(err)
+	}
+	expect(SuccessMsg)
+	msg, err := readMessage(t, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &Record{}
+	if err = record.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	node, err := DecodeStructure(record.Values[0].(Structure))
+	if err != nil || node.(Node).ElementId != "1" {
+		t.Fatalf("expected a node with element id 1, got %#v (%v)\n", node, err)
+	}
+	expect(SuccessMsg)
+}
+
+func TestTranslatingConnNoop(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := NewTranslatingConn(NewDirectConn(client), Version{5, 4}, Version{3, 0})
+
+	// the server gets our NOOP but doesn't answer it, and answers a RESET
+	// with a NOOP of its own before the SUCCESS
+	seen := make(chan Type, 10)
+	go func() {
+		backend := NewDirectConn(server)
+		success := NewSuccess()
+		noop := &Message{T: NopMsg, Data: []byte{0x00, 0x00}}
+		for {
+			msg, err := backend.ReadMessage(context.Background())
+			if err != nil {
+				return
+			}
+			seen <- msg.T
+			if msg.T == ResetMsg {
+				backend.WriteMessages([]*Message{noop, success})
+			}
+		}
+	}()
+
+	expect := func(types ...Type) {
+		for _, expected := range types {
+			msg, err := readMessage(t, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.T != expected {
+				t.Fatalf("expected %s, got %s\n", expected, msg.T)
+			}
+		}
+	}
+
+	noop := &Message{T: NopMsg, Data: []byte{0x00, 0x00}}
+	run, _ := (&Run{Query: "RETURN 1", Metadata: TxMetadata{DB: "movies"}}).Encode()
+	if err := conn.WriteMessages([]*Message{noop, run}); err != nil {
+		t.Fatal(err)
+	}
+	expect(FailureMsg)
+	if found := <-seen; found != NopMsg {
+		t.Fatalf("expected the NOOP to reach the server, got %s\n", found)
+	}
+
+	reset, _ := (&Reset{}).Encode()
+	if err := conn.WriteMessages([]*Message{reset, run}); err != nil {
+		t.Fatal(err)
+	}
+	expect(NopMsg, SuccessMsg, FailureMsg)
+}
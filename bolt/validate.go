@@ -27,81 +27,63 @@ func ValidateMagic(magic []byte) (bool, error) {
 	return false, errors.New("invalid magic bytes")
 }
 
+// Returned by ValidateHandshake when the client didn't offer a version the
+// server speaks
+var ErrNoVersion = errors.New("no bolt version in common with client")
+
 // Inspect client and server communication for valid Bolt handshake,
 // returning the handshake value's bytes.
 //
-// In order to pick the version, we use a simple formula of:
-//
-//   min( max(client versions), max(server versions) )
-//
-// So if client_versions=[4.0, 3.5, 3.4]
-// and server_versions=[4.2, 4.1, 4.0, 3.5]
-// then min(max(4.0, 3.5, 3.4), max([4.2, 4.1, 4.0, 3.5])) ==>
-//   min(4.0, 4.2) ==> 4.0!
+// The server []byte is the newest version the server speaks, and we take
+// it to speak any older one, too. Client offers may be ranges (see
+// VersionRange), and we pick the newest version found in any of them the
+// server also speaks. So if the client offers [4.4-4.2, 4.1, 4.0, 3.0] to a
+// 4.3 server, we settle on 4.3. Versions older than MinVersion are never
+// chosen.
 //
-// Though, in reality, right now we already have the max(serverVersion)
-// as the server []byte argument.
-//
-// If the handshake is input bytes or handshake is invalid, returns
-// an error and an empty byte array.
+// If no offer works for the server, returns the 4 zero bytes Bolt uses to
+// tell the client so, along with ErrNoVersion. If the handshake bytes are
+// invalid, returns an error and an empty byte array.
 func ValidateHandshake(client, server []byte) ([]byte, error) {
 	if len(server) != 4 {
 		return nil, errors.New("server handshake wrong size")
 	}
+	max, _ := ParseVersion(server)
 
-	if len(client) != 16 {
-		return nil, errors.New("client handshake wrong size")
+	offers, err := ParseHandshake(client)
+	if err != nil {
+		return nil, err
 	}
 
-	chosen := make([]byte, 4)
-
-	// find max(clientVersion)
-	clientVersion := []byte{0x0, 0x0, 0x0, 0x0}
-	for i := 0; i < 4; i++ {
-		part := client[i*4 : i*4+4]
-		if part[3] > clientVersion[3] ||
-			(part[3] == clientVersion[3] && part[2] > clientVersion[2]) {
-			clientVersion = part
+	var chosen Version
+	for _, offer := range offers {
+		// the newest version in the offer the server speaks, if any
+		v := offer.Max
+		if !max.AtLeast(v) {
+			v = max
 		}
-		// XXX: we assume nobody cares about patch level or lower
-	}
-
-	// our hacky min() logic
-	if clientVersion[3] > server[3] {
-		// differing major number, client newer
-		copy(chosen, server)
-	} else if clientVersion[3] == server[3] {
-		// check minor numbers
-		if clientVersion[2] > server[2] {
-			copy(chosen, server)
-		} else {
-			copy(chosen, clientVersion)
+		if offer.Contains(v) && v.AtLeast(chosen) && v.AtLeast(MinVersion) {
+			chosen = v
 		}
-	} else {
-		// client is older
-		copy(chosen, clientVersion)
 	}
 
-	return chosen, nil
+	if chosen == (Version{}) {
+		return []byte{0x00, 0x00, 0x00, 0x00}, ErrNoVersion
+	}
+	return chosen.Bytes(), nil
 }
 
 // Try to find and validate the Mode for some given bytes, returning
 // the Mode if found or if valid looking Bolt chatter. Otherwise,
 // returns nil and an error.
 func ValidateMode(buf []byte) (Mode, error) {
-	if IdentifyType(buf) == BeginMsg {
-		tinyMap, _, err := ParseMap(buf[4:])
-		if err != nil {
-			panic(err)
-		}
-
-		value, found := tinyMap["mode"]
-		if found {
-			mode, ok := value.(string)
-			if ok && mode == "r" {
-				return ReadMode, nil
-			}
+	msg := &Message{T: IdentifyType(buf), Data: buf}
+	if msg.T == BeginMsg {
+		begin := Begin{}
+		if err := begin.Decode(msg); err != nil {
+			return WriteMode, err
 		}
+		return begin.Mode, nil
 	}
 	return WriteMode, nil
 }
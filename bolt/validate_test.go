@@ -119,4 +119,93 @@ func TestValidateHandshake(t *testing.T) {
 			t.Fatalf("expected %#v, got %#v (test: %#v)\n", test["expected"], result, test)
 		}
 	}
+
+	if _, err := ValidateHandshake(v42c[:12], v42s); err == nil {
+		t.Fatal("expected an error for a short client handshake")
+	}
+	if _, err := ValidateHandshake(v42c, v42s[:2]); err == nil {
+		t.Fatal("expected an error for a short server handshake")
+	}
+}
+
+func TestValidateHandshakeRanges(t *testing.T) {
+	// What the official drivers send after the magic
+	drivers := map[string][]byte{
+		"java-4.4": {
+			0x00, 0x02, 0x04, 0x04, // 4.4-4.2
+			0x00, 0x00, 0x01, 0x04,
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x00, 0x03,
+		},
+		"python-4.2": {
+			0x00, 0x00, 0x02, 0x04,
+			0x00, 0x00, 0x01, 0x04,
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x00, 0x03,
+		},
+		"go-5.0": {
+			0x00, 0x00, 0x00, 0x05,
+			0x00, 0x02, 0x04, 0x04, // 4.4-4.2
+			0x00, 0x00, 0x01, 0x04,
+			0x00, 0x00, 0x00, 0x03,
+		},
+		"js-5.8": {
+			0x00, 0x03, 0x03, 0x05, // 5.3-5.0
+			0x00, 0x02, 0x04, 0x04, // 4.4-4.2
+			0x00, 0x00, 0x01, 0x04,
+			0x00, 0x00, 0x00, 0x03,
+		},
+		"ancient": {
+			0x00, 0x00, 0x00, 0x02,
+			0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+		},
+	}
+
+	tests := []struct {
+		driver   string
+		server   Version
+		expected Version
+	}{
+		{"java-4.4", Version{4, 4}, Version{4, 4}},
+		{"java-4.4", Version{4, 3}, Version{4, 3}},
+		{"java-4.4", Version{4, 2}, Version{4, 2}},
+		{"java-4.4", Version{4, 1}, Version{4, 1}},
+		{"java-4.4", Version{3, 0}, Version{3, 0}},
+		{"java-4.4", Version{5, 0}, Version{4, 4}},
+		{"python-4.2", Version{4, 4}, Version{4, 2}},
+		{"python-4.2", Version{4, 2}, Version{4, 2}},
+		{"python-4.2", Version{4, 0}, Version{4, 0}},
+		{"go-5.0", Version{5, 4}, Version{5, 0}},
+		{"go-5.0", Version{4, 4}, Version{4, 4}},
+		{"go-5.0", Version{4, 3}, Version{4, 3}},
+		{"js-5.8", Version{5, 6}, Version{5, 3}},
+		{"js-5.8", Version{5, 2}, Version{5, 2}},
+		{"js-5.8", Version{4, 4}, Version{4, 4}},
+		{"js-5.8", Version{3, 0}, Version{3, 0}},
+		// no overlap, or none we can proxy
+		{"ancient", Version{4, 2}, Version{}},
+		{"ancient", Version{1, 0}, Version{}},
+		{"java-4.4", Version{2, 0}, Version{}},
+		{"js-5.8", Version{1, 0}, Version{}},
+	}
+
+	for _, test := range tests {
+		result, err := ValidateHandshake(drivers[test.driver], test.server.Bytes())
+		if test.expected == (Version{}) {
+			if err != ErrNoVersion || !bytes.Equal(result, []byte{0, 0, 0, 0}) {
+				t.Fatalf("expected no version for %s with %s, got %#v (%v)\n",
+					test.driver, test.server, result, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(test.expected.Bytes(), result) {
+			t.Fatalf("expected %s for %s with %s, got %#v\n",
+				test.expected, test.driver, test.server, result)
+		}
+	}
 }
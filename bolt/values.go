@@ -0,0 +1,430 @@
+package bolt
+
+import (
+	"fmt"
+	"time"
+)
+
+// Structure tags for the graph, temporal, and spatial values Neo4j sends
+// back in RECORD messages. The "legacy" DateTime variants are what Bolt
+// versions prior to 5.0 use (unless the utc patch was negotiated); the UTC
+// variants replace them from Bolt 5.0 onward.
+const (
+	NodeTag                byte = 'N'
+	RelationshipTag        byte = 'R'
+	UnboundRelationshipTag byte = 'r'
+	PathTag                byte = 'P'
+	DateTag                byte = 'D'
+	TimeTag                byte = 'T'
+	LocalTimeTag           byte = 't'
+	LegacyDateTimeTag      byte = 'F'
+	LegacyDateTimeZoneTag  byte = 'f'
+	DateTimeTag            byte = 'I'
+	DateTimeZoneIdTag      byte = 'i'
+	LocalDateTimeTag       byte = 'd'
+	DurationTag            byte = 'E'
+	Point2DTag             byte = 'X'
+	Point3DTag             byte = 'Y'
+)
+
+// A graph Node. ElementId is only provided by Bolt 5.0+ servers.
+type Node struct {
+	Id         int
+	Labels     []string
+	Properties map[string]interface{}
+	ElementId  string
+}
+
+// A graph Relationship. The element ids are only provided by Bolt 5.0+
+// servers.
+type Relationship struct {
+	Id                 int
+	StartId, EndId     int
+	Type               string
+	Properties         map[string]interface{}
+	ElementId          string
+	StartNodeElementId string
+	EndNodeElementId   string
+}
+
+// A Relationship without its start and end nodes, as found within a Path.
+type UnboundRelationship struct {
+	Id         int
+	Type       string
+	Properties map[string]interface{}
+	ElementId  string
+}
+
+// A Path made of alternating Nodes and UnboundRelationships. Indices
+// describes the traversal: pairs of (relationship, node) indexes where a
+// negative relationship index means it's traversed in reverse.
+type Path struct {
+	Nodes         []Node
+	Relationships []UnboundRelationship
+	Indices       []int
+}
+
+// Days since the Unix epoch
+type Date struct {
+	Days int
+}
+
+func (d Date) Time() time.Time {
+	return time.Unix(0, 0).UTC().AddDate(0, 0, d.Days)
+}
+
+// Nanoseconds since midnight with a timezone offset in seconds
+type Time struct {
+	Nanoseconds     int
+	TzOffsetSeconds int
+}
+
+// Nanoseconds since midnight
+type LocalTime struct {
+	Nanoseconds int
+}
+
+// A date and time with a fixed timezone offset. If Legacy is set, Seconds
+// are counted from the epoch in local time (pre-Bolt 5 semantics);
+// otherwise Seconds are UTC.
+type DateTime struct {
+	Seconds         int
+	Nanoseconds     int
+	TzOffsetSeconds int
+	Legacy          bool
+}
+
+func (d DateTime) Time() time.Time {
+	seconds := d.Seconds
+	if d.Legacy {
+		seconds = seconds - d.TzOffsetSeconds
+	}
+	zone := time.FixedZone("", d.TzOffsetSeconds)
+	return time.Unix(int64(seconds), int64(d.Nanoseconds)).In(zone)
+}
+
+// A date and time in a named timezone, with the same Legacy semantics as
+// DateTime.
+type DateTimeZoneId struct {
+	Seconds     int
+	Nanoseconds int
+	TzId        string
+	Legacy      bool
+}
+
+// Convert to a time.Time, which requires the named timezone to be known to
+// the local tz database.
+func (d DateTimeZoneId) Time() (time.Time, error) {
+	loc, err := time.LoadLocation(d.TzId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if d.Legacy {
+		return time.Date(1970, 1, 1, 0, 0, d.Seconds, d.Nanoseconds, loc), nil
+	}
+	return time.Unix(int64(d.Seconds), int64(d.Nanoseconds)).In(loc), nil
+}
+
+// Seconds and nanoseconds since the epoch, without any timezone
+type LocalDateTime struct {
+	Seconds     int
+	Nanoseconds int
+}
+
+type Duration struct {
+	Months, Days, Seconds, Nanoseconds int
+}
+
+type Point2D struct {
+	Srid int
+	X, Y float64
+}
+
+type Point3D struct {
+	Srid    int
+	X, Y, Z float64
+}
+
+// Helper for pulling typed fields out of a Structure, remembering the first
+// error so decoders can read all their fields and check once at the end.
+type fieldReader struct {
+	s   Structure
+	err error
+}
+
+func (r *fieldReader) get(i int) interface{} {
+	if r.err != nil {
+		return nil
+	}
+	if i >= len(r.s.Fields) {
+		r.err = fmt.Errorf("structure %#x missing field %d", r.s.Tag, i)
+		return nil
+	}
+	return r.s.Fields[i]
+}
+
+func (r *fieldReader) fail(i int, want string, got interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("structure %#x field %d: expected %s, got %T",
+			r.s.Tag, i, want, got)
+	}
+}
+
+func (r *fieldReader) int(i int) int {
+	val := r.get(i)
+	n, ok := val.(int)
+	if !ok && r.err == nil {
+		r.fail(i, "int", val)
+	}
+	return n
+}
+
+func (r *fieldReader) float(i int) float64 {
+	val := r.get(i)
+	f, ok := val.(float64)
+	if !ok && r.err == nil {
+		r.fail(i, "float", val)
+	}
+	return f
+}
+
+func (r *fieldReader) string(i int) string {
+	val := r.get(i)
+	s, ok := val.(string)
+	if !ok && r.err == nil {
+		r.fail(i, "string", val)
+	}
+	return s
+}
+
+func (r *fieldReader) props(i int) map[string]interface{} {
+	val := r.get(i)
+	m, ok := val.(map[string]interface{})
+	if !ok && r.err == nil {
+		r.fail(i, "map", val)
+		return nil
+	}
+	if r.err == nil {
+		var decoded interface{}
+		decoded, r.err = DecodeValue(m)
+		m, _ = decoded.(map[string]interface{})
+	}
+	return m
+}
+
+func (r *fieldReader) list(i int) []interface{} {
+	val := r.get(i)
+	list, ok := val.([]interface{})
+	if !ok && r.err == nil {
+		r.fail(i, "list", val)
+	}
+	return list
+}
+
+func (r *fieldReader) strings(i int) []string {
+	list := r.list(i)
+	if r.err != nil {
+		return nil
+	}
+	result, err := stringsField(list)
+	if err != nil {
+		r.err = err
+	}
+	return result
+}
+
+func (r *fieldReader) fields(n ...int) {
+	if r.err != nil {
+		return
+	}
+	for _, size := range n {
+		if len(r.s.Fields) == size {
+			return
+		}
+	}
+	r.err = fmt.Errorf("structure %#x has unexpected field count %d", r.s.Tag, len(r.s.Fields))
+}
+
+func decodeNode(s Structure) (Node, error) {
+	r := fieldReader{s: s}
+	r.fields(3, 4)
+	node := Node{
+		Id:         r.int(0),
+		Labels:     r.strings(1),
+		Properties: r.props(2),
+	}
+	if len(s.Fields) > 3 {
+		node.ElementId = r.string(3)
+	}
+	return node, r.err
+}
+
+func decodeRelationship(s Structure) (Relationship, error) {
+	r := fieldReader{s: s}
+	r.fields(5, 8)
+	rel := Relationship{
+		Id:         r.int(0),
+		StartId:    r.int(1),
+		EndId:      r.int(2),
+		Type:       r.string(3),
+		Properties: r.props(4),
+	}
+	if len(s.Fields) > 5 {
+		rel.ElementId = r.string(5)
+		rel.StartNodeElementId = r.string(6)
+		rel.EndNodeElementId = r.string(7)
+	}
+	return rel, r.err
+}
+
+func decodeUnboundRelationship(s Structure) (UnboundRelationship, error) {
+	r := fieldReader{s: s}
+	r.fields(3, 4)
+	rel := UnboundRelationship{
+		Id:         r.int(0),
+		Type:       r.string(1),
+		Properties: r.props(2),
+	}
+	if len(s.Fields) > 3 {
+		rel.ElementId = r.string(3)
+	}
+	return rel, r.err
+}
+
+func decodePath(s Structure) (Path, error) {
+	r := fieldReader{s: s}
+	r.fields(3)
+	nodes, rels, indices := r.list(0), r.list(1), r.list(2)
+	if r.err != nil {
+		return Path{}, r.err
+	}
+
+	path := Path{
+		Nodes:         make([]Node, len(nodes)),
+		Relationships: make([]UnboundRelationship, len(rels)),
+		Indices:       make([]int, len(indices)),
+	}
+	for i, val := range nodes {
+		node, ok := val.(Structure)
+		if !ok || node.Tag != NodeTag {
+			return Path{}, fmt.Errorf("path node %d isn't a node: %v", i, val)
+		}
+		n, err := decodeNode(node)
+		if err != nil {
+			return Path{}, err
+		}
+		path.Nodes[i] = n
+	}
+	for i, val := range rels {
+		rel, ok := val.(Structure)
+		if !ok || rel.Tag != UnboundRelationshipTag {
+			return Path{}, fmt.Errorf("path relationship %d isn't unbound: %v", i, val)
+		}
+		u, err := decodeUnboundRelationship(rel)
+		if err != nil {
+			return Path{}, err
+		}
+		path.Relationships[i] = u
+	}
+	for i, val := range indices {
+		index, ok := val.(int)
+		if !ok {
+			return Path{}, fmt.Errorf("path index %d isn't an int: %T", i, val)
+		}
+		path.Indices[i] = index
+	}
+	return path, nil
+}
+
+// Decode a Structure found in a RECORD into its Go type (Node, Date, etc.).
+// Any property maps are decoded recursively. Returns an error for unknown
+// tags or malformed fields.
+func DecodeStructure(s Structure) (interface{}, error) {
+	r := fieldReader{s: s}
+
+	switch s.Tag {
+	case NodeTag:
+		return decodeNode(s)
+	case RelationshipTag:
+		return decodeRelationship(s)
+	case UnboundRelationshipTag:
+		return decodeUnboundRelationship(s)
+	case PathTag:
+		return decodePath(s)
+	case DateTag:
+		r.fields(1)
+		return Date{Days: r.int(0)}, r.err
+	case TimeTag:
+		r.fields(2)
+		return Time{Nanoseconds: r.int(0), TzOffsetSeconds: r.int(1)}, r.err
+	case LocalTimeTag:
+		r.fields(1)
+		return LocalTime{Nanoseconds: r.int(0)}, r.err
+	case LegacyDateTimeTag, DateTimeTag:
+		r.fields(3)
+		return DateTime{
+			Seconds:         r.int(0),
+			Nanoseconds:     r.int(1),
+			TzOffsetSeconds: r.int(2),
+			Legacy:          s.Tag == LegacyDateTimeTag,
+		}, r.err
+	case LegacyDateTimeZoneTag, DateTimeZoneIdTag:
+		r.fields(3)
+		return DateTimeZoneId{
+			Seconds:     r.int(0),
+			Nanoseconds: r.int(1),
+			TzId:        r.string(2),
+			Legacy:      s.Tag == LegacyDateTimeZoneTag,
+		}, r.err
+	case LocalDateTimeTag:
+		r.fields(2)
+		return LocalDateTime{Seconds: r.int(0), Nanoseconds: r.int(1)}, r.err
+	case DurationTag:
+		r.fields(4)
+		return Duration{
+			Months:      r.int(0),
+			Days:        r.int(1),
+			Seconds:     r.int(2),
+			Nanoseconds: r.int(3),
+		}, r.err
+	case Point2DTag:
+		r.fields(3)
+		return Point2D{Srid: r.int(0), X: r.float(1), Y: r.float(2)}, r.err
+	case Point3DTag:
+		r.fields(4)
+		return Point3D{Srid: r.int(0), X: r.float(1), Y: r.float(2), Z: r.float(3)}, r.err
+	}
+
+	return nil, fmt.Errorf("unknown structure tag %#x", s.Tag)
+}
+
+// Walk a value produced by Unpack, replacing any Structures (including
+// those nested in lists and maps) with their decoded Go types. Useful for
+// turning Record.Values into something friendlier to inspect.
+func DecodeValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case Structure:
+		return DecodeStructure(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			decoded, err := DecodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = decoded
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			decoded, err := DecodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = decoded
+		}
+		return result, nil
+	}
+	return val, nil
+}
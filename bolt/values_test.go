@@ -0,0 +1,189 @@
+package bolt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodingGraphStructures(t *testing.T) {
+	props := map[string]interface{}{"name": "Dave"}
+
+	type test struct {
+		s        Structure
+		expected interface{}
+	}
+
+	tests := []test{
+		// legacy node & relationships
+		{Structure{NodeTag, []interface{}{1, []interface{}{"Person"}, props}},
+			Node{Id: 1, Labels: []string{"Person"}, Properties: props}},
+		{Structure{RelationshipTag, []interface{}{5, 1, 2, "KNOWS", map[string]interface{}{}}},
+			Relationship{Id: 5, StartId: 1, EndId: 2, Type: "KNOWS",
+				Properties: map[string]interface{}{}}},
+		{Structure{UnboundRelationshipTag, []interface{}{5, "KNOWS", map[string]interface{}{}}},
+			UnboundRelationship{Id: 5, Type: "KNOWS", Properties: map[string]interface{}{}}},
+		// Bolt 5 adds element ids
+		{Structure{NodeTag, []interface{}{1, []interface{}{}, props, "4:abc:1"}},
+			Node{Id: 1, Labels: []string{}, Properties: props, ElementId: "4:abc:1"}},
+		{Structure{RelationshipTag, []interface{}{5, 1, 2, "KNOWS", map[string]interface{}{},
+			"5:abc:5", "4:abc:1", "4:abc:2"}},
+			Relationship{Id: 5, StartId: 1, EndId: 2, Type: "KNOWS",
+				Properties: map[string]interface{}{}, ElementId: "5:abc:5",
+				StartNodeElementId: "4:abc:1", EndNodeElementId: "4:abc:2"}},
+		{Structure{UnboundRelationshipTag, []interface{}{5, "KNOWS", map[string]interface{}{}, "5:abc:5"}},
+			UnboundRelationship{Id: 5, Type: "KNOWS", Properties: map[string]interface{}{},
+				ElementId: "5:abc:5"}},
+	}
+
+	for _, test := range tests {
+		val, err := DecodeStructure(test.s)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %s\n", test.s, err)
+		}
+		if !reflect.DeepEqual(test.expected, val) {
+			t.Fatalf("expected %#v, got %#v\n", test.expected, val)
+		}
+	}
+}
+
+func TestDecodingPath(t *testing.T) {
+	empty := map[string]interface{}{}
+	s := Structure{PathTag, []interface{}{
+		[]interface{}{
+			Structure{NodeTag, []interface{}{1, []interface{}{"A"}, empty}},
+			Structure{NodeTag, []interface{}{2, []interface{}{"B"}, empty}},
+		},
+		[]interface{}{
+			Structure{UnboundRelationshipTag, []interface{}{9, "TO", empty}},
+		},
+		[]interface{}{1, 1},
+	}}
+
+	val, err := DecodeStructure(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, ok := val.(Path)
+	if !ok {
+		t.Fatalf("expected a Path, got %T\n", val)
+	}
+	if len(path.Nodes) != 2 || path.Nodes[1].Labels[0] != "B" {
+		t.Fatalf("unexpected path nodes: %#v\n", path.Nodes)
+	}
+	if len(path.Relationships) != 1 || path.Relationships[0].Type != "TO" {
+		t.Fatalf("unexpected path relationships: %#v\n", path.Relationships)
+	}
+	if !reflect.DeepEqual([]int{1, 1}, path.Indices) {
+		t.Fatalf("unexpected path indices: %#v\n", path.Indices)
+	}
+}
+
+func TestDecodingTemporalAndSpatial(t *testing.T) {
+	type test struct {
+		s        Structure
+		expected interface{}
+	}
+
+	tests := []test{
+		{Structure{DateTag, []interface{}{18628}}, Date{18628}},
+		{Structure{TimeTag, []interface{}{3600000000000, -18000}}, Time{3600000000000, -18000}},
+		{Structure{LocalTimeTag, []interface{}{1}}, LocalTime{1}},
+		{Structure{LegacyDateTimeTag, []interface{}{1609459200, 5, 3600}},
+			DateTime{1609459200, 5, 3600, true}},
+		{Structure{DateTimeTag, []interface{}{1609459200, 5, 3600}},
+			DateTime{1609459200, 5, 3600, false}},
+		{Structure{LegacyDateTimeZoneTag, []interface{}{1609459200, 0, "Europe/Stockholm"}},
+			DateTimeZoneId{1609459200, 0, "Europe/Stockholm", true}},
+		{Structure{DateTimeZoneIdTag, []interface{}{1609459200, 0, "Europe/Stockholm"}},
+			DateTimeZoneId{1609459200, 0, "Europe/Stockholm", false}},
+		{Structure{LocalDateTimeTag, []interface{}{1609459200, 7}}, LocalDateTime{1609459200, 7}},
+		{Structure{DurationTag, []interface{}{14, 3, 120, 9}}, Duration{14, 3, 120, 9}},
+		{Structure{Point2DTag, []interface{}{7203, 1.5, -2.0}}, Point2D{7203, 1.5, -2.0}},
+		{Structure{Point3DTag, []interface{}{4979, 1.0, 2.0, 3.0}}, Point3D{4979, 1.0, 2.0, 3.0}},
+	}
+
+	for _, test := range tests {
+		val, err := DecodeStructure(test.s)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %s\n", test.s, err)
+		}
+		if !reflect.DeepEqual(test.expected, val) {
+			t.Fatalf("expected %#v, got %#v\n", test.expected, val)
+		}
+	}
+}
+
+func TestDateTimeConversions(t *testing.T) {
+	// 2021-01-01T01:00:00+01:00 is midnight UTC in both encodings
+	expected := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	legacy := DateTime{Seconds: 1609459200 + 3600, TzOffsetSeconds: 3600, Legacy: true}
+	if !legacy.Time().Equal(expected) {
+		t.Fatalf("expected %s, got %s\n", expected, legacy.Time())
+	}
+	utc := DateTime{Seconds: 1609459200, TzOffsetSeconds: 3600}
+	if !utc.Time().Equal(expected) {
+		t.Fatalf("expected %s, got %s\n", expected, utc.Time())
+	}
+	if _, offset := utc.Time().Zone(); offset != 3600 {
+		t.Fatalf("expected offset of 3600, got %d\n", offset)
+	}
+
+	date := Date{Days: 18628}
+	if !date.Time().Equal(expected) {
+		t.Fatalf("expected %s, got %s\n", expected, date.Time())
+	}
+}
+
+func TestDecodingRecordValues(t *testing.T) {
+	// RECORD [[Node], {"when": Date}]
+	payload, err := Pack(Structure{recordTag, []interface{}{[]interface{}{
+		[]interface{}{Structure{NodeTag, []interface{}{1, []interface{}{}, map[string]interface{}{
+			"born": Structure{DateTag, []interface{}{0}},
+		}}}},
+		map[string]interface{}{"when": Structure{DateTag, []interface{}{1}}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := Record{}
+	if err = record.Decode(&Message{T: RecordMsg, Data: Chunker{}.Chunk(payload)}); err != nil {
+		t.Fatal(err)
+	}
+	val, err := DecodeValue(record.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		[]interface{}{Node{Id: 1, Labels: []string{},
+			Properties: map[string]interface{}{"born": Date{0}}}},
+		map[string]interface{}{"when": Date{1}},
+	}
+	if !reflect.DeepEqual(expected, val) {
+		t.Fatalf("expected %#v, got %#v\n", expected, val)
+	}
+}
+
+func TestDecodingMalformedStructures(t *testing.T) {
+	tests := []Structure{
+		{NodeTag, []interface{}{1, []interface{}{"A"}}},
+		{NodeTag, []interface{}{"1", []interface{}{"A"}, map[string]interface{}{}}},
+		{NodeTag, []interface{}{1, []interface{}{1}, map[string]interface{}{}}},
+		{RelationshipTag, []interface{}{5, 1, 2, "KNOWS", map[string]interface{}{}, "x"}},
+		{PathTag, []interface{}{[]interface{}{1}, []interface{}{}, []interface{}{}}},
+		{DateTag, []interface{}{}},
+		{Point2DTag, []interface{}{7203, 1, 2}},
+		{DateTimeZoneIdTag, []interface{}{0, 0, 0}},
+		{0x00, []interface{}{}},
+	}
+
+	for _, test := range tests {
+		val, err := DecodeStructure(test)
+		if err == nil {
+			t.Fatalf("expected error decoding %v, got %#v\n", test, val)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A negotiated Bolt protocol version. Not to be confused with the Neo4j
+// server version.
+type Version struct {
+	Major, Minor uint8
+}
+
+// Parse the 4-byte big-endian version representation used in the Bolt
+// handshake, e.g. {0x00, 0x00, 0x02, 0x04} for v4.2.
+func ParseVersion(buf []byte) (Version, error) {
+	if len(buf) < 4 {
+		return Version{}, errors.New("buffer too short (< 4)")
+	}
+	return Version{Major: buf[3], Minor: buf[2]}, nil
+}
+
+func (v Version) Bytes() []byte {
+	return []byte{0x00, 0x00, v.Minor, v.Major}
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("Bolt/%d.%d", v.Major, v.Minor)
+}
+
+// Returns true if v is the same as or newer than other
+func (v Version) AtLeast(other Version) bool {
+	return v.Major > other.Major ||
+		(v.Major == other.Major && v.Minor >= other.Minor)
+}
+
+// A version offered in a Bolt handshake, e.g. {0x00, 0x02, 0x04, 0x04}.
+// Since Bolt 4.3, an offer can cover a range of minor versions: the second
+// byte says how many minor versions below Max the client also speaks, so
+// that example means 4.2 through 4.4.
+type VersionRange struct {
+	Max  Version
+	Back uint8
+}
+
+// Parse the 4-byte form of an offer
+func ParseVersionRange(buf []byte) (VersionRange, error) {
+	v, err := ParseVersion(buf)
+	if err != nil {
+		return VersionRange{}, err
+	}
+	return VersionRange{Max: v, Back: buf[1]}, nil
+}
+
+// The oldest version in the range
+func (r VersionRange) Min() Version {
+	if r.Back > r.Max.Minor {
+		return Version{Major: r.Max.Major}
+	}
+	return Version{Major: r.Max.Major, Minor: r.Max.Minor - r.Back}
+}
+
+// Returns true if v falls within the range
+func (r VersionRange) Contains(v Version) bool {
+	return v.Major == r.Max.Major && r.Max.AtLeast(v) && v.AtLeast(r.Min())
+}
+
+func (r VersionRange) String() string {
+	if r.Back == 0 {
+		return r.Max.String()
+	}
+	return fmt.Sprintf("%s-%d.%d", r.Min(), r.Max.Major, r.Max.Minor)
+}
+
+// Parse the version offers in a client's 16-byte handshake (the part after
+// the magic), skipping empty slots.
+func ParseHandshake(buf []byte) ([]VersionRange, error) {
+	if len(buf) != 16 {
+		return nil, errors.New("client handshake wrong size")
+	}
+
+	offers := make([]VersionRange, 0, 4)
+	for i := 0; i < 16; i = i + 4 {
+		r, _ := ParseVersionRange(buf[i : i+4])
+		if r.Max != (Version{}) {
+			offers = append(offers, r)
+		}
+	}
+	return offers, nil
+}
+
+// Entry in our master list of Bolt messages, describing the protocol
+// versions in which a message signature is valid. A zero Until means the
+// message is still current.
+type messageSpec struct {
+	t            Type
+	tag          byte
+	since, until Version
+}
+
+// The newest Bolt version we know how to proxy
+var MaxVersion = Version{5, 4}
+
+// The oldest Bolt version we know how to proxy, as older ones have no
+// HELLO for us to broker authentication with
+var MinVersion = Version{3, 0}
+
+var (
+	v1_0 = Version{1, 0}
+	v3_0 = Version{3, 0}
+	v4_0 = Version{4, 0}
+	v4_1 = Version{4, 1}
+	v4_3 = Version{4, 3}
+	v4_4 = Version{4, 4}
+	v5_0 = Version{5, 0}
+	v5_1 = Version{5, 1}
+	v5_2 = Version{5, 2}
+	v5_3 = Version{5, 3}
+	v5_4 = Version{5, 4}
+)
+
+var messageSpecs = []messageSpec{
+	{t: InitMsg, tag: initTag, since: v1_0, until: v3_0},
+	{t: AckFailureMsg, tag: ackFailureTag, since: v1_0, until: v3_0},
+	{t: HelloMsg, tag: helloTag, since: v3_0},
+	{t: GoodbyeMsg, tag: goodbyeTag, since: v3_0},
+	{t: ResetMsg, tag: resetTag, since: v1_0},
+	{t: RunMsg, tag: runTag, since: v1_0},
+	{t: BeginMsg, tag: beginTag, since: v3_0},
+	{t: CommitMsg, tag: commitTag, since: v3_0},
+	{t: RollbackMsg, tag: rollbackTag, since: v3_0},
+	{t: DiscardMsg, tag: discardTag, since: v1_0},
+	{t: PullMsg, tag: pullTag, since: v1_0},
+	{t: RouteMsg, tag: routeTag, since: v4_3},
+	{t: LogonMsg, tag: logonTag, since: v5_1},
+	{t: LogoffMsg, tag: logoffTag, since: v5_1},
+	{t: TelemetryMsg, tag: telemetryTag, since: v5_4},
+	{t: SuccessMsg, tag: successTag, since: v1_0},
+	{t: RecordMsg, tag: recordTag, since: v1_0},
+	{t: IgnoreMsg, tag: ignoredTag, since: v1_0},
+	{t: FailureMsg, tag: failureTag, since: v1_0},
+}
+
+func (m messageSpec) validIn(v Version) bool {
+	if !v.AtLeast(m.since) {
+		return false
+	}
+	return m.until == (Version{}) || !v.AtLeast(m.until)
+}
+
+// The set of Bolt messages valid for a given protocol version
+type Catalog struct {
+	Version Version
+	types   map[byte]Type
+	tags    map[Type]byte
+}
+
+var (
+	catalogs     = make(map[Version]*Catalog)
+	catalogsLock sync.Mutex
+)
+
+// Get the (shared, read-only) Catalog for the given protocol version
+func CatalogFor(v Version) *Catalog {
+	catalogsLock.Lock()
+	defer catalogsLock.Unlock()
+
+	c, found := catalogs[v]
+	if found {
+		return c
+	}
+
+	c = &Catalog{
+		Version: v,
+		types:   make(map[byte]Type),
+		tags:    make(map[Type]byte),
+	}
+	for _, spec := range messageSpecs {
+		if spec.validIn(v) {
+			c.types[spec.tag] = spec.t
+			c.tags[spec.t] = spec.tag
+		}
+	}
+	catalogs[v] = c
+	return c
+}
+
+// Parse a byte into the corresponding Bolt message Type, returning
+// UnknownMsg if the signature isn't valid in this version.
+func (c *Catalog) TypeFromByte(b byte) Type {
+	t, found := c.types[b]
+	if !found {
+		return UnknownMsg
+	}
+	return t
+}
+
+// Version-aware equivalent of IdentifyType
+func (c *Catalog) IdentifyType(buf []byte) Type {
+	if len(buf) < 4 {
+		return NopMsg
+	}
+	return c.TypeFromByte(buf[3])
+}
+
+// Check if the message Type is valid in this version
+func (c *Catalog) Allows(t Type) bool {
+	_, found := c.tags[t]
+	return found
+}
+
+// Look up the signature byte for a message Type in this version
+func (c *Catalog) Tag(t Type) (byte, bool) {
+	tag, found := c.tags[t]
+	return tag, found
+}
@@ -0,0 +1,131 @@
+package bolt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsingVersions(t *testing.T) {
+	v, err := ParseVersion([]byte{0x00, 0x00, 0x02, 0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != (Version{4, 2}) {
+		t.Fatalf("expected 4.2, got %s\n", v)
+	}
+	if v.String() != "Bolt/4.2" {
+		t.Fatalf("unexpected string form %s\n", v)
+	}
+	if !bytes.Equal(v.Bytes(), []byte{0x00, 0x00, 0x02, 0x04}) {
+		t.Fatalf("unexpected bytes %#v\n", v.Bytes())
+	}
+	if _, err = ParseVersion([]byte{0x04}); err == nil {
+		t.Fatal("expected error parsing short buffer")
+	}
+
+	if !v.AtLeast(Version{4, 2}) || !v.AtLeast(Version{3, 5}) || v.AtLeast(Version{4, 3}) {
+		t.Fatal("AtLeast comparisons are broken")
+	}
+}
+
+func TestCatalogsByVersion(t *testing.T) {
+	type test struct {
+		v       Version
+		allowed []Type
+		denied  []Type
+	}
+
+	tests := []test{
+		{Version{2, 0}, []Type{InitMsg, AckFailureMsg, RunMsg, PullMsg},
+			[]Type{HelloMsg, BeginMsg, GoodbyeMsg, RouteMsg}},
+		{Version{3, 0}, []Type{HelloMsg, BeginMsg, CommitMsg, GoodbyeMsg},
+			[]Type{InitMsg, AckFailureMsg, RouteMsg}},
+		{Version{4, 2}, []Type{HelloMsg, RunMsg, PullMsg},
+			[]Type{RouteMsg, LogonMsg}},
+		{Version{4, 3}, []Type{RouteMsg}, []Type{LogonMsg, LogoffMsg}},
+		{Version{5, 0}, []Type{RouteMsg}, []Type{LogonMsg, TelemetryMsg}},
+		{Version{5, 1}, []Type{LogonMsg, LogoffMsg}, []Type{TelemetryMsg}},
+		{Version{5, 4}, []Type{LogonMsg, TelemetryMsg, SuccessMsg},
+			[]Type{InitMsg, UnknownMsg}},
+	}
+
+	for _, test := range tests {
+		c := CatalogFor(test.v)
+		for _, msgType := range test.allowed {
+			if !c.Allows(msgType) {
+				t.Fatalf("expected %s to allow %s\n", test.v, msgType)
+			}
+		}
+		for _, msgType := range test.denied {
+			if c.Allows(msgType) {
+				t.Fatalf("expected %s to deny %s\n", test.v, msgType)
+			}
+		}
+	}
+}
+
+func TestCatalogIdentifyType(t *testing.T) {
+	init := []byte{0x00, 0x02, 0xb1, 0x01, 0x00, 0x00}
+	if msgType := CatalogFor(Version{2, 0}).IdentifyType(init); msgType != InitMsg {
+		t.Fatalf("expected INIT in v2, got %s\n", msgType)
+	}
+	if msgType := CatalogFor(Version{4, 4}).IdentifyType(init); msgType != HelloMsg {
+		t.Fatalf("expected HELLO in v4.4, got %s\n", msgType)
+	}
+
+	route := []byte{0x00, 0x02, 0xb3, 0x66, 0x00, 0x00}
+	if msgType := CatalogFor(Version{4, 2}).IdentifyType(route); msgType != UnknownMsg {
+		t.Fatalf("expected ROUTE to be unknown in v4.2, got %s\n", msgType)
+	}
+	if msgType := CatalogFor(Version{4, 3}).IdentifyType(route); msgType != RouteMsg {
+		t.Fatalf("expected ROUTE in v4.3, got %s\n", msgType)
+	}
+
+	if msgType := CatalogFor(Version{4, 3}).IdentifyType([]byte{0x00}); msgType != NopMsg {
+		t.Fatalf("expected NOP for short buffer, got %s\n", msgType)
+	}
+
+	if tag, ok := CatalogFor(Version{5, 1}).Tag(LogonMsg); !ok || tag != 0x6a {
+		t.Fatalf("expected LOGON tag 0x6a, got %#x (%v)\n", tag, ok)
+	}
+	if CatalogFor(Version{5, 1}) != CatalogFor(Version{5, 1}) {
+		t.Fatal("expected catalogs to be cached")
+	}
+}
+
+func TestVersionRanges(t *testing.T) {
+	r, err := ParseVersionRange([]byte{0x00, 0x02, 0x04, 0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Min() != (Version{4, 2}) || r.String() != "Bolt/4.2-4.4" {
+		t.Fatalf("expected Bolt/4.2-4.4, got %s\n", r)
+	}
+	for v, expected := range map[Version]bool{
+		{4, 4}: true, {4, 3}: true, {4, 2}: true,
+		{4, 1}: false, {4, 5}: false, {5, 3}: false, {3, 0}: false,
+	} {
+		if r.Contains(v) != expected {
+			t.Fatalf("expected %s contains %s to be %v\n", r, v, expected)
+		}
+	}
+
+	// ranges can't reach below .0
+	r = VersionRange{Max: Version{5, 1}, Back: 7}
+	if r.Min() != (Version{5, 0}) {
+		t.Fatalf("expected a minimum of 5.0, got %s\n", r.Min())
+	}
+
+	offers, err := ParseHandshake([]byte{
+		0x00, 0x02, 0x04, 0x04,
+		0x00, 0x00, 0x01, 0x04,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offers) != 2 || offers[1].Max != (Version{4, 1}) {
+		t.Fatalf("expected 2 offers, got %v\n", offers)
+	}
+}
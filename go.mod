@@ -3,7 +3,7 @@ module github.com/voutilad/bolt-proxy
 go 1.15
 
 require (
-	github.com/gobwas/httphead v0.0.0-20200921212729-da3d93bc3c58 // indirect
+	github.com/gobwas/httphead v0.0.0-20200921212729-da3d93bc3c58
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.0.4
 	github.com/neo4j/neo4j-go-driver/v4 v4.0.0-beta2
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Describe the process on the other end of a Unix domain socket, as
+// reported by SO_PEERCRED
+func peerCredentials(conn net.Conn) (string, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", errors.New("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", cred.Pid, cred.Uid, cred.Gid), nil
+}
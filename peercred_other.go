@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// SO_PEERCRED is Linux-only
+func peerCredentials(conn net.Conn) (string, error) {
+	return "", errors.New("peer credentials not supported on this platform")
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +13,11 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	// debuggin' -- used for runtime profiling/debugging
@@ -28,6 +36,10 @@ const (
 	MAX_IDLE_MINS int = 30
 	// max bytes to display in logs in debug mode
 	MAX_BYTES int = 32
+	// a client that never pauses still has its messages sent on to the
+	// server once this many, or this many bytes, are batched up
+	MAX_BATCH_MESSAGES int = 1000
+	MAX_BATCH_BYTES    int = 1024 * 1024
 )
 
 var (
@@ -36,25 +48,74 @@ var (
 	warn  *log.Logger
 )
 
+// Settings main() hands down to each client handler
+type clientConfig struct {
+	// WebSocket messages smaller than this aren't compressed (-1 disables)
+	deflateThreshold int
+	// max bytes buffered from the backend per client and for all clients
+	sessionBudget int64
+	globalBudget  *bolt.Budget
+	// the biggest message we'll read from a client (0 is unlimited)
+	maxMessageSize int
+	// translate for backend hosts speaking older Bolt versions than clients
+	translate bool
+	// our host:port for clients asking for a routing table, if we answer
+	advertise string
+}
+
+// The newest Bolt version we'll negotiate with clients: whatever every
+// backend host speaks, or all we know if we translate for the hosts
+func offeredVersion(b *backend.Backend, cfg clientConfig) bolt.Version {
+	if cfg.translate {
+		return bolt.MaxVersion
+	}
+	return b.OfferedVersion()
+}
+
+// Budgets of connected clients, for spotting slow ones. They're keyed by
+// session id and client, as clients on a unix socket all look alike.
+var sessions sync.Map
+
+// The id of the last session we saw, counting up
+var lastSession uint64
+
+// Snapshot of our buffering, published via expvar at /debug/vars
+func budgetStats(global *bolt.Budget) interface{} {
+	clients := map[string]bolt.BudgetStats{}
+	sessions.Range(func(key, value interface{}) bool {
+		clients[key.(string)] = value.(*bolt.Budget).Stats()
+		return true
+	})
+	return map[string]interface{}{
+		"global":   global.Stats(),
+		"sessions": clients,
+	}
+}
+
 // Crude logging routine for helping debug bolt Messages. Tries not to clutter
 // output too much due to large messages while trying to deliniate who logged
 // the message.
+//
+// Whatever the type, messages get logged via bolt.Redact so secrets (like
+// the credentials in a HELLO or LOGON) don't end up in the logs.
 func logMessage(who string, msg *bolt.Message) {
+	if debug.Writer() == ioutil.Discard {
+		return
+	}
+
+	data := bolt.Redact(msg.Data)
 	end := MAX_BYTES
-	suffix := fmt.Sprintf("...+%d bytes", len(msg.Data))
-	if len(msg.Data) < MAX_BYTES {
-		end = len(msg.Data)
+	suffix := fmt.Sprintf("...+%d bytes", len(data))
+	if len(data) < MAX_BYTES {
+		end = len(data)
 		suffix = ""
 	}
 
 	switch msg.T {
-	case bolt.HelloMsg:
-		// make sure we don't print the secrets in a Hello!
-		debug.Printf("[%s] <%s>: %#v\n\n", who, msg.T, msg.Data[:4])
 	case bolt.BeginMsg, bolt.FailureMsg:
-		debug.Printf("[%s] <%s>: %#v\n%s\n", who, msg.T, msg.Data[:end], msg.Data)
+		debug.Printf("[%s] <%s>: %#v\n%s\n", who, msg.T, data[:end], data)
 	default:
-		debug.Printf("[%s] <%s>: %#v%s, last2:%#v\n", who, msg.T, msg.Data[:end], suffix, msg.Data[len(msg.Data)-2:])
+		debug.Printf("[%s] <%s>: %#v%s, last2:%#v\n", who, msg.T, data[:end], suffix, data[len(data)-2:])
 	}
 }
 
@@ -68,47 +129,70 @@ func logMessages(who string, messages []*bolt.Message) {
 // the backend Bolt server and writing them to the given client.
 //
 // Since this should be running async to process server Messages as they
-// arrive, two channels are provided for signaling:
+// arrive, it runs until ctx is cancelled (or the server goes quiet or away)
+// and then signals on ack, basically a way to confirm the requested halt.
 //
-//  ack: used for letting this handler to signal that it's completed and
-//       stopping execution, basically a way to confirm the requested halt
+// If the server is forwarding to the client (see bolt.Forwarder), results
+// are streamed straight through and we only see the messages marking their
+// boundaries (SUCCESS, FAILURE, etc.), already relayed. We stop the
+// forwarding on our way out.
 //
-// halt: used by an external routine to request this handler to cleanly
-//       stop execution
+// Each summary the server sends lets replies of our own queued behind it
+// (see replyQueue) through, and any left waiting on the server once we
+// stop get let through, too.
 //
-func handleTx(client, server bolt.BoltConn, ack chan<- bool, halt <-chan bool) {
+// Once stopped, done gets how long the server took to first answer (0 if
+// it never did), for load balancing.
+func handleTx(ctx context.Context, client, server bolt.BoltConn, replies *replyQueue, ack chan<- bool, done func(time.Duration)) {
 	finished := false
+	start := time.Now()
+	var latency time.Duration
 
 	for !finished {
-		select {
-		case msg, ok := <-server.R():
-			if ok {
-				logMessage("P<-S", msg)
+		server.SetReadDeadline(time.Now().Add(time.Duration(MAX_IDLE_MINS) * time.Minute))
+		msg, err := server.ReadMessage(ctx)
+		switch {
+		case err == nil:
+			logMessage("P<-S", msg)
+			if latency == 0 {
+				latency = time.Since(start)
+			}
+			if !msg.Relayed {
 				err := client.WriteMessage(msg)
 				if err != nil {
-					panic(err)
+					warn.Printf("failed writing to client %s: %s\n", client, err)
+					finished = true
 				}
-				logMessage("C<-P", msg)
+			}
+			logMessage("C<-P", msg)
 
+			switch msg.T {
+			case bolt.SuccessMsg, bolt.FailureMsg, bolt.IgnoreMsg:
+				replies.received()
+			case bolt.GoodbyeMsg:
 				// if know the server side is saying goodbye,
 				// we abort the loop
-				if msg.T == bolt.GoodbyeMsg {
-					finished = true
-				}
-			} else {
-				debug.Println("potential server hangup")
 				finished = true
 			}
-
-		case <-halt:
+			msg.Release()
+		case ctx.Err() != nil:
 			finished = true
-
-		case <-time.After(time.Duration(MAX_IDLE_MINS) * time.Minute):
+		case err == os.ErrDeadlineExceeded:
 			warn.Println("timeout reading server!")
 			finished = true
+		default:
+			debug.Printf("potential server hangup: %s\n", err)
+			finished = true
 		}
 	}
 
+	// must happen before our ACK, as the next tx may reuse this server
+	if fwd, ok := server.(bolt.Forwarder); ok {
+		fwd.Forward(nil)
+	}
+	replies.abandon()
+	done(latency)
+
 	select {
 	case ack <- true:
 		debug.Println("tx handler stop ACK sent")
@@ -121,8 +205,10 @@ func handleTx(client, server bolt.BoltConn, ack chan<- bool, halt <-chan bool) {
 // connection based on handshakes.
 //
 // If so, wrap the incoming conn into a BoltConn and pass it off to
-// a client handler
-func handleClient(conn net.Conn, b *backend.Backend) {
+// a client handler. WebSocket clients offering permessage-deflate get
+// messages of at least cfg.deflateThreshold bytes compressed, unless the
+// threshold is negative.
+func handleClient(conn net.Conn, b *backend.Backend, cfg clientConfig) {
 	defer func() {
 		debug.Printf("closing client connection from %s\n",
 			conn.RemoteAddr())
@@ -141,7 +227,7 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 
 	if bytes.Equal(buf[:4], []byte{0x60, 0x60, 0xb0, 0x17}) {
 		// First case: we have a direct bolt client connection
-		n, err := conn.Read(buf[:20])
+		_, err := io.ReadFull(conn, buf[:16])
 		if err != nil {
 			warn.Println("error peeking at connection from", conn.RemoteAddr())
 			return
@@ -149,18 +235,28 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 
 		// Make sure we try to use the version we're using the best
 		// version based on the backend server
-		serverVersion := b.Version().Bytes()
-		clientVersion, err := bolt.ValidateHandshake(buf[:n], serverVersion)
-		if err != nil {
-			warn.Fatal(err)
+		serverVersion := offeredVersion(b, cfg).Bytes()
+		clientVersion, err := bolt.ValidateHandshake(buf[:16], serverVersion)
+		if err == bolt.ErrNoVersion {
+			info.Printf("client %s offered no version we speak: %#v\n",
+				conn.RemoteAddr(), buf[:16])
+			conn.Write(clientVersion)
+			return
+		} else if err != nil {
+			warn.Println(err)
+			return
 		}
 		_, err = conn.Write(clientVersion)
 		if err != nil {
-			warn.Fatal(err)
+			warn.Printf("failed to finish handshake with client %s: %s\n",
+				conn.RemoteAddr(), err)
+			return
 		}
 
 		// regular bolt
-		handleBoltConn(bolt.NewDirectConn(conn), clientVersion, b)
+		client := bolt.NewDirectConn(conn)
+		client.SetMaxMessageSize(cfg.maxMessageSize)
+		handleBoltConn(client, clientVersion, b, cfg)
 
 	} else if bytes.Equal(buf[:4], []byte{0x47, 0x45, 0x54, 0x20}) {
 		// Second case, we have an HTTP connection that might just
@@ -185,7 +281,11 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 		// Build something implementing the io.ReadWriter interface
 		// to pass to the upgrader routine
 		iobuf := bytes.NewBuffer(buf[:n+4])
-		_, err := ws.Upgrade(iobuf)
+		upgrader := ws.Upgrader{}
+		if cfg.deflateThreshold >= 0 {
+			upgrader.ExtensionCustom = bolt.NegotiateDeflate
+		}
+		hs, err := upgrader.Upgrade(iobuf)
 		if err != nil {
 			warn.Printf("failed to upgrade websocket client %s: %s\n",
 				conn.RemoteAddr(), err)
@@ -206,7 +306,12 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 				conn.RemoteAddr(), err)
 			return
 		}
-		n, err := conn.Read(buf[:header.Length])
+		if header.Length > int64(len(buf)) {
+			warn.Printf("ws handshake from client %s too large (%d bytes)\n",
+				conn.RemoteAddr(), header.Length)
+			return
+		}
+		n, err := io.ReadFull(conn, buf[:header.Length])
 		if err != nil {
 			warn.Printf("failed to read payload from client %s\n",
 				conn.RemoteAddr())
@@ -215,29 +320,61 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 		if header.Masked {
 			ws.Cipher(buf[:n], header.Mask, 0)
 		}
+		payload := buf[:n]
+		deflate := bolt.DeflateNegotiated(hs)
+		if deflate && header.Rsv1() {
+			payload, err = bolt.Inflate(payload, len(buf))
+			if err != nil {
+				warn.Printf("failed to inflate handshake from client %s: %s\n",
+					conn.RemoteAddr(), err)
+				return
+			}
+		}
+		if len(payload) < 20 {
+			warn.Printf("short bolt handshake from client %s\n", conn.RemoteAddr())
+			return
+		}
 
 		// We expect we can now do the initial Bolt handshake
-		magic, handshake := buf[:4], buf[4:20] // blaze it
+		magic, handshake := payload[:4], payload[4:20] // blaze it
 		valid, err := bolt.ValidateMagic(magic)
 		if !valid {
-			warn.Fatal(err)
+			warn.Printf("bad bolt handshake from ws client %s: %s\n",
+				conn.RemoteAddr(), err)
+			return
 		}
 
 		// negotiate client & server side bolt versions
-		serverVersion := b.Version().Bytes()
+		serverVersion := offeredVersion(b, cfg).Bytes()
 		clientVersion, err := bolt.ValidateHandshake(handshake, serverVersion)
-		if err != nil {
-			warn.Fatal(err)
+		if err != nil && err != bolt.ErrNoVersion {
+			warn.Println(err)
+			return
 		}
 
 		// Complete Bolt handshake via WebSocket frame
 		frame := ws.NewBinaryFrame(clientVersion)
-		if err = ws.WriteFrame(conn, frame); err != nil {
-			warn.Fatal(err)
+		if err := ws.WriteFrame(conn, frame); err != nil {
+			warn.Printf("failed to finish handshake with ws client %s: %s\n",
+				conn.RemoteAddr(), err)
+			return
+		}
+		if err == bolt.ErrNoVersion {
+			info.Printf("ws client %s offered no version we speak: %#v\n",
+				conn.RemoteAddr(), handshake)
+			return
 		}
 
 		// Let there be Bolt-via-WebSockets!
-		handleBoltConn(bolt.NewWsConn(conn), clientVersion, b)
+		var client bolt.WsConn
+		if deflate {
+			debug.Printf("compressing messages to client %s\n", conn.RemoteAddr())
+			client = bolt.NewDeflateWsConn(conn, cfg.deflateThreshold)
+		} else {
+			client = bolt.NewWsConn(conn)
+		}
+		client.SetMaxMessageSize(cfg.maxMessageSize)
+		handleBoltConn(client, clientVersion, b, cfg)
 	} else {
 		// not bolt, not http...something else?
 		info.Printf("client %s is speaking gibberish: %#v\n",
@@ -245,6 +382,50 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 	}
 }
 
+// Our SUCCESS for a client's HELLO. We speak for the whole cluster, but
+// pass along what the backend said that changes how it talks (e.g. the utc
+// patch for Bolt 4.3 & 4.4) or how the client should behave (hints), given
+// the metadata of its own reply. Returns an error if what the backend
+// said won't pack.
+func helloSuccess(b *backend.Backend, metadata map[string]interface{}) (*bolt.Message, error) {
+	version := b.Version()
+	reply := map[string]interface{}{
+		"server": fmt.Sprintf("Neo4j/%d.%d.%d",
+			version.Major, version.Minor, version.Patch),
+		"connection_id": "bolt-4",
+	}
+	for _, key := range []string{"patch_bolt", "hints"} {
+		if val, found := metadata[key]; found {
+			reply[key] = val
+		}
+	}
+
+	return (&bolt.Success{Metadata: reply}).Encode()
+}
+
+// Wait for a client to LOGON, telling it off for anything else
+func readLogon(ctx context.Context, client bolt.BoltConn) (*bolt.Logon, error) {
+	msg, err := client.ReadMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logMessage("C->P", msg)
+	defer msg.Release()
+
+	logon := &bolt.Logon{}
+	if msg.T != bolt.LogonMsg {
+		err = fmt.Errorf("expected LOGON, got %s", msg.T)
+	} else {
+		err = logon.Decode(msg)
+	}
+	if err != nil {
+		client.WriteMessage(bolt.NewFailure("Neo.ClientError.Request.Invalid",
+			err.Error()))
+		return nil, err
+	}
+	return logon, nil
+}
+
 // Primary Transaction client-side event handler, collecting Messages from
 // the Bolt client and finding ways to switch them to the proper backend.
 //
@@ -252,93 +433,408 @@ func handleClient(conn net.Conn, b *backend.Backend) {
 //
 // TOOD: this logic should be split out between the authentication and the
 // event loop. For now, this does both.
-func handleBoltConn(client bolt.BoltConn, clientVersion []byte, b *backend.Backend) {
-	// Intercept HELLO message for authentication and hold onto it
-	// for use in backend authentication
-	var hello *bolt.Message
-	select {
-	case msg, ok := <-client.R():
-		if !ok {
-			warn.Println("failed to read expected Hello from client")
-			return
-		}
-		hello = msg
-	case <-time.After(30 * time.Second):
+//
+// What we read from the backend on the client's behalf is bounded by a
+// Budget of cfg.sessionBudget bytes, drawing on the global one. A slow
+// client therefore stalls reads from its backend conns instead of us
+// piling up its results in memory.
+func handleBoltConn(client bolt.BoltConn, clientVersion []byte, b *backend.Backend, cfg clientConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Intercept HELLO message for authentication. We only hold onto its
+	// decoded form, whose credentials get zeroed once we've used them for
+	// backend authentication.
+	client.SetReadDeadline(time.Now().Add(30 * time.Second))
+	msg, err := client.ReadMessage(ctx)
+	if err == os.ErrDeadlineExceeded {
 		warn.Println("timed out waiting for client to auth")
 		return
+	} else if err != nil {
+		warn.Printf("failed to read expected Hello from client: %s\n", err)
+		return
+	}
+	logMessage("C->P", msg)
+
+	if msg.T != bolt.HelloMsg {
+		debug.Println("expected HelloMsg, got:", msg.T)
+		client.WriteMessage(bolt.NewFailure("Neo.ClientError.Request.Invalid",
+			fmt.Sprintf("expected HELLO, got %s", msg.T)))
+		msg.Release()
+		return
 	}
-	logMessage("C->P", hello)
 
-	if hello.T != bolt.HelloMsg {
-		debug.Println("expected HelloMsg, got:", hello.T)
+	hello := &bolt.Hello{}
+	err = hello.Decode(msg)
+	msg.Release()
+	if err != nil {
+		warn.Printf("invalid Hello from client %s: %s\n", client, err)
+		client.WriteMessage(bolt.NewFailure("Neo.ClientError.Request.Invalid",
+			fmt.Sprintf("invalid HELLO: %s", err)))
 		return
 	}
 
-	// get backend connection
-	pool, err := b.Authenticate(hello)
+	v, _ := bolt.ParseVersion(clientVersion)
+	catalog := bolt.CatalogFor(v)
+
+	// Since Bolt 5.1, the auth comes in a LOGON once we've said hello
+	if catalog.Allows(bolt.LogonMsg) {
+		success, err := helloSuccess(b, nil)
+		if err != nil {
+			warn.Printf("can't say hello to client %s: %s\n", client, err)
+			client.WriteMessage(bolt.NewFailure("Neo.DatabaseError.General.UnknownError",
+				err.Error()))
+			return
+		}
+		logMessage("P->C", success)
+		if err = client.WriteMessage(success); err != nil {
+			warn.Println(err)
+			return
+		}
+		logon, err := readLogon(ctx, client)
+		if err != nil {
+			warn.Printf("no LOGON from client %s: %s\n", client, err)
+			return
+		}
+		hello.MergeAuth(logon)
+	}
+
+	// get backend connections speaking the client's version
+	pool, metadata, err := b.Authenticate(hello, v)
 	if err != nil {
 		warn.Println(err)
+		client.WriteMessage(bolt.NewFailure("Neo.ClientError.Security.Unauthorized",
+			err.Error()))
 		return
 	}
 
-	// TODO: this seems odd...move parser and version stuff to bolt pkg
-	v, _ := backend.ParseVersion(clientVersion)
 	info.Printf("authenticated client %s speaking %s to %d host(s)\n",
 		client, v, len(pool))
+	budget := bolt.NewBudget(cfg.sessionBudget, cfg.globalBudget)
+	for _, conn := range pool {
+		conn.SetBudget(budget)
+	}
+	name := fmt.Sprintf("%d %s", atomic.AddUint64(&lastSession, 1), client)
+	sessions.Store(name, budget)
+
 	defer func() {
+		// closing returns anything still queued to the global budget
+		for _, conn := range pool {
+			conn.Close()
+		}
+		sessions.Delete(name)
+
+		stats := budget.Stats()
+		if stats.Stalls > 0 {
+			info.Printf("client %s was slow: stalled its backend %d time(s) for %s\n",
+				client, stats.Stalls, stats.Stalled)
+		}
 		info.Printf("goodbye to client %s\n", client)
 	}()
 
-	// TODO: Replace hardcoded Success message with dynamic one
-	success := bolt.Message{
-		T: bolt.SuccessMsg,
-		Data: []byte{
-			0x0, 0x2b, 0xb1, 0x70,
-			0xa2,
-			0x86, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72,
-			0x8b, 0x4e, 0x65, 0x6f, 0x34, 0x6a, 0x2f, 0x34, 0x2e,
-			0x32, 0x2e, 0x30,
-			0x8d, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64,
-			0x86, 0x62, 0x6f, 0x6c, 0x74, 0x2d, 0x34,
-			0x00, 0x00}}
-	logMessage("P->C", &success)
-	err = client.WriteMessage(&success)
+	// reply to the HELLO, or the LOGON
+	success := bolt.NewSuccess()
+	if !catalog.Allows(bolt.LogonMsg) {
+		success, err = helloSuccess(b, metadata)
+		if err != nil {
+			warn.Printf("can't say hello to client %s: %s\n", client, err)
+			client.WriteMessage(bolt.NewFailure("Neo.DatabaseError.General.UnknownError",
+				err.Error()))
+			return
+		}
+	}
+	logMessage("P->C", success)
+	err = client.WriteMessage(success)
 	if err != nil {
-		warn.Fatal(err)
+		warn.Println(err)
+		return
 	}
 
-	// Time to begin the client-side event loop!
+	// Time to begin the client-side event loop! Anything we answer
+	// ourselves from here on goes through replies, so it can't overtake
+	// the server's answers.
+	replies := newReplyQueue(client)
 	startingTx := false
 	manualTx := false
-	halt := make(chan bool, 1)
-	ack := make(chan bool, 1)
+	// the record we owe a client that asked for a routing table via RUN
+	var routing []interface{}
+	var (
+		stopTx context.CancelFunc
+		ack    chan bool
+	)
+
+	// If we have to send our own FAILURE, the client expects us to
+	// behave like a server would: IGNORE everything until a RESET.
+	failed := false
 
+	// Messages for the server are batched up while the client has more
+	// ready for us (e.g. a pipelined RUN and PULL), so they go out in a
+	// single write
 	var server bolt.BoltConn
+	batch := []*bolt.Message{}
+	batched := 0
+
+	// The tx handler stopped, as the server hung up or stopped answering,
+	// so nobody's left to hear it answer the batch. Answer it ourselves
+	// and let go of the server.
+	unreachable := func() {
+		message := fmt.Sprintf("lost connection to server %s", server)
+		warn.Println(message)
+		out, stillFailed := lostReplies(batch,
+			"Neo.TransientError.General.ServiceUnavailable", message)
+		stopTx()
+		<-ack
+		server = nil
+		replies.reply(out...)
+		failed = stillFailed
+		startingTx = false
+		manualTx = false
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var err error
+		if replies.sent(batch) {
+			err = server.WriteMessages(batch)
+			if err == nil {
+				logMessages("P->S", batch)
+			}
+		} else {
+			unreachable()
+		}
+		for i, msg := range batch {
+			msg.Release()
+			batch[i] = nil
+		}
+		batch = batch[:0]
+		batched = 0
+		return err
+	}
+	defer flush()
+
+	// A done context, for polling the client
+	polling, stopPolling := context.WithCancel(ctx)
+	stopPolling()
+
+	// Fail the message at hand, unless flushing found the server gone,
+	// which already failed the client
+	fail := func(code, message string) {
+		if err := flush(); err != nil {
+			warn.Println(err)
+		}
+		warn.Println(message)
+		if failed {
+			replies.reply(bolt.NewIgnored())
+		} else {
+			replies.reply(bolt.NewFailure(code, message))
+		}
+		failed = true
+		startingTx = false
+		manualTx = false
+	}
+
+	// Writing to the server failed, so it won't be answering what's
+	// outstanding. Tell the client before hanging up on it.
+	lost := func(err error) {
+		replies.abandon()
+		fail("Neo.TransientError.General.DatabaseUnavailable",
+			fmt.Sprintf("failed writing to server %s: %s", server, err))
+	}
+
+	// Returning cancels ctx, which halts any tx handler
 	for {
-		var msg *bolt.Message
-		select {
-		case m, ok := <-client.R():
-			if ok {
-				msg = m
-				logMessage("C->P", msg)
-			} else {
-				debug.Println("potential client hangup")
-				select {
-				case halt <- true:
-					debug.Println("client hungup, asking tx to halt")
-				default:
-					warn.Println("failed to send halt message to tx handler")
-				}
+		msg, err := client.ReadMessage(polling)
+		if err == context.Canceled {
+			// nothing more from the client for now
+			if err = flush(); err != nil {
+				// TODO: figure out best way to handle failed writes
+				lost(err)
 				return
 			}
-		case <-time.After(time.Duration(MAX_IDLE_MINS) * time.Minute):
+			// only reads, as results may well take longer than
+			// that to stream to the client
+			client.SetReadDeadline(time.Now().Add(time.Duration(MAX_IDLE_MINS) * time.Minute))
+			msg, err = client.ReadMessage(ctx)
+		}
+		if err == os.ErrDeadlineExceeded {
 			warn.Println("client idle timeout")
 			return
+		} else if err != nil {
+			debug.Printf("potential client hangup: %s\n", err)
+			return
+		}
+		logMessage("C->P", msg)
+
+		// The transport doesn't know what version we negotiated, so
+		// identify the message again now that we do.
+		msg.T = catalog.IdentifyType(msg.Data)
+
+		// A RESET also has to clear out whatever the server we're
+		// bound to has open, so it gets answered by the server. NOOPs
+		// don't get an answer at all.
+		if failed {
+			switch msg.T {
+			case bolt.ResetMsg:
+				failed = false
+				if server != nil {
+					batch = append(batch, msg)
+					continue
+				}
+				success := bolt.NewSuccess()
+				replies.reply(success)
+			case bolt.GoodbyeMsg:
+				return
+			case bolt.NopMsg:
+			default:
+				replies.reply(bolt.NewIgnored())
+			}
+			msg.Release()
+			continue
+		}
+
+		if msg.T != bolt.NopMsg && !catalog.Allows(msg.T) {
+			fail("Neo.ClientError.Request.Invalid",
+				fmt.Sprintf("message isn't valid in %s", v))
+			continue
 		}
 
-		if msg == nil {
-			// happens during websocket timeout?
-			panic("msg is nil")
+		// Bolt 5.1+ clients can log off and back on as someone else
+		// between transactions, which takes a new set of backend conns.
+		// Drivers only LOGOFF with no transaction open, so whatever is
+		// still streaming back just gets cut off.
+		switch msg.T {
+		case bolt.LogoffMsg:
+			msg.Release()
+			if err = flush(); err != nil {
+				lost(err)
+				return
+			}
+			if server != nil {
+				replies.drain()
+				stopTx()
+				<-ack
+				server = nil
+			}
+			for _, conn := range pool {
+				conn.Close()
+			}
+			pool = nil
+			success := bolt.NewSuccess()
+			replies.reply(success)
+			continue
+		case bolt.LogonMsg:
+			logon := &bolt.Logon{}
+			err = logon.Decode(msg)
+			msg.Release()
+			if err != nil {
+				fail("Neo.ClientError.Request.Invalid",
+					fmt.Sprintf("invalid LOGON: %s", err))
+				continue
+			}
+			if pool != nil {
+				logon.Credentials.Zero()
+				fail("Neo.ClientError.Request.Invalid", "already logged on")
+				continue
+			}
+			hello.MergeAuth(logon)
+			pool, _, err = b.Authenticate(hello, v)
+			if err != nil {
+				fail("Neo.ClientError.Security.Unauthorized", err.Error())
+				continue
+			}
+			for _, conn := range pool {
+				conn.SetBudget(budget)
+			}
+			info.Printf("client %s logged on to %d host(s)\n", client, len(pool))
+			success := bolt.NewSuccess()
+			replies.reply(success)
+			continue
+		}
+
+		// Clients using neo4j:// ask for a routing table, via ROUTE or
+		// (before Bolt 4.3) a RUN of the routing procedure, and get one
+		// pointing back at us. Drivers do so on a connection of its own,
+		// but anything already sent to the server goes first, and our
+		// reply waits on the server's.
+		if cfg.advertise != "" {
+			var reply []*bolt.Message
+			switch msg.T {
+			case bolt.RouteMsg:
+				route := &bolt.Route{}
+				if err = route.Decode(msg); err != nil {
+					fail("Neo.ClientError.Request.Invalid",
+						fmt.Sprintf("invalid ROUTE: %s", err))
+					continue
+				}
+				table, err := emulateRoutingTable(b, route.DB, cfg.advertise)
+				if err != nil {
+					fail("Neo.TransientError.General.DatabaseUnavailable",
+						fmt.Sprintf("error getting routing table: %s", err))
+					continue
+				}
+				success, err := (&bolt.Success{Metadata: map[string]interface{}{"rt": table}}).Encode()
+				if err != nil {
+					fail("Neo.TransientError.General.DatabaseUnavailable",
+						fmt.Sprintf("invalid routing table: %s", err))
+					continue
+				}
+				reply = append(reply, success)
+			case bolt.RunMsg:
+				if manualTx {
+					break
+				}
+				db, found, err := routingQuery(msg)
+				if err != nil {
+					fail("Neo.ClientError.Request.Invalid",
+						fmt.Sprintf("invalid RUN: %s", err))
+					continue
+				} else if !found {
+					break
+				}
+				table, err := emulateRoutingTable(b, db, cfg.advertise)
+				if err != nil {
+					fail("Neo.TransientError.General.DatabaseUnavailable",
+						fmt.Sprintf("error getting routing table: %s", err))
+					continue
+				}
+				routing = []interface{}{table["ttl"], table["servers"]}
+				// a list of two strings always packs
+				success, _ := (&bolt.Success{Metadata: map[string]interface{}{
+					"fields": []interface{}{"ttl", "servers"},
+				}}).Encode()
+				reply = append(reply, success)
+			case bolt.PullMsg, bolt.DiscardMsg:
+				if routing == nil {
+					break
+				}
+				if msg.T == bolt.PullMsg {
+					record, err := (&bolt.Record{Values: routing}).Encode()
+					if err != nil {
+						routing = nil
+						fail("Neo.TransientError.General.DatabaseUnavailable",
+							fmt.Sprintf("invalid routing table: %s", err))
+						continue
+					}
+					reply = append(reply, record)
+				}
+				routing = nil
+				success := bolt.NewSuccess()
+				reply = append(reply, success)
+			}
+			if len(reply) > 0 {
+				msg.Release()
+				if err = flush(); err != nil {
+					lost(err)
+					return
+				}
+				if failed {
+					reply = []*bolt.Message{bolt.NewIgnored()}
+				}
+				replies.reply(reply...)
+				continue
+			}
 		}
 
 		// Inspect the client's message to discern transaction state
@@ -360,70 +856,39 @@ func handleBoltConn(client bolt.BoltConn, clientVersion []byte, b *backend.Backe
 		// XXX: This is a mess, but if we're starting a new transaction
 		// we need to find a new connection to switch to
 		if startingTx {
-			mode, _ := bolt.ValidateMode(msg.Data)
+			if pool == nil {
+				fail("Neo.ClientError.Security.Unauthorized", "not logged on")
+				continue
+			}
 			info, err := b.ClusterInfo()
 			if err != nil {
-				warn.Printf("error getting cluster info: %s\n", err)
-				return
+				fail("Neo.TransientError.General.DatabaseUnavailable",
+					fmt.Sprintf("error getting cluster info: %s", err))
+				continue
 			}
-			db := info.DefaultDb
 
-			// get the db name, if any. otherwise, use default
-			var (
-				m map[string]interface{}
-				n int
-			)
-			if msg.T == bolt.BeginMsg {
-				m, _, err = bolt.ParseMap(msg.Data[4:])
-				if err != nil {
-					warn.Println(err)
-					return
-				}
-			} else if msg.T == bolt.RunMsg {
-				pos := 4
-				// query
-				_, n, err = bolt.ParseString(msg.Data[pos:])
-				if err != nil {
-					warn.Println(err)
-					return
-				}
-				pos = pos + n
-
-				// query params
-				_, n, err = bolt.ParseMap(msg.Data[pos:])
-				if err != nil {
-					warn.Println(err)
-					return
-				}
-				pos = pos + n
-
-				// metadata..like the db name!
-				m, _, err = bolt.ParseMap(msg.Data[pos:])
-				if err != nil {
-					warn.Println(err)
-					return
-				}
-			} else {
-				panic("shouldn't be starting a tx without a Begin or Run message")
+			// get the mode and db name, if any. otherwise, use default
+			if msg.T != bolt.BeginMsg && msg.T != bolt.RunMsg {
+				fail("Neo.ClientError.Request.Invalid",
+					fmt.Sprintf("can't start a transaction with %s", msg.T))
+				continue
 			}
-
-			// Extract the db name, if any
-			val, found := m["db"]
-			if found {
-				ok := false
-				db, ok = val.(string)
-				if !ok {
-					panic("db name wasn't a string?!")
-				}
-			} else {
+			mode, db, err := bolt.ScanTxMetadata(msg)
+			if err != nil {
+				fail("Neo.ClientError.Request.Invalid",
+					fmt.Sprintf("invalid %s message: %s", msg.T, err))
+				continue
+			}
+			if db == "" {
+				db = info.DefaultDb
 				debug.Printf("using default db of %s\n", db)
 			}
 
-			// Just choose the first one for now...something simple
 			rt, err := b.RoutingTable(db)
 			if err != nil {
-				warn.Printf("error getting routing table for %s: %s\n", db, err)
-				return
+				fail("Neo.TransientError.General.DatabaseUnavailable",
+					fmt.Sprintf("error getting routing table for %s: %s", db, err))
+				continue
 			}
 			var hosts []string
 			if mode == bolt.ReadMode {
@@ -436,75 +901,93 @@ func handleBoltConn(client bolt.BoltConn, clientVersion []byte, b *backend.Backe
 			}
 
 			if len(hosts) < 1 {
-				warn.Println("empty hosts lists for database", db)
-				// TODO: return FailureMsg???
-				return
+				fail("Neo.TransientError.General.DatabaseUnavailable",
+					fmt.Sprintf("no hosts available for %s access to database %s", mode, db))
+				continue
 			}
-			host := hosts[0]
 
-			// Are we already using a host? If so try to stop the
-			// current tx handler before we create a new one
-			if server != nil {
-				select {
-				case halt <- true:
-					debug.Println("...asking current tx handler to halt")
-					select {
-					case <-ack:
-						debug.Println("tx handler ack'd stop")
-					case <-time.After(5 * time.Second):
-						warn.Println("!!! timeout waiting for ack from tx handler")
-					}
-				default:
-					// this shouldn't happen!
-					panic("couldn't send halt to tx handler!")
+			// Hosts that don't speak the client's version aren't in
+			// our pool, so the database's balancer picks from those
+			// that are
+			usable := make([]string, 0, len(hosts))
+			for _, h := range hosts {
+				if _, found := pool[h]; found {
+					usable = append(usable, h)
 				}
 			}
+			if len(usable) == 0 {
+				fail("Neo.TransientError.General.DatabaseUnavailable",
+					fmt.Sprintf("no host for %s access to database %s speaks %s", mode, db, v))
+				continue
+			}
 
-			// Grab our host from our local pool
-			ok := false
-			server, ok = pool[host]
-			if !ok {
-				warn.Println("no established connection for host", host)
+			// Are we already using a host? If so try to stop the
+			// current tx handler before we create a new one, once
+			// it's relayed everything the host owes the client. If
+			// it's gone, so is whatever we sent it, and the client
+			// is failed until a RESET.
+			if err = flush(); err != nil {
+				lost(err)
 				return
 			}
+			if failed {
+				msg.Release()
+				replies.reply(bolt.NewIgnored())
+				continue
+			}
+			if server != nil {
+				replies.drain()
+				debug.Println("...asking current tx handler to halt")
+				stopTx()
+				<-ack
+				debug.Println("tx handler ack'd stop")
+			}
+
+			// Grab our host from our local pool
+			balancer := b.Balancer(db)
+			host := balancer.Pick(usable)
+			server = pool[host]
 			debug.Printf("grabbed conn for %s-access to db %s on host %s\n", mode, db, host)
 
-			// TODO: refactor channel handling...probably have handleTx() return new ones
-			// instead of reusing the same ones. If we don't create new ones, there could
-			// be lingering halt/ack messages. :-(
-			halt = make(chan bool, 1)
+			txCtx, cancelTx := context.WithCancel(ctx)
+			stopTx = cancelTx
 			ack = make(chan bool, 1)
 
+			// stream results straight to the client if we can. this
+			// has to happen before the server can possibly reply.
+			if fwd, ok := server.(bolt.Forwarder); ok {
+				fwd.Forward(client)
+			}
+
 			// kick off a new tx handler routine
-			go handleTx(client, server, ack, halt)
+			replies.bind()
+			go handleTx(txCtx, client, server, replies, ack, func(latency time.Duration) {
+				balancer.Done(host, latency)
+			})
 			startingTx = false
 		}
 
 		// TODO: this connected/not-connected handling looks messy
 		if server != nil {
-			err = server.WriteMessage(msg)
-			if err != nil {
-				// TODO: figure out best way to handle failed writes
-				panic(err)
+			batch = append(batch, msg)
+			batched += len(msg.Data)
+			if len(batch) >= MAX_BATCH_MESSAGES || batched >= MAX_BATCH_BYTES {
+				if err = flush(); err != nil {
+					lost(err)
+					return
+				}
 			}
-			logMessage("P->S", msg)
 		} else {
 			// we have no connection since there's no tx...
 			// handle only specific, simple messages
 			switch msg.T {
-			case bolt.ResetMsg:
+			case bolt.ResetMsg, bolt.TelemetryMsg:
 				// XXX: Neo4j Desktop does this when defining a
 				// remote dbms connection.
-				// simply send empty success message
-				client.WriteMessage(&bolt.Message{
-					T: bolt.SuccessMsg,
-					Data: []byte{
-						0x00, 0x03,
-						0xb1, 0x70,
-						0xa0,
-						0x00, 0x00,
-					},
-				})
+				// simply send empty success message, which is
+				// also all a TELEMETRY (Bolt 5.4+) gets from us
+				success := bolt.NewSuccess()
+				replies.reply(success)
 			case bolt.GoodbyeMsg:
 				// bye!
 				return
@@ -517,6 +1000,15 @@ const (
 	DEFAULT_BIND string = "localhost:8888"
 	DEFAULT_URI  string = "bolt://localhost:7687"
 	DEFAULT_USER string = "neo4j"
+	// WebSocket messages smaller than this aren't worth compressing
+	DEFAULT_DEFLATE_THRESHOLD int = 1024
+	// bind addresses with this prefix are Unix domain socket paths
+	UNIX_PREFIX string = "unix://"
+	// Bytes we'll buffer from the backend for one client, and for all
+	DEFAULT_SESSION_BUDGET int = 4 * 1024 * 1024
+	DEFAULT_GLOBAL_BUDGET  int = 256 * 1024 * 1024
+	// The biggest message we'll take from a client
+	DEFAULT_MAX_MESSAGE_SIZE int = bolt.DefaultMaxMessageSize
 )
 
 func main() {
@@ -526,6 +1018,14 @@ func main() {
 		proxyTo            string
 		username, password string
 		certFile, keyFile  string
+		deflateThreshold   int
+		sessionBudget      int
+		globalBudget       int
+		maxMessageSize     int
+		logPeers           bool
+		translate          bool
+		advertise          string
+		balance            string
 	)
 
 	bindOn, found := os.LookupEnv("BOLT_PROXY_BIND")
@@ -541,18 +1041,70 @@ func main() {
 		username = DEFAULT_USER
 	}
 	_, debugMode = os.LookupEnv("BOLT_PROXY_DEBUG")
+	_, logPeers = os.LookupEnv("BOLT_PROXY_LOG_PEERS")
+	_, translate = os.LookupEnv("BOLT_PROXY_TRANSLATE")
+	advertise = os.Getenv("BOLT_PROXY_ADVERTISE")
+	balance = os.Getenv("BOLT_PROXY_BALANCE")
 	password = os.Getenv("BOLT_PROXY_PASSWORD")
 	certFile = os.Getenv("BOLT_PROXY_CERT")
 	keyFile = os.Getenv("BOLT_PROXY_KEY")
+	deflateThreshold = DEFAULT_DEFLATE_THRESHOLD
+	if val, found := os.LookupEnv("BOLT_PROXY_DEFLATE_THRESHOLD"); found {
+		threshold, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("invalid BOLT_PROXY_DEFLATE_THRESHOLD: %s\n", err)
+		}
+		deflateThreshold = threshold
+	}
+	sessionBudget = DEFAULT_SESSION_BUDGET
+	if val, found := os.LookupEnv("BOLT_PROXY_SESSION_BUDGET"); found {
+		limit, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("invalid BOLT_PROXY_SESSION_BUDGET: %s\n", err)
+		}
+		sessionBudget = limit
+	}
+	globalBudget = DEFAULT_GLOBAL_BUDGET
+	if val, found := os.LookupEnv("BOLT_PROXY_GLOBAL_BUDGET"); found {
+		limit, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("invalid BOLT_PROXY_GLOBAL_BUDGET: %s\n", err)
+		}
+		globalBudget = limit
+	}
+	maxMessageSize = DEFAULT_MAX_MESSAGE_SIZE
+	if val, found := os.LookupEnv("BOLT_PROXY_MAX_MESSAGE_SIZE"); found {
+		limit, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("invalid BOLT_PROXY_MAX_MESSAGE_SIZE: %s\n", err)
+		}
+		maxMessageSize = limit
+	}
 
 	// to keep it easy, let the defaults be populated by the env vars
-	flag.StringVar(&bindOn, "bind", bindOn, "host:port to bind to")
-	flag.StringVar(&proxyTo, "uri", proxyTo, "bolt uri for remote Neo4j")
+	flag.StringVar(&bindOn, "bind", bindOn, "host:port or unix:///path/to/socket to bind to")
+	flag.StringVar(&proxyTo, "uri", proxyTo, "bolt uri for remote Neo4j (bolt+unix:// for a local socket)")
 	flag.StringVar(&username, "user", username, "Neo4j username")
 	flag.StringVar(&password, "pass", password, "Neo4j password")
 	flag.StringVar(&certFile, "cert", certFile, "x509 certificate")
 	flag.StringVar(&keyFile, "key", keyFile, "x509 private key")
+	flag.IntVar(&deflateThreshold, "deflate", deflateThreshold,
+		"min bytes to compress WebSocket messages (-1 disables)")
+	flag.IntVar(&sessionBudget, "session-budget", sessionBudget,
+		"max bytes buffered from the backend per client (0 is unlimited)")
+	flag.IntVar(&globalBudget, "global-budget", globalBudget,
+		"max bytes buffered from the backend for all clients (0 is unlimited)")
+	flag.IntVar(&maxMessageSize, "max-message-size", maxMessageSize,
+		"max bytes in a message from a client (0 is unlimited)")
 	flag.BoolVar(&debugMode, "debug", debugMode, "enable debug logging")
+	flag.BoolVar(&logPeers, "log-peers", logPeers,
+		"log pid/uid/gid of unix socket clients (Linux only)")
+	flag.BoolVar(&translate, "translate", translate,
+		"let clients speak newer Bolt versions than the backend, translating")
+	flag.StringVar(&advertise, "advertise", advertise,
+		"host:port clients should use in routing tables (default is the bind address, unless a wildcard)")
+	flag.StringVar(&balance, "balance", balance,
+		"load balancing policies, as policy and/or db=policy, comma separated (default is round-robin)")
 	flag.Parse()
 
 	// We log to stdout because our parents raised us right
@@ -564,7 +1116,35 @@ func main() {
 	}
 	warn = log.New(os.Stderr, "WARN ", log.Ldate|log.Ltime|log.Lmsgprefix)
 
-	// ---------- pprof debugger
+	// clients can't be routed to a unix socket, nor to an address that's
+	// only good for binding to, so without something better to advertise
+	// we leave routing tables to the backend
+	if advertise != "" {
+		if err := checkAdvertise(advertise); err != nil {
+			warn.Fatalf("invalid advertise address %s: %s\n", advertise, err)
+		}
+	} else if !strings.HasPrefix(bindOn, UNIX_PREFIX) {
+		if err := checkAdvertise(bindOn); err != nil {
+			warn.Printf("can't advertise bind address %s (%s), "+
+				"not emulating routing tables (set -advertise)\n", bindOn, err)
+		} else {
+			advertise = bindOn
+		}
+	}
+
+	cfg := clientConfig{
+		deflateThreshold: deflateThreshold,
+		sessionBudget:    int64(sessionBudget),
+		globalBudget:     bolt.NewBudget(int64(globalBudget), nil),
+		maxMessageSize:   maxMessageSize,
+		translate:        translate,
+		advertise:        advertise,
+	}
+
+	// ---------- pprof debugger (and buffering stats at /debug/vars)
+	expvar.Publish("budgets", expvar.Func(func() interface{} {
+		return budgetStats(cfg.globalBudget)
+	}))
 	go func() {
 		info.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -577,13 +1157,21 @@ func main() {
 	}
 	info.Println("connected to backend", proxyTo)
 	info.Printf("found backend version %s\n", backend.Version())
+	info.Printf("backend hosts all speak %s\n", backend.OfferedVersion())
+	if translate {
+		backend.EnableTranslation()
+		info.Printf("translating for clients speaking up to %s\n", bolt.MaxVersion)
+	}
+	if err = backend.SetBalancers(balance); err != nil {
+		warn.Fatalf("invalid load balancing policies: %s\n", err)
+	}
 
 	// ---------- FRONT END
 	info.Println("starting bolt-proxy frontend")
 	var listener net.Listener
 	if certFile == "" || keyFile == "" {
 		// non-tls
-		listener, err = net.Listen("tcp", bindOn)
+		listener, err = listen(bindOn, nil)
 		if err != nil {
 			warn.Fatal(err)
 		}
@@ -595,7 +1183,7 @@ func main() {
 			warn.Fatal(err)
 		}
 		config := &tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, err = tls.Listen("tcp", bindOn, config)
+		listener, err = listen(bindOn, config)
 		if err != nil {
 			warn.Fatal(err)
 		}
@@ -607,8 +1195,44 @@ func main() {
 		conn, err := listener.Accept()
 		if err != nil {
 			warn.Printf("error: %v\n", err)
-		} else {
-			go handleClient(conn, backend)
+			continue
+		}
+		if logPeers && conn.RemoteAddr().Network() == "unix" {
+			peer, err := peerCredentials(conn)
+			if err != nil {
+				warn.Printf("can't identify unix socket peer: %s\n", err)
+			} else {
+				info.Printf("accepted unix socket client %s\n", peer)
+			}
 		}
+		go handleClient(conn, backend, cfg)
+	}
+}
+
+// Listen on bindOn, either a host:port or a unix:// path to a Unix domain
+// socket, wrapping connections in TLS if given a config.
+func listen(bindOn string, config *tls.Config) (net.Listener, error) {
+	network, address := "tcp", bindOn
+	if strings.HasPrefix(bindOn, UNIX_PREFIX) {
+		network, address = "unix", strings.TrimPrefix(bindOn, UNIX_PREFIX)
+
+		// clean up after a previous run that didn't get to, unless
+		// somebody is still listening on it
+		fi, err := os.Stat(address)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", address)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("socket %s is already in use", address)
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				os.Remove(address)
+			}
+		}
+	}
+
+	if config != nil {
+		return tls.Listen(network, address, config)
 	}
+	return net.Listen(network, address)
 }
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voutilad/bolt-proxy/backend"
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+// The event loop logs from go routines that may outlive a test, so rather
+// than swapping loggers, tests quiet them once, redirecting their output
+// if they need to see it
+func init() {
+	debug = log.New(ioutil.Discard, "DEBUG ", 0)
+	info = log.New(ioutil.Discard, "INFO ", 0)
+	warn = log.New(ioutil.Discard, "WARN ", 0)
+}
+
+func TestLogMessageRedactsCredentials(t *testing.T) {
+	secret := []byte("sup3r-s3cret")
+	out := &bytes.Buffer{}
+	debug.SetOutput(out)
+	defer debug.SetOutput(ioutil.Discard)
+
+	hello, err := (&bolt.Hello{UserAgent: "bolt-proxy", Scheme: "basic",
+		Principal: "neo4j", Credentials: bolt.NewCredentials(secret)}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := bolt.Pack(bolt.Structure{Tag: 0x6a, Fields: []interface{}{
+		map[string]interface{}{"scheme": "basic", "principal": "neo4j",
+			"credentials": string(secret)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logon := bolt.Chunker{}.Message(payload)
+	// a message type we log in full
+	failure := bolt.NewFailure("Neo.ClientError.Security.Unauthorized",
+		"no thanks")
+
+	logMessages("C->P", []*bolt.Message{hello, logon, failure})
+	if out.Len() == 0 {
+		t.Fatal("expected some debug output")
+	}
+	// message bytes get logged as Go syntax, too
+	hex := strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%#v", secret), "[]byte{"), "}")
+	if bytes.Contains(out.Bytes(), secret) || strings.Contains(out.String(), hex) {
+		t.Fatalf("found the secret in the log:\n%s", out)
+	}
+}
+
+func TestRoutingQuery(t *testing.T) {
+	for _, test := range []struct {
+		run   bolt.Run
+		db    string
+		found bool
+	}{
+		{bolt.Run{Query: "CALL dbms.routing.getRoutingTable($context, $database)",
+			Params: map[string]interface{}{"context": map[string]interface{}{},
+				"database": "movies"}}, "movies", true},
+		{bolt.Run{Query: "CALL dbms.cluster.routing.getRoutingTable($context)",
+			Params: map[string]interface{}{"context": map[string]interface{}{}}}, "", true},
+		{bolt.Run{Query: "RETURN 'routing.getRoutingTable' AS trick",
+			Params: map[string]interface{}{}}, "", false},
+		{bolt.Run{Query: "MATCH (n) RETURN n"}, "", false},
+	} {
+		msg, err := test.run.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, found, err := routingQuery(msg)
+		if err != nil || db != test.db || found != test.found {
+			t.Fatalf("expected (%q, %v) for %q, got (%q, %v, %v)\n",
+				test.db, test.found, test.run.Query, db, found, err)
+		}
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	rt := backend.RoutingTable{Name: "movies", Ttl: 10 * time.Second,
+		Readers: []string{"host-2:7687", "host-3:7687"}, Writers: []string{"host-1:7687"}}
+
+	table := routingTable(rt, "proxy:8888")
+	if table["ttl"] != 10 || table["db"] != "movies" {
+		t.Fatalf("unexpected routing table %v\n", table)
+	}
+	roles := map[string]bool{}
+	for _, server := range table["servers"].([]interface{}) {
+		server := server.(map[string]interface{})
+		addresses := server["addresses"].([]interface{})
+		if len(addresses) != 1 || addresses[0] != "proxy:8888" {
+			t.Fatalf("expected only the proxy, got %v\n", addresses)
+		}
+		roles[server["role"].(string)] = true
+	}
+	if !roles["ROUTE"] || !roles["READ"] || !roles["WRITE"] {
+		t.Fatalf("expected the proxy in every role, got %v\n", roles)
+	}
+
+	// it has to pack to be of any use
+	if _, err := (&bolt.Success{Metadata: map[string]interface{}{"rt": table}}).Encode(); err != nil {
+		t.Fatal(err)
+	}
+	if table = routingTable(backend.RoutingTable{}, "proxy:8888"); table["ttl"] != 300 {
+		t.Fatalf("expected the default ttl, got %v\n", table["ttl"])
+	}
+}
+
+func TestCheckAdvertise(t *testing.T) {
+	for _, addr := range []string{"proxy.example.com:8888", "localhost:8888", "10.0.0.5:8888", "[::1]:8888"} {
+		if err := checkAdvertise(addr); err != nil {
+			t.Fatalf("expected %s to be usable, got %s\n", addr, err)
+		}
+	}
+	for _, addr := range []string{":8888", "0.0.0.0:8888", "[::]:8888", "proxy.example.com"} {
+		if err := checkAdvertise(addr); err == nil {
+			t.Fatalf("expected %s to be rejected\n", addr)
+		}
+	}
+}
+
+// A client that just keeps track of what it's sent
+type recordingConn struct {
+	bolt.BoltConn
+	sync.Mutex
+	written []bolt.Type
+}
+
+func (r *recordingConn) WriteMessage(msg *bolt.Message) error {
+	return r.WriteMessages([]*bolt.Message{msg})
+}
+
+func (r *recordingConn) WriteMessages(messages []*bolt.Message) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, msg := range messages {
+		r.written = append(r.written, msg.T)
+	}
+	return nil
+}
+
+func (r *recordingConn) types() []bolt.Type {
+	r.Lock()
+	defer r.Unlock()
+	return append([]bolt.Type{}, r.written...)
+}
+
+func TestReplyQueue(t *testing.T) {
+	client := &recordingConn{}
+	replies := newReplyQueue(client)
+	success := bolt.NewSuccess()
+	run, _ := (&bolt.Run{Query: "RETURN 1"}).Encode()
+	pull, _ := (&bolt.Pull{N: -1, Qid: -1}).Encode()
+	noop := &bolt.Message{T: bolt.NopMsg, Data: []byte{0x00, 0x00}}
+
+	// our FAILURE waits for the server to answer the RUN and PULL
+	replies.sent([]*bolt.Message{run, pull, noop})
+	replies.reply(bolt.NewFailure("Neo.ClientError.Request.Invalid", "nope"))
+	for i := 0; i < 2; i++ {
+		if len(client.types()) != i {
+			t.Fatalf("expected nothing of ours yet, got %v\n", client.types())
+		}
+		client.WriteMessage(success)
+		replies.received()
+	}
+	expected := fmt.Sprint([]bolt.Type{bolt.SuccessMsg, bolt.SuccessMsg, bolt.FailureMsg})
+	if fmt.Sprint(client.types()) != expected {
+		t.Fatalf("expected %s, got %v\n", expected, client.types())
+	}
+	if replies.busy() {
+		t.Fatal("expected nothing left owed")
+	}
+
+	// draining waits on the server, unless it goes away
+	replies.sent([]*bolt.Message{run})
+	replies.reply(bolt.NewIgnored())
+	drained := make(chan bool)
+	go func() {
+		replies.drain()
+		drained <- true
+	}()
+	select {
+	case <-drained:
+		t.Fatal("expected to wait for the server")
+	case <-time.After(10 * time.Millisecond):
+	}
+	replies.abandon()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out draining")
+	}
+	if types := client.types(); types[len(types)-1] != bolt.IgnoreMsg {
+		t.Fatalf("expected our IGNORED let through, got %v\n", types)
+	}
+
+	// nothing more is owed by a server that's gone, until the next
+	if replies.sent([]*bolt.Message{run}) || replies.busy() {
+		t.Fatal("expected nothing owed by an abandoned server")
+	}
+	replies.bind()
+	if !replies.sent([]*bolt.Message{run}) || !replies.busy() {
+		t.Fatal("expected a summary owed by a new server")
+	}
+}
+
+func TestServerGoneMidTx(t *testing.T) {
+	conn, hangup := net.Pipe()
+	server := bolt.NewDirectConn(conn)
+	defer server.Close()
+	client := &recordingConn{}
+	replies := newReplyQueue(client)
+	ack := make(chan bool, 1)
+
+	replies.bind()
+	stopped := make(chan bool)
+	go func() {
+		handleTx(context.Background(), client, server, replies, ack, func(time.Duration) {})
+		close(stopped)
+	}()
+	run, _ := (&bolt.Run{Query: "RETURN 1"}).Encode()
+	replies.sent([]*bolt.Message{run})
+
+	// the server hangs up before answering, so the RUN's answer isn't
+	// waited on, and what follows it won't be sent
+	hangup.Close()
+	select {
+	case <-ack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the tx handler to stop")
+	}
+	pull, _ := (&bolt.Pull{N: -1, Qid: -1}).Encode()
+	if replies.busy() || replies.sent([]*bolt.Message{pull}) {
+		t.Fatal("expected nothing owed by a server that hung up")
+	}
+	<-stopped
+}
+
+func TestLostReplies(t *testing.T) {
+	run, _ := (&bolt.Run{Query: "RETURN 1"}).Encode()
+	pull, _ := (&bolt.Pull{N: -1, Qid: -1}).Encode()
+	reset, _ := (&bolt.Reset{}).Encode()
+	noop := &bolt.Message{T: bolt.NopMsg, Data: []byte{0x00, 0x00}}
+
+	for _, test := range []struct {
+		batch    []*bolt.Message
+		expected []bolt.Type
+		failed   bool
+	}{
+		{[]*bolt.Message{run, noop, pull},
+			[]bolt.Type{bolt.FailureMsg, bolt.IgnoreMsg}, true},
+		{[]*bolt.Message{pull, reset},
+			[]bolt.Type{bolt.FailureMsg, bolt.SuccessMsg}, false},
+		{[]*bolt.Message{noop}, []bolt.Type{}, false},
+	} {
+		out, failed := lostReplies(test.batch,
+			"Neo.TransientError.General.ServiceUnavailable", "gone")
+		types := []bolt.Type{}
+		for _, msg := range out {
+			types = append(types, msg.T)
+		}
+		if fmt.Sprint(types) != fmt.Sprint(test.expected) || failed != test.failed {
+			t.Fatalf("expected %v (failed: %t), got %v (failed: %t)\n",
+				test.expected, test.failed, types, failed)
+		}
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bindOn := UNIX_PREFIX + filepath.Join(dir, "proxy.sock")
+
+	first, err := listen(bindOn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listen(bindOn, nil); err == nil {
+		t.Fatal("expected a socket in use to be left alone")
+	}
+
+	// a socket left behind by a proxy that's gone gets replaced
+	first.(*net.UnixListener).SetUnlinkOnClose(false)
+	first.Close()
+	second, err := listen(bindOn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+}
+
+// A pretend Neo4j host speaking the given version, which answers whatever
+// it gets with a SUCCESS (and a PULL with a RECORD, too). It hands the
+// types of messages it gets to seen, holds off answering RETURN 'slow'
+// until hold is closed, and hangs up after answering RETURN 'bye'.
+func fakeNeo4j(t *testing.T, version bolt.Version, seen chan<- bolt.Type, hold <-chan bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 20)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		chosen, _ := bolt.ValidateHandshake(buf[4:20], version.Bytes())
+		if _, err := conn.Write(chosen); err != nil {
+			return
+		}
+
+		client := bolt.NewDirectConn(conn)
+		record, _ := (&bolt.Record{Values: []interface{}{1}}).Encode()
+		for {
+			msg, err := client.ReadMessage(context.Background())
+			if err != nil {
+				return
+			}
+			if seen != nil {
+				seen <- msg.T
+			}
+			query := ""
+			if msg.T == bolt.RunMsg {
+				run := &bolt.Run{}
+				run.Decode(msg)
+				query = run.Query
+			}
+			switch {
+			case msg.T == bolt.GoodbyeMsg:
+				return
+			case msg.T == bolt.PullMsg:
+				client.WriteMessages([]*bolt.Message{record, bolt.NewSuccess()})
+			case query == "RETURN 'slow'":
+				<-hold
+				client.WriteMessage(bolt.NewSuccess())
+			case query == "RETURN 'bye'":
+				client.WriteMessage(bolt.NewSuccess())
+				return
+			default:
+				client.WriteMessage(bolt.NewSuccess())
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// A backend of the one host, serving the neo4j database
+func fakeBackend(host string) *backend.Backend {
+	now := time.Now()
+	return backend.NewStaticBackend(log.New(ioutil.Discard, "", 0),
+		backend.Version{Major: 5, Minor: 4},
+		backend.ClusterInfo{DefaultDb: "neo4j", Hosts: []string{host}, CreatedAt: now},
+		backend.RoutingTable{Name: "neo4j", Readers: []string{host}, Writers: []string{host},
+			Routers: []string{host}, CreatedAt: now, Ttl: time.Minute})
+}
+
+// A client of handleBoltConn, over a net.Pipe
+type testSession struct {
+	t      *testing.T
+	client bolt.BoltConn
+	done   chan bool
+}
+
+func startSession(t *testing.T, b *backend.Backend, cfg clientConfig, version bolt.Version) *testSession {
+	conn, proxy := net.Pipe()
+	s := &testSession{t: t, client: bolt.NewDirectConn(conn), done: make(chan bool)}
+	go func() {
+		handleBoltConn(bolt.NewDirectConn(proxy), version.Bytes(), b, cfg)
+		proxy.Close()
+		close(s.done)
+	}()
+	return s
+}
+
+// Send messages without waiting for them to be read, as the proxy might
+// not read them all before we read its replies
+func (s *testSession) send(typed ...bolt.TypedMessage) {
+	messages := make([]*bolt.Message, len(typed))
+	for i, m := range typed {
+		msg, err := m.Encode()
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		messages[i] = msg
+	}
+	go s.client.WriteMessages(messages)
+}
+
+// Read the next messages, which have to be of the given types
+func (s *testSession) expect(types ...bolt.Type) []*bolt.Message {
+	s.t.Helper()
+	messages := make([]*bolt.Message, len(types))
+	for i, expected := range types {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		msg, err := s.client.ReadMessage(ctx)
+		cancel()
+		if err != nil {
+			s.t.Fatalf("expected %s, got %v\n", expected, err)
+		}
+		if msg.T != expected {
+			s.t.Fatalf("expected %s, got %s (%#v)\n", expected, msg.T, msg.Data)
+		}
+		messages[i] = msg
+	}
+	return messages
+}
+
+// Hang up, and wait for the proxy to notice
+func (s *testSession) close() {
+	s.client.Close()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("timed out waiting for the session to end")
+	}
+}
+
+func testConfig() clientConfig {
+	return clientConfig{globalBudget: bolt.NewBudget(0, nil)}
+}
+
+func TestSession(t *testing.T) {
+	v := bolt.Version{Major: 5, Minor: 4}
+	b := fakeBackend(fakeNeo4j(t, v, nil, nil))
+	s := startSession(t, b, testConfig(), v)
+	defer s.close()
+
+	logon := func() *bolt.Logon {
+		return &bolt.Logon{Scheme: "basic", Principal: "neo4j",
+			Credentials: bolt.NewCredentials([]byte("password"))}
+	}
+	s.send(&bolt.Hello{UserAgent: "test"})
+	s.expect(bolt.SuccessMsg)
+	s.send(logon())
+	s.expect(bolt.SuccessMsg)
+
+	// more than a batch's worth of pipelined messages, all answered in
+	// order
+	pipelined := []bolt.TypedMessage{&bolt.Begin{}}
+	for i := 0; i < MAX_BATCH_MESSAGES+10; i++ {
+		pipelined = append(pipelined, &bolt.Run{Query: "RETURN 1"})
+	}
+	pipelined = append(pipelined, &bolt.Commit{})
+	s.send(pipelined...)
+	answers := make([]bolt.Type, len(pipelined))
+	for i := range answers {
+		answers[i] = bolt.SuccessMsg
+	}
+	s.expect(answers...)
+
+	// logged off, there's nobody to run anything as until we log on
+	s.send(&bolt.Logoff{})
+	s.expect(bolt.SuccessMsg)
+	s.send(&bolt.Run{Query: "RETURN 1"}, &bolt.Pull{N: -1, Qid: -1}, &bolt.Reset{})
+	s.expect(bolt.FailureMsg, bolt.IgnoreMsg, bolt.SuccessMsg)
+	s.send(logon())
+	s.expect(bolt.SuccessMsg)
+	s.send(&bolt.Run{Query: "RETURN 1"}, &bolt.Pull{N: -1, Qid: -1})
+	s.expect(bolt.SuccessMsg, bolt.RecordMsg, bolt.SuccessMsg)
+
+	// once the server hangs up, writing to it gets the client a FAILURE
+	s.send(&bolt.Begin{}, &bolt.Run{Query: "RETURN 'bye'"})
+	s.expect(bolt.SuccessMsg, bolt.SuccessMsg)
+	time.Sleep(100 * time.Millisecond)
+	s.send(&bolt.Pull{N: -1, Qid: -1})
+	failure := &bolt.Failure{}
+	if err := failure.Decode(s.expect(bolt.FailureMsg)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(failure.Code, "Neo.TransientError.") {
+		t.Fatalf("expected a transient error, got %s\n", failure.Code)
+	}
+}
+
+func TestRoutingEmulation(t *testing.T) {
+	seen := make(chan bolt.Type, 10)
+	hold := make(chan bool)
+	v := bolt.Version{Major: 4, Minor: 4}
+	b := fakeBackend(fakeNeo4j(t, v, seen, hold))
+	cfg := testConfig()
+	cfg.advertise = "proxy.example.com:8888"
+	s := startSession(t, b, cfg, v)
+	defer s.close()
+
+	s.send(&bolt.Hello{UserAgent: "test", Scheme: "basic", Principal: "neo4j",
+		Credentials: bolt.NewCredentials([]byte("password"))})
+	s.expect(bolt.SuccessMsg)
+	if found := <-seen; found != bolt.HelloMsg {
+		t.Fatalf("expected the host to get a HELLO, got %s\n", found)
+	}
+
+	// the routing procedure gets run by us, not the host, and points
+	// clients back at us
+	s.send(&bolt.Run{Query: "CALL dbms.routing.getRoutingTable($context, $database)",
+		Params: map[string]interface{}{"context": map[string]interface{}{}, "database": "neo4j"}},
+		&bolt.Pull{N: -1, Qid: -1})
+	record := &bolt.Record{}
+	if err := record.Decode(s.expect(bolt.SuccessMsg, bolt.RecordMsg, bolt.SuccessMsg)[1]); err != nil {
+		t.Fatal(err)
+	}
+	servers, ok := record.Values[1].([]interface{})
+	if !ok || len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %#v\n", record.Values)
+	}
+	for _, server := range servers {
+		addresses := server.(map[string]interface{})["addresses"].([]interface{})
+		if len(addresses) != 1 || addresses[0] != cfg.advertise {
+			t.Fatalf("expected only %s, got %v\n", cfg.advertise, addresses)
+		}
+	}
+	select {
+	case found := <-seen:
+		t.Fatalf("expected nothing sent to the host, got %s\n", found)
+	default:
+	}
+
+	// a ROUTE waits for the host to answer what was sent before it
+	s.send(&bolt.Run{Query: "RETURN 'slow'"}, &bolt.Pull{N: -1, Qid: -1},
+		&bolt.Route{Routing: map[string]interface{}{}, DB: "neo4j"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	msg, err := s.client.ReadMessage(ctx)
+	cancel()
+	if err == nil {
+		t.Fatalf("expected nothing before the host answers, got %s\n", msg.T)
+	}
+	close(hold)
+	success := &bolt.Success{}
+	replies := s.expect(bolt.SuccessMsg, bolt.RecordMsg, bolt.SuccessMsg, bolt.SuccessMsg)
+	if err = success.Decode(replies[3]); err != nil {
+		t.Fatal(err)
+	}
+	if success.Metadata["rt"] == nil {
+		t.Fatalf("expected the routing table last, got %v\n", success.Metadata)
+	}
+	for _, expected := range []bolt.Type{bolt.RunMsg, bolt.PullMsg} {
+		if found := <-seen; found != expected {
+			t.Fatalf("expected the host to get %s, got %s\n", expected, found)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+// Keeps the replies we make up ourselves (FAILUREs, IGNOREDs, routing
+// tables, etc.) in order with the server's. Every message sent to the
+// server is owed exactly one summary (SUCCESS, FAILURE or IGNORED) back,
+// and a reply of ours waits until the server has answered everything
+// sent before it.
+type replyQueue struct {
+	sync.Mutex
+	client bolt.BoltConn
+	// nil for a summary the server owes us, otherwise one of ours
+	pending []*bolt.Message
+	idle    *sync.Cond
+	// the server we're waiting on stopped answering
+	gone bool
+}
+
+func newReplyQueue(client bolt.BoltConn) *replyQueue {
+	q := &replyQueue{client: client}
+	q.idle = sync.NewCond(q)
+	return q
+}
+
+// Whether msg, once sent, gets a summary back. NOOPs and GOODBYEs don't.
+func answered(msg *bolt.Message) bool {
+	return msg.T != bolt.NopMsg && msg.T != bolt.GoodbyeMsg
+}
+
+// Note that messages are being sent to the server, each owed a summary.
+// Returns false, noting nothing, if the server was abandoned and nobody
+// is left to hear its answers.
+func (q *replyQueue) sent(messages []*bolt.Message) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.gone {
+		return false
+	}
+	for _, msg := range messages {
+		if answered(msg) {
+			q.pending = append(q.pending, nil)
+		}
+	}
+	return true
+}
+
+// Start waiting on a new server's answers
+func (q *replyQueue) bind() {
+	q.Lock()
+	defer q.Unlock()
+	q.gone = false
+}
+
+// Send our own replies to the client, once the server is done answering
+// whatever came before them
+func (q *replyQueue) reply(messages ...*bolt.Message) {
+	q.Lock()
+	defer q.Unlock()
+	q.pending = append(q.pending, messages...)
+	q.writeReady()
+}
+
+// The server answered the oldest message it owes a summary for, and the
+// client has it
+func (q *replyQueue) received() {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.pending) > 0 && q.pending[0] == nil {
+		q.pending = q.pending[1:]
+	}
+	q.writeReady()
+}
+
+// The server's gone, so stop waiting on it and let our replies through
+// until we bind to another
+func (q *replyQueue) abandon() {
+	q.Lock()
+	defer q.Unlock()
+	q.gone = true
+	ours := q.pending[:0]
+	for _, msg := range q.pending {
+		if msg != nil {
+			ours = append(ours, msg)
+		}
+	}
+	q.pending = ours
+	q.writeReady()
+}
+
+// Wait until the server has answered everything sent to it, and the
+// client has all our replies
+func (q *replyQueue) drain() {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.pending) > 0 {
+		q.idle.Wait()
+	}
+}
+
+// Whether anything's still owed to the client
+func (q *replyQueue) busy() bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending) > 0
+}
+
+// What the client gets for a batch of messages the server never saw, as
+// it went away: a FAILURE, then IGNOREDs until a RESET. Also returns
+// whether the client is left failed.
+func lostReplies(batch []*bolt.Message, code, message string) ([]*bolt.Message, bool) {
+	failed := false
+	out := []*bolt.Message{}
+	for _, msg := range batch {
+		switch {
+		case !answered(msg):
+		case msg.T == bolt.ResetMsg:
+			success := bolt.NewSuccess()
+			out = append(out, success)
+			failed = false
+		case failed:
+			out = append(out, bolt.NewIgnored())
+		default:
+			out = append(out, bolt.NewFailure(code, message))
+			failed = true
+		}
+	}
+	return out, failed
+}
+
+// Write our replies at the head of the queue. Must hold the lock.
+func (q *replyQueue) writeReady() {
+	n := 0
+	for n < len(q.pending) && q.pending[n] != nil {
+		n++
+	}
+	if n > 0 {
+		ready := q.pending[:n]
+		logMessages("P->C", ready)
+		if err := q.client.WriteMessages(ready); err != nil {
+			warn.Printf("failed writing to client %s: %s\n", q.client, err)
+		}
+		for i := range ready {
+			ready[i] = nil
+		}
+		q.pending = q.pending[n:]
+	}
+	if len(q.pending) == 0 {
+		q.idle.Broadcast()
+	}
+}
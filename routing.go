@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/voutilad/bolt-proxy/backend"
+	"github.com/voutilad/bolt-proxy/bolt"
+)
+
+// The ttl we hand out if the backend didn't give us one
+const DEFAULT_ROUTING_TTL = 300 * time.Second
+
+// Found in any RUN asking for a routing table, for a cheap first look
+const ROUTING_PROCEDURE = "routing.getRoutingTable"
+
+// What older drivers (before Bolt 4.3 gave us ROUTE) run to get a routing
+// table: dbms.routing.getRoutingTable since 4.0, or
+// dbms.cluster.routing.getRoutingTable before
+var routingCalls = []string{
+	"CALL dbms.routing.getRoutingTable(",
+	"CALL dbms.cluster.routing.getRoutingTable(",
+}
+
+// If msg is a RUN calling one of the routing table procedures, return the
+// database it asks about, if any, and true
+func routingQuery(msg *bolt.Message) (string, bool, error) {
+	if !bytes.Contains(msg.Data, []byte(ROUTING_PROCEDURE)) {
+		return "", false, nil
+	}
+	run := &bolt.Run{}
+	if err := run.Decode(msg); err != nil {
+		return "", false, err
+	}
+	query := strings.TrimSpace(run.Query)
+	for _, call := range routingCalls {
+		if strings.HasPrefix(query, call) {
+			db, _ := run.Params["database"].(string)
+			return db, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Our answer to a client asking for the routing table for rt's database:
+// the proxy, at the advertised address, is all it needs. Keeps clients
+// using neo4j:// from going around us.
+func routingTable(rt backend.RoutingTable, advertise string) map[string]interface{} {
+	ttl := rt.Ttl
+	if ttl <= 0 {
+		ttl = DEFAULT_ROUTING_TTL
+	}
+
+	servers := make([]interface{}, 0, 3)
+	for _, role := range []string{"ROUTE", "READ", "WRITE"} {
+		servers = append(servers, map[string]interface{}{
+			"addresses": []interface{}{advertise},
+			"role":      role,
+		})
+	}
+	return map[string]interface{}{
+		"ttl":     int(ttl / time.Second),
+		"db":      rt.Name,
+		"servers": servers,
+	}
+}
+
+// Check clients could reach us at the advertised host:port, which a
+// wildcard (e.g. 0.0.0.0) or missing host won't do
+func checkAdvertise(advertise string) error {
+	host, _, err := net.SplitHostPort(advertise)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("%s isn't an address clients can use", host)
+	}
+	return nil
+}
+
+// Look up the routing table for db, or the default database if empty, and
+// make it ours
+func emulateRoutingTable(b *backend.Backend, db, advertise string) (map[string]interface{}, error) {
+	if db == "" {
+		info, err := b.ClusterInfo()
+		if err != nil {
+			return nil, err
+		}
+		db = info.DefaultDb
+	}
+	rt, err := b.RoutingTable(db)
+	if err != nil {
+		return nil, err
+	}
+	return routingTable(rt, advertise), nil
+}